@@ -148,6 +148,43 @@ func BenchmarkUnmarshalToml(b *testing.B) {
 	}
 }
 
+// Decodes a parsed document repeatedly, to measure the mapping of the tree to
+// the struct alone.
+func BenchmarkUnmarshalTomlTree(b *testing.B) {
+	tree, err := toml.LoadFile("benchmark.toml")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		target := benchmarkDoc{}
+		err := tree.Unmarshal(&target)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalToml(b *testing.B) {
+	bytes, err := ioutil.ReadFile("benchmark.toml")
+	if err != nil {
+		b.Fatal(err)
+	}
+	doc := benchmarkDoc{}
+	if err := toml.Unmarshal(bytes, &doc); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := toml.Marshal(doc)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func BenchmarkUnmarshalBurntSushiToml(b *testing.B) {
 	bytes, err := ioutil.ReadFile("benchmark.toml")
 	if err != nil {
@@ -18,6 +18,8 @@ import (
 
 func main() {
 	multiLineArray := flag.Bool("multiLineArray", false, "sets up the linter to encode arrays with more than one element on multiple lines instead of one.")
+	alignEquals := flag.Bool("alignEquals", false, "sets up the linter to align the equal signs of consecutive key/value lines.")
+	alignComments := flag.Bool("alignComments", false, "sets up the linter to align the trailing comments of consecutive key/value lines.")
 	flag.Usage = func() {
 		fmt.Fprintln(os.Stderr, "tomll can be used in two ways:")
 		fmt.Fprintln(os.Stderr, "Writing to STDIN and reading from STDOUT:")
@@ -31,12 +33,14 @@ func main() {
 		fmt.Fprintln(os.Stderr, "")
 		fmt.Fprintln(os.Stderr, "Flags:")
 		fmt.Fprintln(os.Stderr, "-multiLineArray      sets up the linter to encode arrays with more than one element on multiple lines instead of one.")
+		fmt.Fprintln(os.Stderr, "-alignEquals         sets up the linter to align the equal signs of consecutive key/value lines.")
+		fmt.Fprintln(os.Stderr, "-alignComments       sets up the linter to align the trailing comments of consecutive key/value lines.")
 	}
 	flag.Parse()
 
 	// read from stdin and print to stdout
 	if flag.NArg() == 0 {
-		s, err := lintReader(os.Stdin, *multiLineArray)
+		s, err := lintReader(os.Stdin, *multiLineArray, *alignEquals, *alignComments)
 		if err != nil {
 			io.WriteString(os.Stderr, err.Error())
 			os.Exit(-1)
@@ -45,7 +49,7 @@ func main() {
 	} else {
 		// otherwise modify a list of files
 		for _, filename := range flag.Args() {
-			s, err := lintFile(filename, *multiLineArray)
+			s, err := lintFile(filename, *multiLineArray, *alignEquals, *alignComments)
 			if err != nil {
 				io.WriteString(os.Stderr, err.Error())
 				os.Exit(-1)
@@ -55,28 +59,28 @@ func main() {
 	}
 }
 
-func lintFile(filename string, multiLineArray bool) (string, error) {
+func lintFile(filename string, multiLineArray, alignEquals, alignComments bool) (string, error) {
 	tree, err := toml.LoadFile(filename)
 	if err != nil {
 		return "", err
 	}
 
 	buf := new(bytes.Buffer)
-	if err := toml.NewEncoder(buf).ArraysWithOneElementPerLine(multiLineArray).Encode(tree); err != nil {
+	if err := toml.NewEncoder(buf).ArraysWithOneElementPerLine(multiLineArray).AlignEquals(alignEquals).AlignComments(alignComments).Encode(tree); err != nil {
 		panic(err)
 	}
 
 	return buf.String(), nil
 }
 
-func lintReader(r io.Reader, multiLineArray bool) (string, error) {
+func lintReader(r io.Reader, multiLineArray, alignEquals, alignComments bool) (string, error) {
 	tree, err := toml.LoadReader(r)
 	if err != nil {
 		return "", err
 	}
 
 	buf := new(bytes.Buffer)
-	if err := toml.NewEncoder(buf).ArraysWithOneElementPerLine(multiLineArray).Encode(tree); err != nil {
+	if err := toml.NewEncoder(buf).ArraysWithOneElementPerLine(multiLineArray).AlignEquals(alignEquals).AlignComments(alignComments).Encode(tree); err != nil {
 		panic(err)
 	}
 	return buf.String(), nil
@@ -0,0 +1,208 @@
+// Encoding and decoding functions registered by type.
+
+package toml
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// EncodeFunc converts v, a value of the type it is registered for, to a value
+// that can be encoded to TOML, such as a string, a number, a slice, a map or a
+// struct.
+type EncodeFunc func(v interface{}) (interface{}, error)
+
+// DecodeFunc converts v, the plain Go value of a TOML element as given to
+// Unmarshaler.UnmarshalTOML, to a value of the type it is registered for.
+type DecodeFunc func(v interface{}) (interface{}, error)
+
+type codecRegistry struct {
+	mu       sync.RWMutex
+	encoders map[reflect.Type]EncodeFunc
+	decoders map[reflect.Type]DecodeFunc
+	// Types whose decoders were set with RegisterDecoder
+	registered map[reflect.Type]bool
+}
+
+func (r *codecRegistry) encoder(t reflect.Type) EncodeFunc {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.encoders[t]
+}
+
+func (r *codecRegistry) decoder(t reflect.Type) DecodeFunc {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.decoders[t]
+}
+
+func (r *codecRegistry) registeredDecoder(t reflect.Type) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.registered[t]
+}
+
+var defaultCodecs = &codecRegistry{
+	encoders: map[reflect.Type]EncodeFunc{
+		reflect.TypeOf(time.Duration(0)): encodeDuration,
+		reflect.TypeOf(net.IP{}):         encodeStringer,
+		reflect.TypeOf(&url.URL{}):       encodeStringer,
+		reflect.TypeOf(&regexp.Regexp{}): encodeStringer,
+	},
+	decoders: map[reflect.Type]DecodeFunc{
+		reflect.TypeOf(time.Duration(0)): decodeDuration,
+		reflect.TypeOf(net.IP{}):         decodeIP,
+		reflect.TypeOf(&url.URL{}):       decodeURL,
+		reflect.TypeOf(&regexp.Regexp{}): decodeRegexp,
+	},
+	registered: map[reflect.Type]bool{},
+}
+
+// RegisterEncoder sets the function encoding the values of type t for all
+// Encoders. It takes precedence over the Marshaler interfaces of t, but not
+// over the functions registered with Encoder.RegisterEncoder.
+//
+// Functions are registered for time.Duration, net.IP, *url.URL and
+// *regexp.Regexp by default.
+func RegisterEncoder(t reflect.Type, f EncodeFunc) {
+	defaultCodecs.mu.Lock()
+	defer defaultCodecs.mu.Unlock()
+	defaultCodecs.encoders[t] = f
+}
+
+// RegisterDecoder sets the function decoding the values of type t for all
+// Decoders. It takes precedence over the Unmarshaler interfaces of t, but not
+// over the functions registered with Decoder.RegisterDecoder.
+//
+// Functions are registered for time.Duration, net.IP, *url.URL and
+// *regexp.Regexp by default.
+func RegisterDecoder(t reflect.Type, f DecodeFunc) {
+	defaultCodecs.mu.Lock()
+	defer defaultCodecs.mu.Unlock()
+	defaultCodecs.decoders[t] = f
+	defaultCodecs.registered[t] = true
+	callbacksCache.reset()
+}
+
+// RegisterEncoder sets the function encoding the values of type t for this
+// Encoder only.
+func (e *Encoder) RegisterEncoder(t reflect.Type, f EncodeFunc) *Encoder {
+	if e.encoders == nil {
+		e.encoders = make(map[reflect.Type]EncodeFunc)
+	}
+	e.encoders[t] = f
+	return e
+}
+
+// RegisterDecoder sets the function decoding the values of type t for this
+// Decoder only.
+func (d *Decoder) RegisterDecoder(t reflect.Type, f DecodeFunc) *Decoder {
+	if d.decoders == nil {
+		d.decoders = make(map[reflect.Type]DecodeFunc)
+	}
+	d.decoders[t] = f
+	return d
+}
+
+func (e *Encoder) encoderFor(t reflect.Type) EncodeFunc {
+	if f, ok := e.encoders[t]; ok {
+		return f
+	}
+	return defaultCodecs.encoder(t)
+}
+
+func (d *Decoder) decoderFor(t reflect.Type) DecodeFunc {
+	if f, ok := d.decoders[t]; ok {
+		return f
+	}
+	return defaultCodecs.decoder(t)
+}
+
+// Convert given marshal value to toml value with the registered function f
+func (e *Encoder) valueToTomlWith(f EncodeFunc, mtype reflect.Type, mval reflect.Value) (interface{}, error) {
+	val, err := f(mval.Interface())
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, fmt.Errorf("encoder for %v returned nil", mtype)
+	}
+	vtype := reflect.TypeOf(val)
+	if vtype == mtype {
+		return nil, fmt.Errorf("encoder for %v returned a value of the same type", mtype)
+	}
+	return e.valueToToml(vtype, reflect.ValueOf(val))
+}
+
+// Convert toml value to marshal value with the registered function f
+func (d *Decoder) valueFromTomlWith(f DecodeFunc, mtype reflect.Type, tval interface{}) (reflect.Value, error) {
+	d.visitor.visitAll()
+	val, err := f(tomlToGo(tval))
+	if err != nil {
+		return reflect.ValueOf(nil), err
+	}
+	if val == nil {
+		return reflect.Zero(mtype), nil
+	}
+	mval := reflect.ValueOf(val)
+	switch {
+	case mval.Type().AssignableTo(mtype):
+		return mval, nil
+	case mval.Type().ConvertibleTo(mtype):
+		return mval.Convert(mtype), nil
+	default:
+		return reflect.ValueOf(nil), fmt.Errorf("decoder for %v returned a %T", mtype, val)
+	}
+}
+
+func encodeStringer(v interface{}) (interface{}, error) {
+	return v.(fmt.Stringer).String(), nil
+}
+
+func encodeDuration(v interface{}) (interface{}, error) {
+	return v.(time.Duration).String(), nil
+}
+
+func decodeDuration(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return time.ParseDuration(v)
+	case int64:
+		return time.Duration(v), nil
+	default:
+		return nil, fmt.Errorf("Can't convert %v(%T) to time.Duration", v, v)
+	}
+}
+
+func decodeIP(v interface{}) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("Can't convert %v(%T) to net.IP", v, v)
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", s)
+	}
+	return ip, nil
+}
+
+func decodeURL(v interface{}) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("Can't convert %v(%T) to *url.URL", v, v)
+	}
+	return url.Parse(s)
+}
+
+func decodeRegexp(v interface{}) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("Can't convert %v(%T) to *regexp.Regexp", v, v)
+	}
+	return regexp.Compile(s)
+}
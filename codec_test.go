@@ -0,0 +1,179 @@
+package toml
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+type builtinCodecs struct {
+	Timeout  time.Duration   `toml:"timeout"`
+	Retries  []time.Duration `toml:"retries"`
+	IP       net.IP          `toml:"ip"`
+	Endpoint *url.URL        `toml:"endpoint"`
+	Filter   *regexp.Regexp  `toml:"filter"`
+	Small    *big.Int        `toml:"small"`
+	Large    *big.Int        `toml:"large"`
+}
+
+func TestBuiltinCodecs(t *testing.T) {
+	doc := []byte(`
+timeout = "1m30s"
+retries = ["1s", 2000000000]
+ip = "192.168.0.1"
+endpoint = "https://example.com/api?v=1"
+filter = "^a+b$"
+small = 42
+large = "123456789012345678901234567890"
+`)
+
+	var v builtinCodecs
+	if err := Unmarshal(doc, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Timeout != 90*time.Second || !reflect.DeepEqual(v.Retries, []time.Duration{time.Second, 2 * time.Second}) {
+		t.Errorf("unexpected durations: %v, %v", v.Timeout, v.Retries)
+	}
+	if !v.IP.Equal(net.IPv4(192, 168, 0, 1)) {
+		t.Errorf("unexpected IP: %v", v.IP)
+	}
+	if v.Endpoint.Host != "example.com" || v.Endpoint.RawQuery != "v=1" {
+		t.Errorf("unexpected URL: %v", v.Endpoint)
+	}
+	if !v.Filter.MatchString("aab") || v.Filter.MatchString("b") {
+		t.Errorf("unexpected regexp: %v", v.Filter)
+	}
+	if v.Small.Int64() != 42 || v.Large.String() != "123456789012345678901234567890" {
+		t.Errorf("unexpected big integers: %v, %v", v.Small, v.Large)
+	}
+
+	result, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `endpoint = "https://example.com/api?v=1"
+filter = "^a+b$"
+ip = "192.168.0.1"
+large = "123456789012345678901234567890"
+retries = ["1s", "2s"]
+small = "42"
+timeout = "1m30s"
+`
+	if string(result) != expected {
+		t.Errorf("expected\n-----\n%s\n-----\ngot\n-----\n%s\n-----\n", expected, result)
+	}
+}
+
+// Removes the functions registered for t with RegisterEncoder and
+// RegisterDecoder.
+func unregisterCodecs(t reflect.Type) {
+	defaultCodecs.mu.Lock()
+	delete(defaultCodecs.encoders, t)
+	delete(defaultCodecs.decoders, t)
+	delete(defaultCodecs.registered, t)
+	defaultCodecs.mu.Unlock()
+	callbacksCache.reset()
+}
+
+func TestBuiltinCodecsErrors(t *testing.T) {
+	tests := []struct {
+		doc string
+		err string
+	}{
+		{`timeout = "5x"`, `(1, 1): time: unknown unit "x" in duration "5x"`},
+		{`timeout = 1.5`, "(1, 1): Can't convert 1.5(float64) to time.Duration"},
+		{`ip = "localhost"`, "(1, 1): invalid IP address: localhost"},
+		{`endpoint = 1`, "(1, 1): Can't convert 1(int64) to *url.URL"},
+		{`filter = "a("`, "(1, 1): error parsing regexp: missing closing ): `a(`"},
+		{`large = "12a"`, `(1, 1): unmarshal text: math/big: cannot unmarshal "12a" into a *big.Int`},
+	}
+
+	for _, test := range tests {
+		var v builtinCodecs
+		err := Unmarshal([]byte(test.doc), &v)
+		if err == nil {
+			t.Errorf("%q: expected error %q, got none", test.doc, test.err)
+			continue
+		}
+		if err.Error() != test.err {
+			t.Errorf("%q: expected error %q, got %q", test.doc, test.err, err.Error())
+		}
+	}
+}
+
+type celsius float64
+
+func TestRegisterCodecs(t *testing.T) {
+	celsiusType := reflect.TypeOf(celsius(0))
+	RegisterEncoder(celsiusType, func(v interface{}) (interface{}, error) {
+		return fmt.Sprintf("%gC", v), nil
+	})
+	RegisterDecoder(celsiusType, func(v interface{}) (interface{}, error) {
+		s, _ := v.(string)
+		var c float64
+		if _, err := fmt.Sscanf(s, "%gC", &c); err != nil {
+			return nil, errors.New("invalid temperature")
+		}
+		return c, nil
+	})
+	defer unregisterCodecs(celsiusType)
+
+	type config struct {
+		Temperatures map[string]celsius `toml:"temperatures"`
+		Timeout      time.Duration      `toml:"timeout"`
+	}
+
+	var v config
+	if err := Unmarshal([]byte("timeout = 5\n[temperatures]\nroom = \"21.5C\""), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Temperatures["room"] != 21.5 || v.Timeout != 5 {
+		t.Errorf("unexpected config: %+v", v)
+	}
+
+	err := NewDecoder(strings.NewReader(`timeout = 5`)).
+		RegisterDecoder(reflect.TypeOf(time.Duration(0)), func(v interface{}) (interface{}, error) {
+			return time.Duration(v.(int64)) * time.Second, nil
+		}).
+		Decode(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Timeout != 5*time.Second {
+		t.Errorf("expected the decoder function to take precedence, got %v", v.Timeout)
+	}
+
+	var buf bytes.Buffer
+	err = NewEncoder(&buf).
+		RegisterEncoder(reflect.TypeOf(time.Duration(0)), func(v interface{}) (interface{}, error) {
+			return int64(v.(time.Duration) / time.Second), nil
+		}).
+		Encode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "timeout = 5\n\n[temperatures]\n  room = \"21.5C\"\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+
+	err = Unmarshal([]byte("[temperatures]\nroom = 21"), &v)
+	if err == nil || err.Error() != "(2, 1): invalid temperature" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = NewEncoder(nil).RegisterEncoder(celsiusType, func(v interface{}) (interface{}, error) {
+		return v, nil
+	}).marshal(v)
+	if err == nil || err.Error() != "encoder for toml.celsius returned a value of the same type" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
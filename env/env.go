@@ -0,0 +1,161 @@
+// Package env overlays environment variables onto TOML documents.
+//
+// The name of a variable, stripped from a prefix, designates a key path of the
+// document. Components of the path are separated by a double underscore, and
+// matched case-insensitively against the keys of the document, with
+// underscores also matching dashes. Indexes select elements of arrays of
+// tables. For example, with the prefix "APP_":
+//
+//	APP_DATABASE__PORT=5432         database.port
+//	APP_LOG_LEVEL=debug             log_level
+//	APP_SERVERS__0__HOST=localhost  host of the first [[servers]] table
+//
+// Values are read as TOML value literals, so that APP_DATABASE__PORT above is
+// the integer 5432, and APP_LOG_LEVEL, which is not a valid literal, is the
+// string "debug". When the key already exists in the document, its type is
+// kept: strings are never parsed, and a value of another type is an error.
+//
+// Go structures can also read environment variables using the env struct tag,
+// which toml.Decoder honors after setting the values of the document:
+//
+//	type Config struct {
+//		Port int `toml:"port" env:"APP_PORT"`
+//	}
+package env
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// Separator between the components of a key path in variable names.
+const Separator = "__"
+
+// Overlay sets the values of the environment variables starting with prefix
+// onto tree. See the package documentation for the naming convention.
+func Overlay(tree *toml.Tree, prefix string) error {
+	return OverlayEnviron(tree, prefix, os.Environ())
+}
+
+// OverlayEnviron is the same as Overlay, but reads the variables from environ,
+// a list of "NAME=value" strings in the form returned by os.Environ.
+func OverlayEnviron(tree *toml.Tree, prefix string, environ []string) error {
+	vars := make(map[string]string)
+	var names []string
+	for _, kv := range environ {
+		idx := strings.IndexByte(kv, '=')
+		if idx < 0 || !strings.HasPrefix(kv[:idx], prefix) || idx == len(prefix) {
+			continue
+		}
+		names = append(names, kv[:idx])
+		vars[kv[:idx]] = kv[idx+1:]
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := set(tree, strings.Split(name[len(prefix):], Separator), vars[name]); err != nil {
+			return fmt.Errorf("environment variable %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func set(tree *toml.Tree, path []string, raw string) error {
+	for _, component := range path {
+		if component == "" {
+			return errors.New("empty key")
+		}
+	}
+
+	subtree := tree
+	for i, component := range path[:len(path)-1] {
+		key := matchKey(subtree, component)
+		switch node := subtree.GetPath([]string{key}).(type) {
+		case nil:
+			next, _ := toml.TreeFromMap(map[string]interface{}{})
+			subtree.SetPath([]string{key}, next)
+			subtree = next
+		case *toml.Tree:
+			subtree = node
+		case []*toml.Tree:
+			idx, err := strconv.Atoi(path[i+1])
+			if err != nil || idx < 0 || idx >= len(node) {
+				return fmt.Errorf("invalid index %s of array of tables %s", path[i+1], key)
+			}
+			if i+2 == len(path) {
+				return fmt.Errorf("cannot replace table %s", key)
+			}
+			return set(node[idx], path[i+2:], raw)
+		default:
+			return fmt.Errorf("%s is not a table", key)
+		}
+	}
+
+	key := matchKey(subtree, path[len(path)-1])
+	value, err := convert(subtree.GetPath([]string{key}), raw)
+	if err != nil {
+		return err
+	}
+	subtree.SetPath([]string{key}, value)
+	return nil
+}
+
+// Returns the key of tree matching the component of a variable name, or the
+// component in lower case if there is none.
+func matchKey(tree *toml.Tree, component string) string {
+	normalized := strings.Replace(component, "-", "_", -1)
+	keys := tree.Keys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		if strings.EqualFold(strings.Replace(key, "-", "_", -1), normalized) {
+			return key
+		}
+	}
+	return strings.ToLower(component)
+}
+
+// Converts raw to a value of the same type as existing.
+func convert(existing interface{}, raw string) (interface{}, error) {
+	switch existing.(type) {
+	case string:
+		return raw, nil
+	case *toml.Tree, []*toml.Tree:
+		return nil, errors.New("cannot replace a table")
+	}
+
+	value, err := toml.ParseValue(raw)
+	if _, ok := value.(*toml.Tree); ok {
+		value, err = nil, errors.New("tables are not supported")
+	}
+	if existing == nil {
+		if err != nil {
+			return raw, nil
+		}
+		return value, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q for a %T", raw, existing)
+	}
+
+	if i, ok := value.(int64); ok {
+		switch existing.(type) {
+		case float64:
+			return float64(i), nil
+		case uint64:
+			if i >= 0 {
+				return uint64(i), nil
+			}
+		}
+	}
+	if reflect.TypeOf(value) != reflect.TypeOf(existing) {
+		return nil, fmt.Errorf("invalid value %q for a %T", raw, existing)
+	}
+	return value, nil
+}
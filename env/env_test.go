@@ -0,0 +1,114 @@
+package env
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/pelletier/go-toml"
+)
+
+const testDocument = `
+name = "app"
+ratio = 0.5
+ids = [1, 2]
+max-conns = 10
+
+[database]
+port = 3306
+host = "localhost"
+
+[[servers]]
+host = "alpha"
+
+[[servers]]
+host = "beta"
+`
+
+func TestOverlayEnviron(t *testing.T) {
+	tree, err := toml.Load(testDocument)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = OverlayEnviron(tree, "APP_", []string{
+		"APP_NAME=42",
+		"APP_RATIO=1",
+		"APP_IDS=[3, 4, 5]",
+		"APP_MAX_CONNS=20",
+		"APP_DATABASE__PORT=5432",
+		"APP_DATABASE__HOST=db.example.com",
+		"APP_DATABASE__TLS=true",
+		"APP_SERVERS__1__HOST=gamma",
+		"APP_LOG__LEVEL=debug",
+		"APP_LOG__FILE__ROTATE=1979-05-27",
+		"OTHER_NAME=ignored",
+		"APP_=ignored",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"name":          "42",
+		"ratio":         float64(1),
+		"ids":           []interface{}{int64(3), int64(4), int64(5)},
+		"max-conns":     int64(20),
+		"database.port": int64(5432),
+		"database.host": "db.example.com",
+		"database.tls":  true,
+		"log.level":     "debug",
+	}
+	for key, value := range expected {
+		if got := tree.Get(key); !reflect.DeepEqual(got, value) {
+			t.Errorf("%s: expected %#v, got %#v", key, value, got)
+		}
+	}
+	servers := tree.Get("servers").([]*toml.Tree)
+	if servers[0].Get("host") != "alpha" || servers[1].Get("host") != "gamma" {
+		t.Errorf("unexpected servers: %v", servers)
+	}
+	if _, ok := tree.Get("log.file.rotate").(toml.LocalDate); !ok {
+		t.Errorf("expected a local date, got %#v", tree.Get("log.file.rotate"))
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	os.Setenv("GO_TOML_ENV_TEST_DATABASE__PORT", "5432")
+	defer os.Unsetenv("GO_TOML_ENV_TEST_DATABASE__PORT")
+
+	tree, _ := toml.Load(testDocument)
+	if err := Overlay(tree, "GO_TOML_ENV_TEST_"); err != nil {
+		t.Fatal(err)
+	}
+	if tree.Get("database.port") != int64(5432) {
+		t.Errorf("expected database.port to be overridden, got %v", tree.Get("database.port"))
+	}
+}
+
+func TestOverlayErrors(t *testing.T) {
+	tests := []struct {
+		variable string
+		err      string
+	}{
+		{"APP_DATABASE__PORT=abc", `environment variable APP_DATABASE__PORT: invalid value "abc" for a int64`},
+		{"APP_RATIO=true", `environment variable APP_RATIO: invalid value "true" for a float64`},
+		{"APP_DATABASE=1", "environment variable APP_DATABASE: cannot replace a table"},
+		{"APP_NAME__FIRST=1", "environment variable APP_NAME__FIRST: name is not a table"},
+		{"APP_SERVERS__2__HOST=x", "environment variable APP_SERVERS__2__HOST: invalid index 2 of array of tables servers"},
+		{"APP_SERVERS__0=x", "environment variable APP_SERVERS__0: cannot replace table servers"},
+		{"APP_DATABASE____PORT=1", "environment variable APP_DATABASE____PORT: empty key"},
+	}
+
+	for _, test := range tests {
+		tree, _ := toml.Load(testDocument)
+		err := OverlayEnviron(tree, "APP_", []string{test.variable})
+		if err == nil {
+			t.Errorf("%s: expected error %q, got none", test.variable, test.err)
+			continue
+		}
+		if err.Error() != test.err {
+			t.Errorf("%s: expected error %q, got %q", test.variable, test.err, err.Error())
+		}
+	}
+}
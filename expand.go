@@ -0,0 +1,156 @@
+// Environment variable expansion in string values.
+
+package toml
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ExpandEnv returns a LoadOption that expands environment variable references
+// found in string values while the Tree is built. The following forms are
+// supported:
+//
+//	${VAR}           value of VAR, or an empty string if VAR is not set
+//	${VAR:-default}  value of VAR, or default if VAR is unset or empty
+//	${VAR:?message}  value of VAR, or an error containing message if VAR is
+//	                 unset or empty
+//	$$               a literal $
+//
+// Variables are looked up using lookup, or os.LookupEnv if lookup is nil.
+// Keys and literal strings are never expanded, unless
+// ExpandEnvInLiteralStrings is also provided for the latter.
+//
+// With ResolveReferences, references are expanded by Tree.Resolve instead,
+// and only fall back to the environment when the document has no such key.
+func ExpandEnv(lookup func(string) (string, bool)) LoadOption {
+	if lookup == nil {
+		lookup = os.LookupEnv
+	}
+	return func(o *loadOptions) {
+		o.lookupEnv = lookup
+	}
+}
+
+// ExpandEnvInLiteralStrings returns a LoadOption that makes ExpandEnv apply to
+// single-quoted literal strings as well as basic strings.
+func ExpandEnvInLiteralStrings() LoadOption {
+	return func(o *loadOptions) {
+		o.expandLiteral = true
+	}
+}
+
+// Expands environment variable references of the token's value, if enabled.
+func (p *tomlParser) expandEnv(tok *token) string {
+	if p.options.lookupEnv == nil || p.options.resolve {
+		// References are expanded by Tree.Resolve, after the document
+		return tok.val
+	}
+	s, err := expandEnv(tok.val, p.options.lookupEnv)
+	if err != nil {
+		p.raiseError(tok, "%s", err)
+	}
+	return s
+}
+
+// Expands environment variable references of s.
+func expandEnv(s string, lookup func(string) (string, bool)) (string, error) {
+	return replaceReferences(s, false, func(ref string) (string, bool, error) {
+		value, err := expandReference(ref, lookup)
+		return value, true, err
+	})
+}
+
+// Calls expand for each ${...} reference found in s, and replaces the
+// reference by the returned string. References for which expand returns false
+// are kept untouched. $$ is replaced by $ unless keepEscapes is true.
+func replaceReferences(s string, keepEscapes bool, expand func(ref string) (string, bool, error)) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			if keepEscapes {
+				b.WriteByte('$')
+			}
+			b.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				return "", errors.New("unterminated variable reference")
+			}
+			ref := s[i+2 : i+2+end]
+			value, ok, err := expand(ref)
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				b.WriteString(value)
+			} else {
+				b.WriteString(s[i : i+3+end])
+			}
+			i += end + 2
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String(), nil
+}
+
+func envReferenceName(ref string) string {
+	if idx := strings.Index(ref, ":"); idx >= 0 {
+		return ref[:idx]
+	}
+	return ref
+}
+
+// Expands the inside of a ${...} reference.
+func expandReference(ref string, lookup func(string) (string, bool)) (string, error) {
+	name, op, arg := envReferenceName(ref), "", ""
+	if len(name) < len(ref) {
+		if len(ref) < len(name)+2 || (ref[len(name)+1] != '-' && ref[len(name)+1] != '?') {
+			return "", fmt.Errorf("invalid variable reference: ${%s}", ref)
+		}
+		op, arg = ref[len(name):len(name)+2], ref[len(name)+2:]
+	}
+	if !isValidEnvName(name) {
+		return "", fmt.Errorf("invalid variable name: %q", name)
+	}
+
+	value, ok := lookup(name)
+	if ok && value != "" {
+		return value, nil
+	}
+	switch op {
+	case ":-":
+		return arg, nil
+	case ":?":
+		if arg == "" {
+			arg = "variable is unset or empty"
+		}
+		return "", fmt.Errorf("%s: %s", name, arg)
+	}
+	return value, nil
+}
+
+func isValidEnvName(name string) bool {
+	if name == "" || isDigit(rune(name[0])) {
+		return false
+	}
+	for _, r := range name {
+		if !isAlphanumeric(r) && !isDigit(r) {
+			return false
+		}
+	}
+	return true
+}
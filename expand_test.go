@@ -0,0 +1,92 @@
+package toml
+
+import (
+	"os"
+	"testing"
+)
+
+func testLookupEnv(name string) (string, bool) {
+	env := map[string]string{
+		"HOST":  "example.com",
+		"PORT":  "8080",
+		"EMPTY": "",
+	}
+	v, ok := env[name]
+	return v, ok
+}
+
+func TestExpandEnv(t *testing.T) {
+	tree, err := Load(`
+url = "http://${HOST}:${PORT}/"
+user = "${USER:-nobody}"
+empty = "${EMPTY:-fallback}"
+missing = "[${MISSING}]"
+price = "$$5 and $ alone"
+list = ["${HOST}", "${PORT}"]
+inline = { host = "${HOST}" }
+literal = '${HOST}'
+`, ExpandEnv(testLookupEnv))
+	assertTree(t, tree, err, map[string]interface{}{
+		"url":     "http://example.com:8080/",
+		"user":    "nobody",
+		"empty":   "fallback",
+		"missing": "[]",
+		"price":   "$5 and $ alone",
+		"list":    []interface{}{"example.com", "8080"},
+		"inline": map[string]interface{}{
+			"host": "example.com",
+		},
+		"literal": "${HOST}",
+	})
+}
+
+func TestExpandEnvDisabled(t *testing.T) {
+	tree, err := Load(`a = "${HOST} $$"`)
+	assertTree(t, tree, err, map[string]interface{}{
+		"a": "${HOST} $$",
+	})
+}
+
+func TestExpandEnvLiteralStrings(t *testing.T) {
+	tree, err := Load(`
+a = '${HOST}'
+b = '''${PORT}'''
+`, ExpandEnv(testLookupEnv), ExpandEnvInLiteralStrings())
+	assertTree(t, tree, err, map[string]interface{}{
+		"a": "example.com",
+		"b": "8080",
+	})
+}
+
+func TestExpandEnvDefaultLookup(t *testing.T) {
+	os.Setenv("GO_TOML_TEST_EXPAND", "from env")
+	defer os.Unsetenv("GO_TOML_TEST_EXPAND")
+	tree, err := Load(`a = "${GO_TOML_TEST_EXPAND}"`, ExpandEnv(nil))
+	assertTree(t, tree, err, map[string]interface{}{
+		"a": "from env",
+	})
+}
+
+func TestExpandEnvErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{`a = "${MISSING:?must be set}"`, "(1, 6): MISSING: must be set"},
+		{"\n\na = [1, \"${EMPTY:?}\"]", "(3, 10): EMPTY: variable is unset or empty"},
+		{`a = "${HOST"`, "(1, 6): unterminated variable reference"},
+		{`a = "${1HOST}"`, `(1, 6): invalid variable name: "1HOST"`},
+		{`a = "${HOST:+x}"`, "(1, 6): invalid variable reference: ${HOST:+x}"},
+	}
+
+	for _, test := range tests {
+		_, err := Load(test.input, ExpandEnv(testLookupEnv))
+		if err == nil {
+			t.Errorf("%q: expected error %q, got none", test.input, test.err)
+			continue
+		}
+		if err.Error() != test.err {
+			t.Errorf("%q: expected error %q, got %q", test.input, test.err, err.Error())
+		}
+	}
+}
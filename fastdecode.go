@@ -0,0 +1,565 @@
+// Decoding of documents into structs without building a Tree.
+
+package toml
+
+import (
+	"errors"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Kinds of the nodes of a document decoded directly, used to reject the
+// documents the parser would not build a Tree from.
+type directKind int
+
+const (
+	directImplicitTable directKind = iota + 1
+	directTable
+	directArray
+	directValue
+)
+
+// A table of the document, decoded into the struct mval. Its fields decoded
+// from tables and arrays of tables are completed with the table. Its path is
+// not tracked: it only appears in errors and metadata, which are left to the
+// Tree path.
+type directStruct struct {
+	mval   reflect.Value
+	fields *structFields
+	pos    Position
+	// Nodes decoded into the fields, by index in fields.list
+	nodes []directNode
+}
+
+// A node of the document, either decoded into the field index of its table,
+// or ignored, in which case index is -1.
+type directNode struct {
+	kind  directKind
+	index int
+	// Key the node was first found at, and its position
+	key string
+	pos Position
+	// Struct decoded from the table of the field, or from each table of the
+	// array of tables of the field
+	table *directStruct
+	array []*directStruct
+	// Path of the ignored node below its table, and number of tables of the
+	// array of tables
+	path  string
+	count int
+}
+
+// Path of an ignored node of the document.
+type directPath struct {
+	table *directStruct
+	path  string
+}
+
+// Position in the document: a struct decoded from a table, or an ignored node
+// below it.
+type directCursor struct {
+	table *directStruct
+	node  *directNode
+}
+
+// Decoder of a document into a struct, reading the tokens of the parser
+// directly instead of building a Tree. It bails out on anything it does not
+// decode the same way as the Tree path, by panicking with errDirectFallback.
+type directDecoder struct {
+	d       *Decoder
+	parser  *tomlParser
+	an      annotation
+	ignored map[directPath]*directNode
+	root    *directStruct
+	keys    []string
+}
+
+var errDirectFallback = errors.New("document must be decoded from a tree")
+
+// Decodes the document b into v, if it can be done without building a Tree:
+// v must point to a struct whose tables are structs and arrays of structs
+// decoded by the Decoder itself, and the Decoder must have neither hooks,
+// metadata, KeyMatcher nor functions of its own. Values are decoded as with a
+// Tree. It reports false if the document must be decoded from a Tree instead,
+// in which case v is left untouched. The errors of the document, including
+// failed requirements, are left to the Tree path.
+//
+// Since the Tree path decodes the document again from the start, the types
+// reachable from v must not run user code, which would be run twice.
+//
+// Tokens are read from the lexer as the document is decoded, and strings,
+// booleans and numbers are set straight from their token. Arrays, inline
+// tables and dates still go through the values of a Tree.
+func (d *Decoder) decodeDirect(b []byte, v interface{}) (ok bool) {
+	if len(d.hooks) > 0 || d.metadata || d.keyMatcher != nil || len(d.decoders) > 0 {
+		return false
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return false
+	}
+	dd := &directDecoder{
+		d:       d,
+		an:      annotation{tag: d.tagName},
+		ignored: map[directPath]*directNode{},
+	}
+	if !dd.decodable(rv.Type().Elem()) {
+		return false
+	}
+	if calls := callbacksCache.get(rv.Type().Elem(), dd.an); calls.methods || calls.env && d.lookupEnv != nil {
+		return false
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			if _, isRuntime := r.(runtime.Error); isRuntime {
+				panic(r)
+			}
+			// Errors of the parser and of the values are reported by the
+			// Tree path
+			ok = false
+		}
+	}()
+
+	d.visitor = visitorState{}
+	d.path, d.pos = nil, Source{Position: Position{Line: 1, Col: 1}}
+	d.defaulted = nil
+	d.invalid = nil
+
+	mval := reflect.New(rv.Type().Elem()).Elem()
+	mval.Set(rv.Elem())
+	dd.root = dd.newStruct(mval, d.pos.Position)
+	dd.parser = &tomlParser{lexer: newTomlLexer(trimBOM(b))}
+	dd.run()
+	if err := dd.complete(dd.root); err != nil || len(d.invalid) > 0 {
+		return false
+	}
+	rv.Elem().Set(mval)
+	return true
+}
+
+// Checks if values of type t are tables decoded field by field by the
+// Decoder.
+func (dd *directDecoder) decodable(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct || isPrimitive(t) || t == reflect.TypeOf(Tree{}) || dd.d.decoderFor(t) != nil {
+		return false
+	}
+	ptr := reflect.PtrTo(t)
+	if isValueUnmarshaler(ptr) || isCustomUnmarshaler(ptr) {
+		return false
+	}
+	for _, f := range fieldsCache.get(t, dd.an).list {
+		if f.field.Anonymous {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks if values of type t are arrays of tables decoded table by table by
+// the Decoder.
+func (dd *directDecoder) decodableArray(t reflect.Type) bool {
+	if t.Kind() != reflect.Slice || dd.d.decoderFor(t) != nil {
+		return false
+	}
+	ptr := reflect.PtrTo(t)
+	if isValueUnmarshaler(ptr) || isCustomUnmarshaler(ptr) {
+		return false
+	}
+	return dd.decodable(t.Elem())
+}
+
+func (dd *directDecoder) newStruct(mval reflect.Value, pos Position) *directStruct {
+	fields := fieldsCache.get(mval.Type(), dd.an)
+	return &directStruct{
+		mval:   mval,
+		fields: fields,
+		pos:    pos,
+		nodes:  make([]directNode, len(fields.list)),
+	}
+}
+
+// User code run when decoding the values of a type.
+type typeCallbacks struct {
+	// Defaulter and unmarshaler methods of the types reachable from the type,
+	// or functions set with RegisterDecoder for them
+	methods bool
+	// env tags of the structs reachable from the type, whose variables are
+	// looked up with the function given to Decoder.LookupEnv
+	env bool
+}
+
+type typeCallbacksCache struct {
+	mu        sync.RWMutex
+	callbacks map[structFieldsKey]typeCallbacks
+}
+
+// Returns the user code run when decoding the values of type t with the tags
+// of an. It is computed on first use, and again after RegisterDecoder.
+func (c *typeCallbacksCache) get(t reflect.Type, an annotation) typeCallbacks {
+	key := structFieldsKey{t: t, an: an}
+	c.mu.RLock()
+	calls, ok := c.callbacks[key]
+	c.mu.RUnlock()
+	if ok {
+		return calls
+	}
+
+	findCallbacks(t, an, &calls, map[reflect.Type]bool{})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.callbacks[key] = calls
+	return calls
+}
+
+func (c *typeCallbacksCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.callbacks = map[structFieldsKey]typeCallbacks{}
+}
+
+var callbacksCache = &typeCallbacksCache{callbacks: map[structFieldsKey]typeCallbacks{}}
+
+// Adds the user code run when decoding the values of type t to calls,
+// following the order of valueFromToml.
+func findCallbacks(t reflect.Type, an annotation, calls *typeCallbacks, seen map[reflect.Type]bool) {
+	if seen[t] {
+		return
+	}
+	seen[t] = true
+	if defaultCodecs.decoder(t) != nil {
+		calls.methods = calls.methods || defaultCodecs.registeredDecoder(t)
+		return
+	}
+	if t.Kind() == reflect.Ptr {
+		findCallbacks(t.Elem(), an, calls, seen)
+		return
+	}
+	ptr := reflect.PtrTo(t)
+	if isValueUnmarshaler(ptr) || isCustomUnmarshaler(ptr) || isTextUnmarshaler(ptr) && !isTimeType(t) || ptr.Implements(defaulterType) {
+		calls.methods = true
+		return
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		findCallbacks(t.Elem(), an, calls, seen)
+	case reflect.Struct:
+		for _, f := range fieldsCache.get(t, an).list {
+			calls.env = calls.env || f.opts.env != ""
+			findCallbacks(f.field.Type, an, calls, seen)
+		}
+	}
+}
+
+func (dd *directDecoder) fallback() {
+	panic(errDirectFallback)
+}
+
+func (dd *directDecoder) run() {
+	p := dd.parser
+	current := directCursor{table: dd.root}
+	for {
+		tok := p.peek()
+		if tok == nil || tok.typ == tokenEOF {
+			return
+		}
+		switch tok.typ {
+		case tokenDoubleLeftBracket:
+			start := p.getToken()
+			key := p.getToken()
+			if key.typ != tokenKeyGroupArray {
+				dd.fallback()
+			}
+			current = dd.arrayTable(dd.parseKey(key), start.Position)
+			p.assume(tokenDoubleRightBracket)
+		case tokenLeftBracket:
+			start := p.getToken()
+			key := p.getToken()
+			if key.typ != tokenKeyGroup {
+				dd.fallback()
+			}
+			current = dd.table(dd.parseKey(key), start.Position)
+			p.assume(tokenRightBracket)
+		case tokenKey:
+			key := p.getToken()
+			p.assume(tokenEqual)
+			dd.assign(current, dd.parseKey(key), key.Position)
+		default:
+			dd.fallback()
+		}
+	}
+}
+
+func (dd *directDecoder) parseKey(tok *token) []string {
+	// Keys are not kept once handled, so their slice is reused
+	if keys, ok := splitBareKeys(dd.keys[:0], tok.val); ok {
+		dd.keys = keys
+		return keys
+	}
+	keys, err := parseKey(tok.val)
+	if err != nil {
+		dd.fallback()
+	}
+	for _, key := range keys {
+		if strings.ContainsAny(key, "\x00\x01") {
+			dd.fallback()
+		}
+	}
+	return keys
+}
+
+// Returns the node at key in the node at cursor, recording the key it is first
+// found at.
+func (dd *directDecoder) lookup(c directCursor, key string, pos Position) *directNode {
+	if c.node == nil {
+		if i, ok := c.table.fields.byKey[key]; ok {
+			if i < 0 {
+				dd.fallback()
+			}
+			n := &c.table.nodes[i]
+			if n.key == "" {
+				n.index, n.key, n.pos = i, key, pos
+			} else if n.key != key {
+				// Several keys of the table may be decoded into the field
+				dd.fallback()
+			}
+			return n
+		} else if dd.d.strict {
+			dd.fallback()
+		}
+	}
+
+	path := "\x00" + key
+	if c.node != nil {
+		path = c.node.path
+		if c.node.kind == directArray {
+			path += "\x00\x01" + strconv.Itoa(c.node.count-1)
+		}
+		path += "\x00" + key
+	}
+	n, ok := dd.ignored[directPath{c.table, path}]
+	if !ok {
+		n = &directNode{index: -1, path: path}
+		dd.ignored[directPath{c.table, path}] = n
+	}
+	return n
+}
+
+// Returns the table of node n in the table at cursor, or the last table of
+// its array of tables, creating an implicit table if there is none.
+func (dd *directDecoder) enter(c directCursor, n *directNode, pos Position) directCursor {
+	switch n.kind {
+	case 0:
+		n.kind = directImplicitTable
+	case directImplicitTable, directTable, directArray:
+	default:
+		dd.fallback()
+	}
+	if n.index < 0 {
+		return directCursor{table: c.table, node: n}
+	}
+	if n.kind == directArray {
+		return directCursor{table: n.array[len(n.array)-1]}
+	}
+	if n.table == nil {
+		f := c.table.fields.list[n.index]
+		if !dd.decodable(f.field.Type) {
+			dd.fallback()
+		}
+		n.table = dd.newStruct(c.table.mval.Field(f.index), pos)
+	}
+	return directCursor{table: n.table}
+}
+
+// Returns the parent table of the last key of keys, from the table at cursor.
+func (dd *directDecoder) parent(c directCursor, keys []string, pos Position) directCursor {
+	for _, key := range keys[:len(keys)-1] {
+		c = dd.enter(c, dd.lookup(c, key, pos), pos)
+	}
+	return c
+}
+
+// Handles a [key] header.
+func (dd *directDecoder) table(keys []string, pos Position) directCursor {
+	c := dd.parent(directCursor{table: dd.root}, keys, pos)
+	key := keys[len(keys)-1]
+	n := dd.lookup(c, key, pos)
+	if n.kind != 0 && n.kind != directImplicitTable {
+		dd.fallback()
+	}
+	c = dd.enter(c, n, pos)
+	n.kind = directTable
+	return c
+}
+
+// Handles a [[key]] header.
+func (dd *directDecoder) arrayTable(keys []string, pos Position) directCursor {
+	c := dd.parent(directCursor{table: dd.root}, keys, pos)
+	key := keys[len(keys)-1]
+	n := dd.lookup(c, key, pos)
+	switch n.kind {
+	case 0:
+		n.kind = directArray
+	case directArray:
+	default:
+		dd.fallback()
+	}
+	n.count++
+	if n.index < 0 {
+		return directCursor{table: c.table, node: n}
+	}
+
+	f := c.table.fields.list[n.index]
+	if n.count == 1 && !dd.decodableArray(f.field.Type) {
+		dd.fallback()
+	}
+	elem := dd.newStruct(reflect.New(f.field.Type.Elem()).Elem(), pos)
+	n.array = append(n.array, elem)
+	return directCursor{table: elem}
+}
+
+// Handles a key = value line in the table at cursor, reading the value.
+func (dd *directDecoder) assign(c directCursor, keys []string, pos Position) {
+	c = dd.parent(c, keys, pos)
+	key := keys[len(keys)-1]
+	n := dd.lookup(c, key, pos)
+	if n.kind != 0 {
+		dd.fallback()
+	}
+	n.kind = directValue
+	if n.index < 0 {
+		dd.parser.parseRvalue()
+		return
+	}
+
+	f := c.table.fields.list[n.index]
+	fval := c.table.mval.Field(f.index)
+	if dd.scalar(fval) {
+		return
+	}
+	value := dd.parser.parseRvalue()
+	if dd.d.strict && containsTable(value) {
+		// The keys of inline tables are checked from a Tree
+		dd.fallback()
+	}
+	mvalf, err := dd.d.valueFromToml(f.field.Type, value, &fval)
+	if err != nil {
+		dd.fallback()
+	}
+	fval.Set(mvalf)
+}
+
+// Reads the next value into fval if it is a scalar of the kind of fval, which
+// is then set as valueFromToml would, without converting the value to an
+// interface{}. It reports whether it did.
+func (dd *directDecoder) scalar(fval reflect.Value) bool {
+	p := dd.parser
+	tok := p.peek()
+	if tok == nil || dd.d.decoderFor(fval.Type()) != nil {
+		return false
+	}
+	switch fval.Kind() {
+	case reflect.String:
+		// The parser has no options, so strings are not expanded
+		if tok.typ != tokenString && tok.typ != tokenLiteralString {
+			return false
+		}
+		p.getToken()
+		fval.SetString(tok.val)
+	case reflect.Bool:
+		if tok.typ != tokenTrue && tok.typ != tokenFalse {
+			return false
+		}
+		p.getToken()
+		fval.SetBool(tok.typ == tokenTrue)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if tok.typ != tokenInteger {
+			return false
+		}
+		p.getToken()
+		digits, base := p.integerDigits(tok)
+		i, err := strconv.ParseInt(digits, base, 64)
+		if err != nil || fval.OverflowInt(i) {
+			dd.fallback()
+		}
+		fval.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if tok.typ != tokenInteger {
+			return false
+		}
+		p.getToken()
+		digits, base := p.integerDigits(tok)
+		i, err := strconv.ParseInt(digits, base, 64)
+		if err != nil || i < 0 || fval.OverflowUint(uint64(i)) {
+			dd.fallback()
+		}
+		fval.SetUint(uint64(i))
+	case reflect.Float32, reflect.Float64:
+		if tok.typ != tokenFloat {
+			return false
+		}
+		p.getToken()
+		f := p.parseFloat(tok)
+		if fval.OverflowFloat(f) {
+			dd.fallback()
+		}
+		fval.SetFloat(f)
+	default:
+		return false
+	}
+	return true
+}
+
+// Completes the decoding of the fields of a table, once the whole document is
+// read.
+func (dd *directDecoder) complete(table *directStruct) error {
+	d := dd.d
+	for i, f := range table.fields.list {
+		n := &table.nodes[i]
+		found := n.kind != 0
+		key, pos := n.key, n.pos
+		if !found {
+			key, pos = f.opts.name, table.pos
+		}
+		if n.table != nil {
+			if err := dd.complete(n.table); err != nil {
+				return err
+			}
+			pos = n.table.pos
+		}
+		if n.array != nil {
+			array := reflect.MakeSlice(f.field.Type, len(n.array), len(n.array))
+			for j, elem := range n.array {
+				if err := dd.complete(elem); err != nil {
+					return err
+				}
+				array.Index(j).Set(elem.mval)
+			}
+			table.mval.Field(f.index).Set(array)
+			pos = n.array[len(n.array)-1].pos
+		}
+		d.pos = Source{Position: table.pos}
+		if err := d.completeField(table.mval, f, nil, found, key, Source{Position: pos}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks if a value of a document contains inline tables.
+func containsTable(value interface{}) bool {
+	switch v := value.(type) {
+	case *Tree, []*Tree:
+		return true
+	case []interface{}:
+		for _, elem := range v {
+			if containsTable(elem) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,239 @@
+package toml
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type directServer struct {
+	Host  string   `toml:"host,required"`
+	Port  int      `toml:"port" default:"80" toml_validate:"min=1"`
+	Tags  []string `toml:"tags"`
+	Extra map[string]interface{}
+}
+
+type directOwner struct {
+	Name string    `toml:"name"`
+	DOB  time.Time `toml:"dob"`
+}
+
+type directConfig struct {
+	Title   string         `toml:"title"`
+	Owner   directOwner    `toml:"owner"`
+	Servers []directServer `toml:"servers"`
+	Limits  struct {
+		Max   int64   `toml:"max" default:"10"`
+		Ratio float64 `toml:"ratio"`
+	} `toml:"limits"`
+	Values []interface{} `toml:"values"`
+}
+
+func TestDecodeDirect(t *testing.T) {
+	tests := []struct {
+		desc   string
+		doc    string
+		direct bool
+	}{
+		{"empty", ``, true},
+		{"document", `
+title = "config"
+values = [1, "two", {three = 3}]
+
+[owner]
+name = "Tom"
+dob = 1979-05-27T07:32:00Z
+
+[[servers]]
+host = "alpha"
+tags = ["a", "b"]
+Extra = {color = "red"}
+
+[[servers]]
+host = "beta"
+port = 8080
+
+[limits]
+ratio = 0.5
+`, true},
+		{"dotted keys", "owner.name = \"Tom\"\nlimits.max = 3", true},
+		{"nested headers", "[limits]\n[owner]\nname = \"a\"\n[limits.unknown]\nx = 1", true},
+		{"key spellings", "TITLE = \"a\"\n[OWNER]\nNAME = \"b\"", true},
+		{"two spellings", "TITLE = \"a\"\ntitle = \"b\"", false},
+		{"inline table", "owner = {name = \"Tom\"}", true},
+		{"table in array of tables", "[[servers]]\nhost = \"a\"\n[servers.Extra]\nx = 1", false},
+		{"duplicate key", "title = \"a\"\ntitle = \"a\"", false},
+		{"duplicate table", "[owner]\n[owner]", false},
+		{"table over value", "values = []\n[values]", false},
+		{"missing required key", "[[servers]]\nport = 1", false},
+		{"failed validation", "[[servers]]\nhost = \"a\"\nport = 0", false},
+		{"wrong type", "title = 1", false},
+		{"syntax error", "title = ", false},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			var fromTree directConfig
+			var treeErr error
+			if tree, err := LoadBytes([]byte(test.doc)); err != nil {
+				treeErr = err
+			} else {
+				treeErr = tree.Unmarshal(&fromTree)
+			}
+
+			var direct directConfig
+			d := Decoder{tagName: tagFieldName}
+			if ok := d.decodeDirect([]byte(test.doc), &direct); ok != test.direct {
+				t.Fatalf("expected direct decoding to be %v, got %v", test.direct, ok)
+			}
+			if !test.direct && !reflect.DeepEqual(direct, directConfig{}) {
+				t.Errorf("value decoded despite fallback: %+v", direct)
+			}
+
+			var decoded directConfig
+			err := Unmarshal([]byte(test.doc), &decoded)
+			if (err == nil) != (treeErr == nil) || err != nil && err.Error() != treeErr.Error() {
+				t.Fatalf("expected error %v, got %v", treeErr, err)
+			}
+			if !reflect.DeepEqual(decoded, fromTree) {
+				t.Errorf("expected\n%+v\ngot\n%+v", fromTree, decoded)
+			}
+		})
+	}
+}
+
+func TestDecodeDirectStrict(t *testing.T) {
+	for _, doc := range []string{
+		"title = \"a\"\n[owner]\nname = \"b\"",
+		"title = \"a\"\n[owner]\nnickname = \"b\"",
+		"owner = {nickname = \"b\"}",
+	} {
+		var fromTree directConfig
+		treeErr := NewDecoder(nil).Strict(true).unmarshalTree(doc, &fromTree)
+
+		var decoded directConfig
+		err := NewDecoder(nil).Strict(true).decodeBytes([]byte(doc), &decoded)
+		if (err == nil) != (treeErr == nil) || err != nil && err.Error() != treeErr.Error() {
+			t.Errorf("%q: expected error %v, got %v", doc, treeErr, err)
+		}
+		if !reflect.DeepEqual(decoded, fromTree) {
+			t.Errorf("%q: expected %+v, got %+v", doc, fromTree, decoded)
+		}
+	}
+}
+
+// Number of calls of the user code of the types below.
+var directCallbacks int
+
+type directUnmarshaler string
+
+func (u *directUnmarshaler) UnmarshalTOML(v interface{}) error {
+	directCallbacks++
+	return nil
+}
+
+type directValueUnmarshaler string
+
+func (u *directValueUnmarshaler) UnmarshalTOMLValue(node interface{}, ctx DecodeContext) error {
+	directCallbacks++
+	return nil
+}
+
+type directTextUnmarshaler string
+
+func (u *directTextUnmarshaler) UnmarshalText(text []byte) error {
+	directCallbacks++
+	return nil
+}
+
+type directDefaulter struct {
+	Name string `toml:"name"`
+}
+
+func (s *directDefaulter) SetDefaults() {
+	directCallbacks++
+}
+
+type directRegistered string
+
+type directDecoded string
+
+func countDirectCallback(v interface{}) (interface{}, error) {
+	directCallbacks++
+	return v, nil
+}
+
+func TestDecodeDirectCallsUserCodeOnce(t *testing.T) {
+	RegisterDecoder(reflect.TypeOf(directRegistered("")), func(v interface{}) (interface{}, error) {
+		directCallbacks++
+		return directRegistered(v.(string)), nil
+	})
+	defer unregisterCodecs(reflect.TypeOf(directRegistered("")))
+	const doc = "c = \"x\"\nt = 1\n"
+	tests := []struct {
+		desc  string
+		doc   string
+		v     interface{}
+		setup func(*Decoder) *Decoder
+	}{
+		{"UnmarshalTOML", doc, &struct {
+			C directUnmarshaler `toml:"c"`
+			T string            `toml:"t"`
+		}{}, nil},
+		{"UnmarshalTOMLValue", doc, &struct {
+			C directValueUnmarshaler `toml:"c"`
+			T string                 `toml:"t"`
+		}{}, nil},
+		{"UnmarshalText", doc, &struct {
+			C directTextUnmarshaler `toml:"c"`
+			T string                `toml:"t"`
+		}{}, nil},
+		{"SetDefaults", "[c]\nname = \"x\"\n[t]", &struct {
+			C directDefaulter `toml:"c"`
+			T string          `toml:"t"`
+		}{}, nil},
+		{"RegisterDecoder", doc, &struct {
+			C directRegistered `toml:"c"`
+			T string           `toml:"t"`
+		}{}, nil},
+		{"Decoder.RegisterDecoder", doc, &struct {
+			C directDecoded `toml:"c"`
+			T string        `toml:"t"`
+		}{}, func(d *Decoder) *Decoder {
+			return d.RegisterDecoder(reflect.TypeOf(directDecoded("")), countDirectCallback)
+		}},
+		{"LookupEnv", "t = 1", &struct {
+			C string `toml:"c" env:"DIRECT_C"`
+			T int    `toml:"t" toml_validate:"min=2"`
+		}{}, func(d *Decoder) *Decoder {
+			return d.LookupEnv(func(string) (string, bool) {
+				directCallbacks++
+				return "x", true
+			})
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			directCallbacks = 0
+			d := NewDecoder(strings.NewReader(test.doc))
+			if test.setup != nil {
+				d = test.setup(d)
+			}
+			if err := d.Decode(test.v); err == nil {
+				t.Fatal("expected an error")
+			}
+			if directCallbacks != 1 {
+				t.Errorf("expected user code to be called once, got %d calls", directCallbacks)
+			}
+		})
+	}
+}
+
+// Decodes doc into v from its Tree.
+func (d *Decoder) unmarshalTree(doc string, v interface{}) error {
+	var err error
+	if d.tval, err = LoadBytes([]byte(doc)); err != nil {
+		return err
+	}
+	return d.unmarshal(v)
+}
@@ -0,0 +1,91 @@
+// Struct fields encoded and decoded, computed once per type.
+
+package toml
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// A struct field encoded and decoded, with the options read from its tags.
+// Embedded structs are fields of their own, with plans of their own types.
+type structField struct {
+	index int
+	field reflect.StructField
+	opts  tomlOpts
+	// Keys the field is decoded from without KeyMatcher, in order of
+	// preference.
+	keys []string
+	// Rules of its toml_validate tag, or the error parsing them.
+	rules    []validationRule
+	rulesErr error
+}
+
+// The fields of a struct type. Without KeyMatcher, the field decoded from a key
+// is found with byKey, giving its index in list, or -1 when several fields
+// may be decoded from the key.
+type structFields struct {
+	list  []structField
+	byKey map[string]int
+}
+
+type structFieldsKey struct {
+	t  reflect.Type
+	an annotation
+}
+
+type structFieldsCache struct {
+	mu     sync.RWMutex
+	fields map[structFieldsKey]*structFields
+}
+
+// Returns the fields of the struct type t encoded and decoded with the tags of
+// an, in order. They are computed on first use.
+func (c *structFieldsCache) get(t reflect.Type, an annotation) *structFields {
+	key := structFieldsKey{t: t, an: an}
+	c.mu.RLock()
+	fields, ok := c.fields[key]
+	c.mu.RUnlock()
+	if ok {
+		return fields
+	}
+
+	fields = typeFields(t, an)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fields[key] = fields
+	return fields
+}
+
+var fieldsCache = &structFieldsCache{fields: map[structFieldsKey]*structFields{}}
+
+func typeFields(t reflect.Type, an annotation) *structFields {
+	fields := &structFields{byKey: map[string]int{}}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		opts := tomlOptions(f, an)
+		if !opts.include {
+			continue
+		}
+		field := structField{index: i, field: f, opts: opts}
+		if opts.name != "" {
+			field.keys = []string{
+				opts.name,
+				strings.ToLower(opts.name),
+				strings.ToTitle(opts.name),
+				strings.ToLower(string(opts.name[0])) + opts.name[1:],
+			}
+		}
+		field.rules, field.rulesErr = parseValidationRules(f.Tag.Get(tagValidate))
+		for _, key := range field.keys {
+			if j, ok := fields.byKey[key]; ok && j != len(fields.list) {
+				fields.byKey[key] = -1
+			} else {
+				fields.byKey[key] = len(fields.list)
+			}
+		}
+		fields.list = append(fields.list, field)
+	}
+	return fields
+}
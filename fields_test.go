@@ -0,0 +1,56 @@
+package toml
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type cachedFieldsConfig struct {
+	Name    string `toml:"name" yaml:"title"`
+	Port    int    `toml:"port" yaml:"port" default:"80"`
+	Ignored string `toml:"-" yaml:"-"`
+	private string
+}
+
+func TestStructFieldsCache(t *testing.T) {
+	fields := fieldsCache.get(reflect.TypeOf(cachedFieldsConfig{}), annotation{tag: tagFieldName}).list
+	if len(fields) != 2 || fields[0].opts.name != "name" || fields[1].index != 1 || fields[1].opts.defaultValue != "80" {
+		t.Errorf("unexpected fields: %+v", fields)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(yaml bool) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				var buf bytes.Buffer
+				enc := NewEncoder(&buf)
+				dec := NewDecoder(strings.NewReader("name = 'a'\ntitle = 'b'"))
+				expected := "name = \"a\"\nport = 80\n"
+				if yaml {
+					enc.SetTagName("yaml")
+					dec.SetTagName("yaml")
+					expected = "port = 80\ntitle = \"b\"\n"
+				}
+				var v cachedFieldsConfig
+				if err := dec.Decode(&v); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := enc.Encode(v); err != nil {
+					t.Error(err)
+					return
+				}
+				if buf.String() != expected {
+					t.Errorf("expected %q, got %q", expected, buf.String())
+					return
+				}
+			}
+		}(i%2 == 0)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,157 @@
+// Binding of TOML values to command-line flags.
+
+package toml
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FlagBinding links the leaf values of a TOML document to the flags of a
+// flag.FlagSet. See BindFlags and BindStructFlags.
+type FlagBinding struct {
+	set   *flag.FlagSet
+	flags map[string]*flagValue
+}
+
+type flagValue struct {
+	path  []string
+	value interface{}
+}
+
+// BindFlags registers on fs a flag for every leaf value of tree, except for the
+// values of arrays of tables. Flags are named after the key paths of the
+// values, such as -server.port, use the values of tree as defaults and their
+// comments as usage text.
+//
+// Once fs is parsed, call Apply to write the flags explicitly set on the
+// command line onto a Tree.
+func BindFlags(fs *flag.FlagSet, tree *Tree) *FlagBinding {
+	b := &FlagBinding{
+		set:   fs,
+		flags: make(map[string]*flagValue),
+	}
+	b.bindTree(tree, nil)
+	return b
+}
+
+// BindStructFlags is the same as BindFlags, but for the fields of v, a struct
+// or a pointer to a struct, as they would be marshaled by an Encoder. The
+// values of v are the defaults of the flags, and comment struct tags provide
+// their usage text.
+func BindStructFlags(fs *flag.FlagSet, v interface{}) (*FlagBinding, error) {
+	mtype := reflect.TypeOf(v)
+	if mtype == nil || (mtype.Kind() != reflect.Struct && (mtype.Kind() != reflect.Ptr || mtype.Elem().Kind() != reflect.Struct)) {
+		return nil, errors.New("only a struct or a pointer to struct can be bound to flags")
+	}
+	if mtype.Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil() {
+		return nil, errors.New("nil pointer cannot be bound to flags")
+	}
+	tree, err := NewEncoder(nil).valueToTree(mtype, reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return BindFlags(fs, tree), nil
+}
+
+func (b *FlagBinding) bindTree(tree *Tree, path []string) {
+	keys := tree.Keys()
+	sort.Strings(keys)
+	for _, k := range keys {
+		keyPath := append(path[:len(path):len(path)], k)
+		switch node := tree.values[k].(type) {
+		case *Tree:
+			b.bindTree(node, keyPath)
+		case *tomlValue:
+			if inline, ok := node.value.(*Tree); ok {
+				b.bindTree(inline, keyPath)
+				continue
+			}
+			names := make([]string, len(keyPath))
+			for i, key := range keyPath {
+				names[i] = quoteKeyIfNeeded(key)
+			}
+			name := strings.Join(names, ".")
+			fv := &flagValue{path: keyPath, value: node.value}
+			b.flags[name] = fv
+			b.set.Var(fv, name, node.comment)
+		}
+	}
+}
+
+// Apply sets the values of the flags explicitly set on the command line onto
+// tree, creating the keys that do not exist. Comments and formatting options
+// of existing values are kept.
+func (b *FlagBinding) Apply(tree *Tree) error {
+	if !b.set.Parsed() {
+		return errors.New("flags have not been parsed")
+	}
+	b.set.Visit(func(f *flag.Flag) {
+		fv, ok := b.flags[f.Name]
+		if !ok {
+			return
+		}
+		if existing, ok := tree.getTomlValue(fv.path); ok {
+			existing.value = fv.value
+			return
+		}
+		tree.SetPath(fv.path, fv.value)
+	})
+	return nil
+}
+
+// Returns the value at the given path, if it is a leaf of the tree.
+func (t *Tree) getTomlValue(keys []string) (*tomlValue, bool) {
+	parent, ok := t.GetPath(keys[:len(keys)-1]).(*Tree)
+	if !ok {
+		return nil, false
+	}
+	v, ok := parent.values[keys[len(keys)-1]].(*tomlValue)
+	return v, ok
+}
+
+func (v *flagValue) String() string {
+	if v == nil {
+		return ""
+	}
+	repr, _ := tomlValueStringRepresentation(v.value, "", "", OrderAlphabetical, false)
+	return repr
+}
+
+func (v *flagValue) IsBoolFlag() bool {
+	_, ok := v.value.(bool)
+	return ok
+}
+
+// Set parses s according to the type of the default value of the flag.
+func (v *flagValue) Set(s string) error {
+	var value interface{}
+	var err error
+	switch v.value.(type) {
+	case string:
+		value = s
+	case bool:
+		value, err = strconv.ParseBool(s)
+	case int64:
+		value, err = strconv.ParseInt(s, 0, 64)
+	case uint64:
+		value, err = strconv.ParseUint(s, 0, 64)
+	case float64:
+		value, err = strconv.ParseFloat(s, 64)
+	default:
+		value, err = ParseValue(s)
+		if err == nil && reflect.TypeOf(value) != reflect.TypeOf(v.value) {
+			err = fmt.Errorf("expected a value of type %T", v.value)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	v.value = value
+	return nil
+}
@@ -0,0 +1,125 @@
+package toml
+
+import (
+	"bytes"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBindFlags(t *testing.T) {
+	tree, _ := Load(`
+name = "app"
+debug = false
+ids = [1, 2]
+
+[server]
+port = 8080
+ratio = 0.5
+"base path" = "/"
+`)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	b := BindFlags(fs, tree)
+	err := fs.Parse([]string{"-server.port", "9090", "-debug", "-ids", "[3, 4]", `-server."base path"`, "/api", "-server.ratio=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Apply(tree); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"name":         "app",
+		"debug":        true,
+		"ids":          []interface{}{int64(3), int64(4)},
+		"server.port":  int64(9090),
+		"server.ratio": float64(2),
+	}
+	for key, value := range expected {
+		if got := tree.Get(key); !reflect.DeepEqual(got, value) {
+			t.Errorf("%s: expected %#v, got %#v", key, value, got)
+		}
+	}
+	if got := tree.GetPath([]string{"server", "base path"}); got != "/api" {
+		t.Errorf("expected /api, got %#v", got)
+	}
+	if pos := tree.GetPosition("server.port"); pos.Line != 7 {
+		t.Errorf("position of server.port should be kept, got %v", pos)
+	}
+}
+
+func TestBindFlagsErrors(t *testing.T) {
+	tree, _ := Load(`
+port = 8080
+ids = [1, 2]
+`)
+
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"-port", "abc"}, `invalid value "abc" for flag -port`},
+		{[]string{"-ids", "3"}, `invalid value "3" for flag -ids: expected a value of type []interface {}`},
+	}
+	for _, test := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(&bytes.Buffer{})
+		BindFlags(fs, tree)
+		err := fs.Parse(test.args)
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%v: expected error %q, got %v", test.args, test.err, err)
+		}
+	}
+
+	b := BindFlags(flag.NewFlagSet("test", flag.ContinueOnError), tree)
+	if err := b.Apply(tree); err == nil {
+		t.Error("expected an error before parsing")
+	}
+}
+
+func TestBindStructFlags(t *testing.T) {
+	type server struct {
+		Host string `toml:"host" comment:"Host to listen on"`
+		Port int    `toml:"port" comment:"Port to listen on"`
+	}
+	type config struct {
+		Verbose bool   `toml:"verbose"`
+		Server  server `toml:"server"`
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	b, err := BindStructFlags(fs, config{Server: server{Host: "localhost", Port: 80}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := fs.Lookup("server.port")
+	if f == nil || f.Usage != "Port to listen on" || f.DefValue != "80" {
+		t.Fatalf("unexpected flag: %#v", f)
+	}
+	if f := fs.Lookup("server.host"); f == nil || f.DefValue != `"localhost"` {
+		t.Fatalf("unexpected flag: %#v", f)
+	}
+
+	if err := fs.Parse([]string{"-server.port", "8080"}); err != nil {
+		t.Fatal(err)
+	}
+	tree, _ := Load(`verbose = true`)
+	if err := b.Apply(tree); err != nil {
+		t.Fatal(err)
+	}
+
+	var c config
+	if err := tree.Unmarshal(&c); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Verbose || c.Server.Port != 8080 || c.Server.Host != "" {
+		t.Errorf("unexpected config: %+v", c)
+	}
+
+	if _, err := BindStructFlags(fs, 42); err == nil {
+		t.Error("expected an error binding a non-struct")
+	}
+}
@@ -0,0 +1,251 @@
+// Conversion between trees and maps of flat key paths.
+
+package toml
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Flatten returns the values of the tree keyed by their full key path, such as
+// `server."base path"`. Keys are quoted when they are not valid bare keys, and
+// the elements of arrays of tables are designated by their index between
+// brackets, such as `servers[0].host`. Inline tables are flattened like other
+// tables, empty tables are map[string]interface{} values, and empty arrays of
+// tables are []map[string]interface{} values.
+func (t *Tree) Flatten() map[string]interface{} {
+	result := make(map[string]interface{})
+	for k, v := range t.values {
+		flattenNode(result, flatKey(k), v)
+	}
+	return result
+}
+
+func flattenNode(result map[string]interface{}, path string, node interface{}) {
+	switch node := node.(type) {
+	case *Tree:
+		if len(node.values) == 0 {
+			result[path] = map[string]interface{}{}
+		}
+		for k, v := range node.values {
+			flattenNode(result, path+"."+flatKey(k), v)
+		}
+	case []*Tree:
+		if len(node) == 0 {
+			result[path] = []map[string]interface{}{}
+		}
+		for i, tree := range node {
+			flattenNode(result, path+"["+strconv.Itoa(i)+"]", tree)
+		}
+	case *tomlValue:
+		if tree, ok := node.value.(*Tree); ok {
+			flattenNode(result, path, tree)
+		} else {
+			result[path] = node.value
+		}
+	}
+}
+
+// Returns the segment of a flat key path designating the key k, quoted unless
+// it is a bare key.
+func flatKey(k string) string {
+	if k == "" {
+		return `""`
+	}
+	for _, r := range k {
+		if !isValidBareChar(r) {
+			return quoteKey(k)
+		}
+	}
+	return k
+}
+
+// Unflatten creates a Tree from a map of values keyed by their full key path,
+// as returned by Tree.Flatten. The indexes of the elements of an array of
+// tables must start at zero and be contiguous.
+func Unflatten(m map[string]interface{}) (*Tree, error) {
+	type entry struct {
+		key  string
+		path []flatSegment
+	}
+	entries := make([]entry, 0, len(m))
+	for key := range m {
+		path, err := parseFlatKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %s", key, err)
+		}
+		entries = append(entries, entry{key, path})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if c := compareFlatPaths(entries[i].path, entries[j].path); c != 0 {
+			return c < 0
+		}
+		return entries[i].key < entries[j].key
+	})
+
+	tree := newTree()
+	for _, e := range entries {
+		if err := tree.unflatten(e.path, m[e.key]); err != nil {
+			return nil, fmt.Errorf("key %q: %s", e.key, err)
+		}
+	}
+	return tree, nil
+}
+
+type flatSegment struct {
+	key   string
+	index int // -1 when the segment does not designate an array element
+}
+
+func (t *Tree) unflatten(path []flatSegment, value interface{}) error {
+	subtree := t
+	for i, segment := range path {
+		last := i == len(path)-1
+		node, exists := subtree.values[segment.key]
+
+		if segment.index < 0 {
+			if last {
+				if exists {
+					return fmt.Errorf("duplicate key %s", segment.key)
+				}
+				v, err := flatValue(value)
+				if err != nil {
+					return err
+				}
+				subtree.values[segment.key] = v
+				return nil
+			}
+			if !exists {
+				node = newTree()
+				subtree.values[segment.key] = node
+			}
+			next, ok := node.(*Tree)
+			if !ok {
+				return fmt.Errorf("%s is not a table", segment.key)
+			}
+			subtree = next
+			continue
+		}
+
+		if !exists {
+			node = []*Tree{}
+		}
+		array, ok := node.([]*Tree)
+		if !ok {
+			return fmt.Errorf("%s is not an array of tables", segment.key)
+		}
+		switch {
+		case segment.index == len(array):
+			array = append(array, newTree())
+			subtree.values[segment.key] = array
+		case segment.index > len(array):
+			return fmt.Errorf("missing element %d of array of tables %s", len(array), segment.key)
+		}
+		if last {
+			if _, ok := value.(map[string]interface{}); !ok || len(array[segment.index].values) > 0 {
+				return fmt.Errorf("element %d of %s must be a table", segment.index, segment.key)
+			}
+			return nil
+		}
+		subtree = array[segment.index]
+	}
+	return nil
+}
+
+// Converts a value of a flattened map to a node of a tree. Arrays of values
+// are kept as []interface{}, the way the parser creates them.
+func flatValue(value interface{}) (interface{}, error) {
+	if array, ok := value.([]interface{}); ok {
+		if v, err := simpleValueCoercion(array); err == nil {
+			return &tomlValue{value: v}, nil
+		}
+	}
+	return toTree(value)
+}
+
+func compareFlatPaths(a, b []flatSegment) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := strings.Compare(a[i].key, b[i].key); c != 0 {
+			return c
+		}
+		if a[i].index != b[i].index {
+			return a[i].index - b[i].index
+		}
+	}
+	return len(a) - len(b)
+}
+
+// Parses a key path as returned by Tree.Flatten.
+func parseFlatKey(s string) ([]flatSegment, error) {
+	var path []flatSegment
+	i := 0
+	for {
+		var key string
+		switch {
+		case i < len(s) && s[i] == '"':
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, errors.New("unclosed double-quoted key")
+			}
+			unquoted, err := strconv.Unquote(s[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid double-quoted key: %s", s[i:end+1])
+			}
+			key = unquoted
+			i = end + 1
+		case i < len(s) && s[i] == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unclosed single-quoted key")
+			}
+			key = s[i+1 : i+1+end]
+			i += end + 2
+		default:
+			start := i
+			for i < len(s) {
+				r, size := utf8.DecodeRuneInString(s[i:])
+				if !isValidBareChar(r) {
+					break
+				}
+				i += size
+			}
+			if i == start {
+				return nil, errors.New("expecting a key")
+			}
+			key = s[start:i]
+		}
+
+		segment := flatSegment{key: key, index: -1}
+		if i < len(s) && s[i] == '[' {
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return nil, errors.New("unclosed index")
+			}
+			index, err := strconv.Atoi(s[i+1 : i+end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid index: %s", s[i+1:i+end])
+			}
+			segment.index = index
+			i += end + 1
+		}
+		path = append(path, segment)
+
+		if i == len(s) {
+			return path, nil
+		}
+		if s[i] != '.' {
+			return nil, fmt.Errorf("unexpected character: %c", s[i])
+		}
+		i++
+	}
+}
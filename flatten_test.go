@@ -0,0 +1,168 @@
+package toml
+
+import (
+	"reflect"
+	"testing"
+)
+
+const flattenTestDocument = `
+title = "example"
+date = 1979-05-27T07:32:00
+empty = {}
+point = { x = 1, y = 2 }
+
+[server]
+"base path" = "/api"
+ports = [80, 443]
+
+[[servers]]
+host = "alpha"
+
+[[servers]]
+host = "beta"
+"tls.cert" = "beta.pem"
+`
+
+func TestTreeFlatten(t *testing.T) {
+	tree, err := Load(flattenTestDocument)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		`title`:                 "example",
+		`date`:                  LocalDateTime{Date: LocalDate{Year: 1979, Month: 5, Day: 27}, Time: LocalTime{Hour: 7, Minute: 32}},
+		`empty`:                 map[string]interface{}{},
+		`point.x`:               int64(1),
+		`point.y`:               int64(2),
+		`server."base path"`:    "/api",
+		`server.ports`:          []interface{}{int64(80), int64(443)},
+		`servers[0].host`:       "alpha",
+		`servers[1].host`:       "beta",
+		`servers[1]."tls.cert"`: "beta.pem",
+	}
+	if flat := tree.Flatten(); !reflect.DeepEqual(flat, expected) {
+		t.Errorf("expected %#v, got %#v", expected, flat)
+	}
+}
+
+func TestUnflatten(t *testing.T) {
+	tree, _ := Load(flattenTestDocument)
+	flat := tree.Flatten()
+
+	unflattened, err := Unflatten(flat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(unflattened.Flatten(), flat) {
+		t.Errorf("expected %#v, got %#v", flat, unflattened.Flatten())
+	}
+	if _, ok := unflattened.Get("servers").([]*Tree); !ok {
+		t.Errorf("servers should be an array of tables, got %T", unflattened.Get("servers"))
+	}
+
+	unflattened, err = Unflatten(map[string]interface{}{
+		`a.'b.c'.d`:        1,
+		`a."e\"f"`:         "g",
+		`list[0]`:          map[string]interface{}{},
+		`list[1].x`:        true,
+		`list[10].x`:       false,
+		`list[2].x`:        true,
+		`list[3].x`:        true,
+		`list[4].x`:        true,
+		`list[5].x`:        true,
+		`list[6].x`:        true,
+		`list[7].x`:        true,
+		`list[8].x`:        true,
+		`list[9].x`:        true,
+		`local."time"`:     LocalTime{Hour: 7, Minute: 32},
+		`table`:            map[string]interface{}{"k": "v"},
+		`table-other.deep`: []int{1, 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		path  []string
+		value interface{}
+	}{
+		{[]string{"a", "b.c", "d"}, int64(1)},
+		{[]string{"a", "e\"f"}, "g"},
+		{[]string{"local", "time"}, LocalTime{Hour: 7, Minute: 32}},
+		{[]string{"table", "k"}, "v"},
+		{[]string{"table-other", "deep"}, []int64{1, 2}},
+	}
+	for _, e := range expected {
+		if got := unflattened.GetPath(e.path); !reflect.DeepEqual(got, e.value) {
+			t.Errorf("%v: expected %#v, got %#v", e.path, e.value, got)
+		}
+	}
+	list := unflattened.Get("list").([]*Tree)
+	if len(list) != 11 || len(list[0].Keys()) != 0 || list[10].Get("x") != false {
+		t.Errorf("unexpected list: %v", list)
+	}
+}
+
+func TestFlattenRoundTrip(t *testing.T) {
+	tree, err := TreeFromMap(map[string]interface{}{
+		`"quoted"`: "a",
+		`"`:        "b",
+		`back\`:    "c",
+		"table":    map[string]interface{}{`"x"`: "d"},
+		"empty":    []map[string]interface{}{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flat := tree.Flatten()
+	expected := map[string]interface{}{
+		`"\"quoted\""`:  "a",
+		`"\""`:          "b",
+		`"back\\"`:      "c",
+		`table."\"x\""`: "d",
+		`empty`:         []map[string]interface{}{},
+	}
+	if !reflect.DeepEqual(flat, expected) {
+		t.Errorf("expected %#v, got %#v", expected, flat)
+	}
+
+	unflattened, err := Unflatten(flat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(unflattened.ToMap(), tree.ToMap()) {
+		t.Errorf("expected %#v, got %#v", tree.ToMap(), unflattened.ToMap())
+	}
+	if empty, ok := unflattened.Get("empty").([]*Tree); !ok || len(empty) != 0 {
+		t.Errorf("expected an empty array of tables, got %#v", unflattened.Get("empty"))
+	}
+}
+
+func TestUnflattenErrors(t *testing.T) {
+	tests := []struct {
+		m   map[string]interface{}
+		err string
+	}{
+		{map[string]interface{}{"a.": 1}, `invalid key "a.": expecting a key`},
+		{map[string]interface{}{`"a`: 1}, `invalid key "\"a": unclosed double-quoted key`},
+		{map[string]interface{}{"a[x]": 1}, `invalid key "a[x]": invalid index: x`},
+		{map[string]interface{}{"a b": 1}, `invalid key "a b": unexpected character:  `},
+		{map[string]interface{}{"a": 1, "a.b": 2}, `key "a.b": a is not a table`},
+		{map[string]interface{}{"a": 1, `"a"`: 2}, `key "a": duplicate key a`},
+		{map[string]interface{}{"a[1].b": 1}, `key "a[1].b": missing element 0 of array of tables a`},
+		{map[string]interface{}{"a.b": 1, "a[0].b": 2}, `key "a[0].b": a is not an array of tables`},
+		{map[string]interface{}{"a[0]": 1}, `key "a[0]": element 0 of a must be a table`},
+		{map[string]interface{}{"a": struct{}{}}, `key "a": cannot convert type struct {} to Tree`},
+	}
+
+	for _, test := range tests {
+		_, err := Unflatten(test.m)
+		if err == nil {
+			t.Errorf("%v: expected error %q, got none", test.m, test.err)
+			continue
+		}
+		if err.Error() != test.err {
+			t.Errorf("%v: expected error %q, got %q", test.m, test.err, err.Error())
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Layout of the documents written by the Encoder and by trees.
+
+package toml
+
+import (
+	"bytes"
+	"io"
+)
+
+// FormatOptions describes the layout of the documents written by an Encoder or
+// by Tree.WriteFormatted. The zero value writes documents without indentation
+// or blank lines between tables, and without final newline; use
+// DefaultFormatOptions as a starting point to change only some of them.
+type FormatOptions struct {
+	// IndentTables indents the keys of sub-tables by one indentation per
+	// level of nesting.
+	IndentTables bool
+	// TableSpacing is the number of blank lines written before each table
+	// header, or before the comment of the table.
+	TableSpacing int
+	// KeyGroupSpacing separates the key groups of a table with a blank line.
+	// The keys of each sub-table written as dotted keys form a group, and the
+	// other keys of the table another one.
+	KeyGroupSpacing bool
+	// FinalNewline ends the document with a line ending.
+	FinalNewline bool
+	// CRLF ends the lines with "\r\n" instead of "\n".
+	CRLF bool
+}
+
+// DefaultFormatOptions returns the layout used by default: sub-tables are
+// indented, table headers are preceded by a blank line, and the lines end
+// with "\n", the last one included.
+func DefaultFormatOptions() FormatOptions {
+	return FormatOptions{
+		IndentTables: true,
+		TableSpacing: 1,
+		FinalNewline: true,
+	}
+}
+
+// FormatOptions sets the layout of the documents. Encoder.Indentation sets
+// the indentation of the sub-tables.
+func (e *Encoder) FormatOptions(opts FormatOptions) *Encoder {
+	e.format = opts
+	return e
+}
+
+// WriteFormatted writes the tree to w like WriteTo, with the given layout.
+// It returns the number of bytes written.
+func (t *Tree) WriteFormatted(w io.Writer, opts FormatOptions) (int64, error) {
+	wopts := writeOpts{
+		order:        OrderAlphabetical,
+		indentString: "  ",
+		headerLevels: -1,
+	}
+	wopts.setFormat(opts)
+	fw := newFormatWriter(w, opts)
+	if _, err := t.writeToOrdered(fw, "", "", 0, wopts, false); err != nil {
+		return fw.n, err
+	}
+	err := fw.close()
+	return fw.n, err
+}
+
+// Sets the options of the writer given by the layout.
+func (opts *writeOpts) setFormat(format FormatOptions) {
+	if !format.IndentTables {
+		opts.indentString = ""
+	}
+	opts.tableSpacing = format.TableSpacing
+	opts.keyGroupSpacing = format.KeyGroupSpacing
+}
+
+// Writer converting the lines written by the tree writer, which end with "\n",
+// to the line endings of a layout. The last line ending written is held back
+// until more is written, to drop it if the document has no final newline.
+type formatWriter struct {
+	w            io.Writer
+	eol          []byte
+	finalNewline bool
+	pending      bool
+	n            int64
+}
+
+func newFormatWriter(w io.Writer, opts FormatOptions) *formatWriter {
+	fw := &formatWriter{w: w, eol: []byte("\n"), finalNewline: opts.FinalNewline}
+	if opts.CRLF {
+		fw.eol = []byte("\r\n")
+	}
+	return fw
+}
+
+func (fw *formatWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var b []byte
+	if fw.pending {
+		b = append(b, fw.eol...)
+	}
+	body := p
+	hold := body[len(body)-1] == '\n'
+	if hold {
+		body = body[:len(body)-1]
+	}
+	if len(fw.eol) == 1 {
+		b = append(b, body...)
+	} else {
+		b = append(b, bytes.Replace(body, []byte("\n"), fw.eol, -1)...)
+	}
+	n, err := fw.w.Write(b)
+	fw.n += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	fw.pending = hold
+	return len(p), nil
+}
+
+// Writes the last line ending held back, if the layout has a final newline.
+func (fw *formatWriter) close() error {
+	if !fw.pending || !fw.finalNewline {
+		return nil
+	}
+	fw.pending = false
+	n, err := fw.w.Write(fw.eol)
+	fw.n += int64(n)
+	return err
+}
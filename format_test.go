@@ -0,0 +1,78 @@
+package toml
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTreeWriteFormatted(t *testing.T) {
+	tree, err := Load("title = 'x'\n[a]\nk = 1\n[a.b]\nj = 2\n[[c]]\nv = 1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		opts     FormatOptions
+		expected string
+	}{
+		{DefaultFormatOptions(), "title = \"x\"\n\n[a]\n  k = 1\n\n  [a.b]\n    j = 2\n\n[[c]]\n  v = 1\n"},
+		{FormatOptions{}, "title = \"x\"\n[a]\nk = 1\n[a.b]\nj = 2\n[[c]]\nv = 1"},
+		{FormatOptions{TableSpacing: 2, FinalNewline: true, CRLF: true}, "title = \"x\"\r\n\r\n\r\n[a]\r\nk = 1\r\n\r\n\r\n[a.b]\r\nj = 2\r\n\r\n\r\n[[c]]\r\nv = 1\r\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		n, err := tree.WriteFormatted(&buf, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("%+v: expected %q, got %q", test.opts, test.expected, buf.String())
+		}
+		if n != int64(buf.Len()) {
+			t.Errorf("%+v: expected %d bytes written, got %d", test.opts, buf.Len(), n)
+		}
+		if _, err := LoadBytes(buf.Bytes()); err != nil {
+			t.Errorf("%+v: %s", test.opts, err)
+		}
+	}
+}
+
+func TestEncoderFormatOptions(t *testing.T) {
+	type point struct{ X, Y int }
+	type config struct {
+		Name     string
+		Color    string
+		Physical point
+		Site     point
+	}
+	v := config{"apple", "red", point{1, 2}, point{3, 4}}
+
+	opts := DefaultFormatOptions()
+	opts.KeyGroupSpacing = true
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).TableStyle(TableDottedKeys, 0).FormatOptions(opts).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	expected := `Color = "red"
+Name = "apple"
+
+Physical.X = 1
+Physical.Y = 2
+
+Site.X = 3
+Site.Y = 4
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n-----\n%s\n-----\ngot\n-----\n%s\n-----\n", expected, buf.String())
+	}
+
+	opts = DefaultFormatOptions()
+	opts.IndentTables = false
+	buf.Reset()
+	if err := NewEncoder(&buf).Indentation("    ").FormatOptions(opts).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	expected = "Color = \"red\"\nName = \"apple\"\n\n[Physical]\nX = 1\nY = 2\n\n[Site]\nX = 3\nY = 4\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+}
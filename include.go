@@ -0,0 +1,177 @@
+//go:build go1.16
+// +build go1.16
+
+// Composition of documents split across several files.
+
+package toml
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+const defaultIncludeDirective = "include"
+
+// IncludeDirective returns a LoadOption that changes the name of the key
+// LoadFS reads the list of included files from. It defaults to "include".
+func IncludeDirective(key string) LoadOption {
+	return func(o *loadOptions) {
+		o.include = key
+	}
+}
+
+// LoadFS creates a Tree from the file name of fsys, composed with the files it
+// includes.
+//
+// The top-level "include" key of a document lists the files to include, as a
+// string or an array of strings:
+//
+//	include = ["base.toml", "conf.d/*.toml"]
+//
+// Paths are relative to the directory of the including file, and may be
+// patterns as understood by fs.Glob. Files matching a pattern are included in
+// lexical order, and a path that is not a pattern must exist. Included files
+// may include other files, but include cycles are reported as errors.
+//
+// The included documents are merged in the order they are listed, then the
+// including document is merged on top of them: values of later documents
+// replace the values of earlier ones, and tables are merged key by key.
+// Inline tables and arrays of tables are replaced as a whole. The include key
+// itself is not part of the resulting Tree.
+//
+// The source of every element of the Tree, as returned by Tree.GetSource,
+// records the name of the file it was read from.
+func LoadFS(fsys fs.FS, name string, opts ...LoadOption) (*Tree, error) {
+	options := newLoadOptions(opts)
+	if options.include == "" {
+		options.include = defaultIncludeDirective
+	}
+	l := &includeLoader{
+		fsys:    fsys,
+		options: options,
+	}
+	tree, err := l.load(name)
+	if err != nil {
+		return nil, err
+	}
+	if options.resolve {
+		if err := tree.resolve(options.lookupEnv); err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
+
+type includeLoader struct {
+	fsys    fs.FS
+	options loadOptions
+	stack   []string
+}
+
+func (l *includeLoader) load(name string) (*Tree, error) {
+	b, err := fs.ReadFile(l.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	options := l.options
+	options.filename = name
+	tree, err := loadBytes(b, options)
+	if err != nil {
+		return nil, err
+	}
+
+	includes, err := l.includes(tree, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(includes) == 0 {
+		return tree, nil
+	}
+
+	l.stack = append(l.stack, name)
+	defer func() {
+		l.stack = l.stack[:len(l.stack)-1]
+	}()
+
+	result := newTreeWithPosition(tree.position)
+	result.filename = tree.filename
+	result.comment = tree.comment
+	for _, include := range includes {
+		sub, err := l.load(include)
+		if err != nil {
+			return nil, err
+		}
+		result.merge(sub)
+	}
+	result.merge(tree)
+	return result, nil
+}
+
+// Removes the include directive from the tree, and returns the paths of the
+// files it designates.
+func (l *includeLoader) includes(tree *Tree, name string) ([]string, error) {
+	key := l.options.include
+	v, ok := tree.values[key]
+	if !ok {
+		return nil, nil
+	}
+	pos := tree.GetSourcePath([]string{key})
+	delete(tree.values, key)
+
+	patterns, ok := includePatterns(v)
+	if !ok {
+		return nil, fmt.Errorf("%s: %s must be a string or an array of strings", pos, key)
+	}
+
+	dir := path.Dir(name)
+	var paths []string
+	for _, pattern := range patterns {
+		p := path.Join(dir, pattern)
+		if !strings.ContainsAny(pattern, `*?[\`) {
+			paths = append(paths, p)
+			continue
+		}
+		matches, err := fs.Glob(l.fsys, p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid include pattern %q: %s", pos, pattern, err)
+		}
+		paths = append(paths, matches...)
+	}
+
+	for _, p := range paths {
+		if p == name {
+			return nil, fmt.Errorf("%s: include cycle: %s -> %s", pos, name, p)
+		}
+		for i, s := range l.stack {
+			if s == p {
+				cycle := append(append(l.stack[i:len(l.stack):len(l.stack)], name), p)
+				return nil, fmt.Errorf("%s: include cycle: %s", pos, strings.Join(cycle, " -> "))
+			}
+		}
+	}
+	return paths, nil
+}
+
+func includePatterns(v interface{}) ([]string, bool) {
+	tv, ok := v.(*tomlValue)
+	if !ok {
+		return nil, false
+	}
+	switch value := tv.value.(type) {
+	case string:
+		return []string{value}, true
+	case []interface{}:
+		patterns := make([]string, len(value))
+		for i, item := range value {
+			s, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			patterns[i] = s
+		}
+		return patterns, true
+	}
+	return nil, false
+}
@@ -0,0 +1,122 @@
+//go:build go1.16
+// +build go1.16
+
+package toml
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"etc/app.toml": {Data: []byte(`
+include = ["base.toml", "conf.d/*.toml"]
+name = "app"
+
+[server]
+port = 8080
+`)},
+		"etc/base.toml": {Data: []byte(`
+name = "base"
+debug = false
+
+[server]
+host = "localhost"
+port = 80
+`)},
+		"etc/conf.d/10-debug.toml": {Data: []byte(`debug = true`)},
+		"etc/conf.d/20-server.toml": {Data: []byte(`
+include = "../common/log.toml"
+
+[server]
+host = "example.com"
+`)},
+		"etc/common/log.toml": {Data: []byte(`
+[log]
+level = "info"
+`)},
+	}
+
+	tree, err := LoadFS(fsys, "etc/app.toml")
+	assertTree(t, tree, err, map[string]interface{}{
+		"name":  "app",
+		"debug": true,
+		"server": map[string]interface{}{
+			"host": "example.com",
+			"port": int64(8080),
+		},
+		"log": map[string]interface{}{
+			"level": "info",
+		},
+	})
+	if tree.Has("include") {
+		t.Error("include directive should be removed from the tree")
+	}
+
+	sources := map[string]Source{
+		"name":        {Filename: "etc/app.toml", Position: Position{Line: 3, Col: 1}},
+		"debug":       {Filename: "etc/conf.d/10-debug.toml", Position: Position{Line: 1, Col: 1}},
+		"server.host": {Filename: "etc/conf.d/20-server.toml", Position: Position{Line: 5, Col: 1}},
+		"server.port": {Filename: "etc/app.toml", Position: Position{Line: 6, Col: 1}},
+		"log.level":   {Filename: "etc/common/log.toml", Position: Position{Line: 3, Col: 1}},
+	}
+	for key, expected := range sources {
+		if src := tree.GetSource(key); src != expected {
+			t.Errorf("source of %s: expected %#v, got %#v", key, expected, src)
+		}
+		if pos := tree.GetPosition(key); pos != expected.Position {
+			t.Errorf("position of %s: expected %v, got %v", key, expected.Position, pos)
+		}
+	}
+}
+
+func TestLoadFSIncludeDirective(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.toml": {Data: []byte(`
+include = "not a directive"
+imports = ["b.toml"]
+`)},
+		"b.toml": {Data: []byte(`b = "${include}"`)},
+	}
+
+	tree, err := LoadFS(fsys, "a.toml", IncludeDirective("imports"), ResolveReferences())
+	assertTree(t, tree, err, map[string]interface{}{
+		"include": "not a directive",
+		"b":       "not a directive",
+	})
+}
+
+func TestLoadFSErrors(t *testing.T) {
+	fsys := fstest.MapFS{
+		"self.toml":    {Data: []byte(`include = "self.toml"`)},
+		"a.toml":       {Data: []byte(`include = "b.toml"`)},
+		"b.toml":       {Data: []byte("\ninclude = [\"a.toml\"]")},
+		"invalid.toml": {Data: []byte(`include = 42`)},
+		"missing.toml": {Data: []byte(`include = "nope.toml"`)},
+		"parse.toml":   {Data: []byte(`include = "broken.toml"`)},
+		"broken.toml":  {Data: []byte("a = 1\nb = ")},
+	}
+
+	tests := []struct {
+		name string
+		err  string
+	}{
+		{"self.toml", "self.toml:(1, 1): include cycle: self.toml -> self.toml"},
+		{"a.toml", "b.toml:(2, 1): include cycle: a.toml -> b.toml -> a.toml"},
+		{"invalid.toml", "invalid.toml:(1, 1): include must be a string or an array of strings"},
+		{"missing.toml", "open nope.toml: file does not exist"},
+		{"parse.toml", "broken.toml:(2, 5): expecting a value"},
+	}
+
+	for _, test := range tests {
+		_, err := LoadFS(fsys, test.name)
+		if err == nil {
+			t.Errorf("%s: expected error %q, got none", test.name, test.err)
+			continue
+		}
+		if err.Error() != test.err {
+			t.Errorf("%s: expected error %q, got %q", test.name, test.err, err.Error())
+		}
+	}
+}
@@ -11,12 +11,15 @@ import (
 // The input supports double quotation and single quotation,
 // but escape sequences are not supported. Lexers must unescape them beforehand.
 func parseKey(key string) ([]string, error) {
-	runes := []rune(key)
-	var groups []string
-
 	if len(key) == 0 {
 		return nil, errors.New("empty key")
 	}
+	if groups, ok := splitBareKeys(nil, key); ok {
+		return groups, nil
+	}
+
+	runes := []rune(key)
+	var groups []string
 
 	idx := 0
 	for idx < len(runes) {
@@ -107,6 +110,27 @@ func parseKey(key string) ([]string, error) {
 	return groups, nil
 }
 
+// Appends the groups of key to dst if it is made of bare keys separated by
+// dots, the most common kind of key. It reports whether it is.
+func splitBareKeys(dst []string, key string) ([]string, bool) {
+	start := 0
+	for i, r := range key {
+		if r == '.' {
+			if i == start {
+				return dst, false
+			}
+			dst = append(dst, key[start:i])
+			start = i + 1
+		} else if !isValidBareChar(r) {
+			return dst, false
+		}
+	}
+	if start == len(key) {
+		return dst, false
+	}
+	return append(dst, key[start:]), true
+}
+
 func isValidBareChar(r rune) bool {
 	return isAlphanumeric(r) || r == '-' || isDigit(r)
 }
@@ -0,0 +1,515 @@
+// Loading of documents on demand.
+
+package toml
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// LazyTree is a TOML document whose values are parsed on demand. Loading it
+// only scans the document to index the byte ranges of its top-level keys: the
+// tables and arrays of tables under each of them, and the keys of the root
+// table. The values of a top-level key are parsed the first time a lookup
+// touches it, and kept for the next ones.
+//
+// Its lookup methods behave like the ones of Tree. Syntax errors are only
+// reported when the top-level key holding them is parsed: the lookups then
+// return nil, and Tree and Unmarshal return the error.
+type LazyTree struct {
+	src     []byte
+	options loadOptions
+	keys    []string
+	index   map[string]*lazyKey
+
+	mu sync.Mutex
+}
+
+// The byte ranges of a top-level key, and its values once parsed.
+type lazyKey struct {
+	chunks []lazyChunk
+	loaded bool
+	value  interface{} // *tomlValue, *Tree or []*Tree
+	err    error
+}
+
+// A range of lines of the document, starting at line.
+type lazyChunk struct {
+	start, end int
+	line       int
+}
+
+// LoadLazy creates a LazyTree from a []byte. The ResolveReferences option has
+// no effect on it.
+func LoadLazy(b []byte, opts ...LoadOption) (*LazyTree, error) {
+	t := &LazyTree{
+		src:     trimBOM(b),
+		options: newLoadOptions(opts),
+		index:   map[string]*lazyKey{},
+	}
+	t.options.resolve = false
+	if err := t.scan(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// LoadLazyFile creates a LazyTree from a file. The sources of its elements, as
+// well as errors, refer to the given path.
+func LoadLazyFile(path string, opts ...LoadOption) (*LazyTree, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return LoadLazy(b, append(opts, withFilename(path))...)
+}
+
+// Position returns the position of the tree.
+func (t *LazyTree) Position() Position {
+	return Position{Line: 1, Col: 1}
+}
+
+// Keys returns the keys of the root table, in the order of the document,
+// without parsing them.
+func (t *LazyTree) Keys() []string {
+	return append([]string(nil), t.keys...)
+}
+
+// Has returns a boolean indicating if the given key exists.
+func (t *LazyTree) Has(key string) bool {
+	return t.subTree(rootKey(key)).Has(key)
+}
+
+// HasPath returns true if the given path of keys exists, false otherwise.
+func (t *LazyTree) HasPath(keys []string) bool {
+	if len(keys) == 0 {
+		return true
+	}
+	return t.subTree(keys[0]).HasPath(keys)
+}
+
+// Get returns the value at key, like Tree.Get.
+func (t *LazyTree) Get(key string) interface{} {
+	if key == "" {
+		return t
+	}
+	return t.subTree(rootKey(key)).Get(key)
+}
+
+// GetPath returns the element indicated by 'keys', like Tree.GetPath.
+func (t *LazyTree) GetPath(keys []string) interface{} {
+	if len(keys) == 0 {
+		return t
+	}
+	return t.subTree(keys[0]).GetPath(keys)
+}
+
+// GetArray returns the value at key, like Tree.GetArray.
+func (t *LazyTree) GetArray(key string) interface{} {
+	if key == "" {
+		return t
+	}
+	return t.subTree(rootKey(key)).GetArray(key)
+}
+
+// GetDefault works like Get but with a default value.
+func (t *LazyTree) GetDefault(key string, def interface{}) interface{} {
+	val := t.Get(key)
+	if val == nil {
+		return def
+	}
+	return val
+}
+
+// GetPosition returns the position of the given key.
+func (t *LazyTree) GetPosition(key string) Position {
+	if key == "" {
+		return t.Position()
+	}
+	return t.subTree(rootKey(key)).GetPosition(key)
+}
+
+// GetPositionPath returns the position of the element indicated by 'keys'.
+func (t *LazyTree) GetPositionPath(keys []string) Position {
+	if len(keys) == 0 {
+		return t.Position()
+	}
+	return t.subTree(keys[0]).GetPositionPath(keys)
+}
+
+// GetSource returns the source of the given key: its position and the file it
+// was read from.
+func (t *LazyTree) GetSource(key string) Source {
+	if key == "" {
+		return Source{Filename: t.options.filename, Position: t.Position()}
+	}
+	return t.subTree(rootKey(key)).GetSource(key)
+}
+
+// GetSourcePath returns the source of the element indicated by 'keys'.
+func (t *LazyTree) GetSourcePath(keys []string) Source {
+	if len(keys) == 0 {
+		return Source{Filename: t.options.filename, Position: t.Position()}
+	}
+	return t.subTree(keys[0]).GetSourcePath(keys)
+}
+
+// Tree returns a Tree holding the given top-level keys, or the whole document
+// if no key is given, parsing them if needed. The Tree shares its values with
+// t.
+func (t *LazyTree) Tree(keys ...string) (*Tree, error) {
+	if len(keys) == 0 {
+		keys = t.keys
+	}
+	return t.tree(keys)
+}
+
+// Unmarshal decodes the document into v like Tree.Unmarshal. Only the
+// top-level keys v may be decoded from are parsed when v points to a struct.
+func (t *LazyTree) Unmarshal(v interface{}) error {
+	tree, err := t.tree(t.keysFor(v))
+	if err != nil {
+		return err
+	}
+	return tree.Unmarshal(v)
+}
+
+// Returns a Tree holding the given top-level keys.
+func (t *LazyTree) tree(keys []string) (*Tree, error) {
+	tree := newTreeWithPosition(t.Position())
+	tree.filename = t.options.filename
+	for _, key := range keys {
+		value, err := t.load(key)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			tree.values[key] = value
+		}
+	}
+	return tree, nil
+}
+
+// Returns the top-level keys of the document v may be decoded from.
+func (t *LazyTree) keysFor(v interface{}) []string {
+	mtype := reflect.TypeOf(v)
+	if mtype == nil || mtype.Kind() != reflect.Ptr || mtype.Elem().Kind() != reflect.Struct {
+		return t.keys
+	}
+	mtype = mtype.Elem()
+	if isPrimitive(mtype) || mtype == reflect.TypeOf(Tree{}) || isValueUnmarshaler(reflect.PtrTo(mtype)) || isCustomUnmarshaler(reflect.PtrTo(mtype)) {
+		return t.keys
+	}
+	fields := fieldsCache.get(mtype, annotation{tag: tagFieldName})
+	for _, f := range fields.list {
+		if f.field.Anonymous {
+			return t.keys
+		}
+	}
+	var keys []string
+	for _, key := range t.keys {
+		if _, ok := fields.byKey[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Returns a Tree holding the top-level key, if the document has it.
+func (t *LazyTree) subTree(key string) *Tree {
+	tree := newTreeWithPosition(t.Position())
+	tree.filename = t.options.filename
+	if value, err := t.load(key); err == nil && value != nil {
+		tree.values[key] = value
+	}
+	return tree
+}
+
+// Returns the values of the top-level key, parsing them on first use, or nil
+// if the document does not have it.
+func (t *LazyTree) load(key string) (interface{}, error) {
+	k, ok := t.index[key]
+	if !ok {
+		return nil, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !k.loaded {
+		var tree *Tree
+		if tree, k.err = loadBytes(t.document(k), t.options); k.err == nil {
+			k.value = tree.values[key]
+		}
+		k.loaded = true
+	}
+	return k.value, k.err
+}
+
+// Returns the document made of the lines of the top-level key, at the same
+// positions as in the whole document.
+func (t *LazyTree) document(k *lazyKey) []byte {
+	var buf bytes.Buffer
+	line := 1
+	for _, c := range k.chunks {
+		for ; line < c.line; line++ {
+			buf.WriteByte('\n')
+		}
+		b := t.src[c.start:c.end]
+		buf.Write(b)
+		line += bytes.Count(b, []byte("\n"))
+	}
+	return buf.Bytes()
+}
+
+// Returns the first key of a dot-separated path, as split by Tree.Get.
+func rootKey(key string) string {
+	if i := strings.IndexByte(key, '.'); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// Indexes the lines of the document by top-level key: the root keys are
+// indexed with their values, and the tables with all their lines.
+func (t *LazyTree) scan() error {
+	s := lazyScanner{b: t.src, line: 1}
+	var section *lazyKey
+	sectionStart, sectionLine := 0, 0
+	closeSection := func(end int) {
+		if section != nil {
+			section.chunks = append(section.chunks, lazyChunk{start: sectionStart, end: end, line: sectionLine})
+		}
+	}
+
+	for {
+		s.skipSpace()
+		if s.i >= len(s.b) {
+			break
+		}
+		switch s.b[s.i] {
+		case '\n', '\r':
+			s.i++
+		case '#':
+			s.skipLine()
+		case '[':
+			start := s.lineStart()
+			closeSection(start)
+			key, err := s.header()
+			if err != nil {
+				return t.scanError(s.position(start), err)
+			}
+			section = t.indexKey(key)
+			sectionStart, sectionLine = start, s.lineAt(start)
+			s.skipLine()
+		default:
+			start := s.lineStart()
+			key, err := s.key()
+			if err != nil {
+				return t.scanError(s.position(start), err)
+			}
+			s.skipValue()
+			s.skipLine()
+			if section == nil {
+				k := t.indexKey(key)
+				k.chunks = append(k.chunks, lazyChunk{start: start, end: s.i, line: s.lineAt(start)})
+			}
+		}
+	}
+	closeSection(len(s.b))
+	return nil
+}
+
+func (t *LazyTree) indexKey(key string) *lazyKey {
+	k, ok := t.index[key]
+	if !ok {
+		k = &lazyKey{}
+		t.index[key] = k
+		t.keys = append(t.keys, key)
+	}
+	return k
+}
+
+func (t *LazyTree) scanError(pos Position, err error) error {
+	return fmt.Errorf("%s: %s", Source{Filename: t.options.filename, Position: pos}, err)
+}
+
+// Scanner of the lines of a document, skipping over values without parsing
+// them. Malformed values are left to the parser.
+type lazyScanner struct {
+	b []byte
+	i int
+	// Line of the byte at offset, counted up to offset
+	line, offset int
+}
+
+// Returns the line of the byte at i, which must not be before the last one
+// asked for.
+func (s *lazyScanner) lineAt(i int) int {
+	s.line += bytes.Count(s.b[s.offset:i], []byte("\n"))
+	s.offset = i
+	return s.line
+}
+
+// Returns the position of the line starting at offset i.
+func (s *lazyScanner) position(i int) Position {
+	return Position{Line: s.lineAt(i), Col: 1}
+}
+
+// Returns the offset of the start of the current line.
+func (s *lazyScanner) lineStart() int {
+	return bytes.LastIndexByte(s.b[:s.i], '\n') + 1
+}
+
+func (s *lazyScanner) skipSpace() {
+	for s.i < len(s.b) && (s.b[s.i] == ' ' || s.b[s.i] == '\t') {
+		s.i++
+	}
+}
+
+// Skips to the start of the next line.
+func (s *lazyScanner) skipLine() {
+	if i := bytes.IndexByte(s.b[s.i:], '\n'); i >= 0 {
+		s.i += i + 1
+	} else {
+		s.i = len(s.b)
+	}
+}
+
+// Reads the header of a table or array of tables, and returns its first key.
+func (s *lazyScanner) header() (string, error) {
+	s.i++
+	closing := "]"
+	if s.i < len(s.b) && s.b[s.i] == '[' {
+		s.i++
+		closing = "]]"
+	}
+	start := s.i
+	if !s.skipKey(']') {
+		return "", errors.New("unclosed table key")
+	}
+	text := string(s.b[start:s.i])
+	if !bytes.HasPrefix(s.b[s.i:], []byte(closing)) {
+		return "", errors.New("unclosed table key")
+	}
+	return firstKey(text, "["+text+"]")
+}
+
+// Reads the key of a key = value line, up to its value, and returns its first
+// key.
+func (s *lazyScanner) key() (string, error) {
+	start := s.i
+	if !s.skipKey('=') {
+		return "", errors.New("expected = after key")
+	}
+	text := string(s.b[start:s.i])
+	s.i++
+	return firstKey(text, text+"= 0")
+}
+
+// Skips the key at the current offset, up to the given terminator. It reports
+// false if the line ends before.
+func (s *lazyScanner) skipKey(terminator byte) bool {
+	for s.i < len(s.b) {
+		switch c := s.b[s.i]; c {
+		case terminator:
+			return true
+		case '\n':
+			return false
+		case '"', '\'':
+			s.skipString()
+		default:
+			s.i++
+		}
+	}
+	return false
+}
+
+// Returns the first key of the dotted key text, read from line with the lexer
+// if it may contain escape sequences.
+func firstKey(text string, line string) (string, error) {
+	if strings.IndexByte(text, '\\') >= 0 {
+		for _, tok := range lexToml([]byte(line)) {
+			if tok.typ == tokenError {
+				return "", errors.New(tok.val)
+			} else if tok.typ == tokenKey || tok.typ == tokenKeyGroup {
+				text = tok.val
+				break
+			}
+		}
+	}
+	keys, err := parseKey(text)
+	if err != nil {
+		return "", err
+	}
+	return keys[0], nil
+}
+
+// Skips the value at the current offset.
+func (s *lazyScanner) skipValue() {
+	s.skipSpace()
+	if s.i >= len(s.b) {
+		return
+	}
+	switch s.b[s.i] {
+	case '"', '\'':
+		s.skipString()
+	case '[', '{':
+		depth := 0
+		for s.i < len(s.b) {
+			switch s.b[s.i] {
+			case '[', '{':
+				depth++
+			case ']', '}':
+				depth--
+			case '"', '\'':
+				s.skipString()
+				continue
+			case '#':
+				s.skipLine()
+				continue
+			}
+			s.i++
+			if depth == 0 {
+				return
+			}
+		}
+	default:
+		for s.i < len(s.b) && s.b[s.i] != '\n' && s.b[s.i] != '#' {
+			s.i++
+		}
+	}
+}
+
+// Skips the string at the current offset, multi-line strings included.
+func (s *lazyScanner) skipString() {
+	quote := s.b[s.i]
+	delim := []byte{quote}
+	if bytes.HasPrefix(s.b[s.i:], []byte{quote, quote, quote}) {
+		delim = []byte{quote, quote, quote}
+	}
+	s.i += len(delim)
+	for s.i < len(s.b) {
+		switch {
+		case s.b[s.i] == '\\' && quote == '"':
+			s.i += 2
+		case bytes.HasPrefix(s.b[s.i:], delim):
+			s.i += len(delim)
+			// Multi-line strings may end with up to two quotes
+			for extra := 0; len(delim) == 3 && extra < 2 && s.i < len(s.b) && s.b[s.i] == quote; extra++ {
+				s.i++
+			}
+			return
+		case s.b[s.i] == '\n' && len(delim) == 1:
+			return
+		default:
+			s.i++
+		}
+	}
+	if s.i > len(s.b) {
+		s.i = len(s.b)
+	}
+}
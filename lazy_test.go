@@ -0,0 +1,124 @@
+package toml
+
+import (
+	"reflect"
+	"testing"
+)
+
+const lazyTestToml = `# inventory
+title = "inventory"
+owner.name = "Tom" # dotted key
+tags = [
+  "a", # first
+  "b]",
+]
+
+[hosts.alpha]
+ip = "10.0.0.1"
+notes = """
+[not.a.table]
+key = "not a key"
+"""
+
+[[racks]]
+name = 'r1'
+slots = { first = "}", count = 4 }
+
+[owner]
+dob = 1979-05-27T07:32:00Z
+
+[[racks]]
+name = 'r2'
+
+[hosts."beta.example"]
+ip = "10.0.0.2"
+`
+
+func TestLazyTree(t *testing.T) {
+	tree, err := Load(lazyTestToml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lazy, err := LoadLazy([]byte(lazyTestToml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := lazy.Keys(); !reflect.DeepEqual(keys, []string{"title", "owner", "tags", "hosts", "racks"}) {
+		t.Errorf("unexpected keys %v", keys)
+	}
+	for _, k := range lazy.index {
+		if k.loaded {
+			t.Fatal("key parsed by LoadLazy")
+		}
+	}
+
+	for _, key := range []string{"title", "tags", "owner.name", "owner.dob", "hosts.alpha.notes", "racks", "missing", "owner.missing"} {
+		if got, expected := lazy.Get(key), tree.Get(key); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Get(%q): expected %v, got %v", key, expected, got)
+		}
+		if got, expected := lazy.GetPosition(key), tree.GetPosition(key); got != expected {
+			t.Errorf("GetPosition(%q): expected %v, got %v", key, expected, got)
+		}
+		if got, expected := lazy.Has(key), tree.Has(key); got != expected {
+			t.Errorf("Has(%q): expected %v, got %v", key, expected, got)
+		}
+	}
+	path := []string{"hosts", "beta.example", "ip"}
+	if got := lazy.GetPath(path); got != "10.0.0.2" {
+		t.Errorf("GetPath(%q): got %v", path, got)
+	}
+	if got := lazy.GetArray("tags"); !reflect.DeepEqual(got, []string{"a", "b]"}) {
+		t.Errorf("GetArray: got %v", got)
+	}
+
+	whole, err := lazy.Tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if whole.String() != tree.String() {
+		t.Errorf("expected\n%s\ngot\n%s", tree.String(), whole.String())
+	}
+}
+
+func TestLazyTreeUnmarshal(t *testing.T) {
+	doc := lazyTestToml + "\n[broken]\nkey = \n"
+	_, loadErr := Load(doc)
+	lazy, err := LoadLazy([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v struct {
+		Title string `toml:"title"`
+		Racks []struct {
+			Name string `toml:"name"`
+		} `toml:"racks"`
+	}
+	if err := lazy.Unmarshal(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Title != "inventory" || len(v.Racks) != 2 || v.Racks[1].Name != "r2" {
+		t.Errorf("unexpected value %+v", v)
+	}
+	if lazy.index["hosts"].loaded {
+		t.Error("unused key parsed by Unmarshal")
+	}
+
+	if lazy.Get("broken.key") != nil {
+		t.Error("expected nil for a key failing to parse")
+	}
+	if _, err := lazy.Tree("broken"); err == nil || err.Error() != loadErr.Error() {
+		t.Errorf("expected error %v, got %v", loadErr, err)
+	}
+	if _, err := lazy.Tree("owner", "racks"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadLazyError(t *testing.T) {
+	_, err := LoadLazy([]byte("a = 1\n[b\nc = 2"))
+	if err == nil || err.Error() != "(2, 1): unclosed table key" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
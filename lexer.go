@@ -11,44 +11,48 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 // Define state functions
-type tomlLexStateFn func() tomlLexStateFn
+type tomlLexStateFn func(l *tomlLexer) tomlLexStateFn
 
 // Define lexer
 type tomlLexer struct {
 	inputIdx          int
-	input             []rune // Textual source
+	input             []byte // Textual source, in UTF-8
 	currentTokenStart int
 	currentTokenStop  int
 	tokens            []token
+	state             tomlLexStateFn
 	brackets          []rune
 	line              int
 	col               int
 	endbufferLine     int
 	endbufferCol      int
+	// Emits the comments ending the line of a value as tokenComment
+	trailingComments bool
 }
 
 // Basic read operations on input
 
-func (l *tomlLexer) read() rune {
-	r := l.peek()
+func (l *tomlLexer) read() (rune, int) {
+	r, size := l.peekRune()
 	if r == '\n' {
 		l.endbufferLine++
 		l.endbufferCol = 1
 	} else {
 		l.endbufferCol++
 	}
-	l.inputIdx++
-	return r
+	l.inputIdx += size
+	return r, size
 }
 
 func (l *tomlLexer) next() rune {
-	r := l.read()
+	r, size := l.read()
 
 	if r != eof {
-		l.currentTokenStop++
+		l.currentTokenStop += size
 	}
 	return r
 }
@@ -84,23 +88,47 @@ func (l *tomlLexer) emit(t tokenType) {
 }
 
 func (l *tomlLexer) peek() rune {
+	r, _ := l.peekRune()
+	return r
+}
+
+// Returns the next rune and its size in the input, which is 1 at its end.
+func (l *tomlLexer) peekRune() (rune, int) {
+	if l.inputIdx < len(l.input) && l.input[l.inputIdx] < utf8.RuneSelf {
+		return rune(l.input[l.inputIdx]), 1
+	}
+	return l.decodeRune()
+}
+
+func (l *tomlLexer) decodeRune() (rune, int) {
 	if l.inputIdx >= len(l.input) {
-		return eof
+		return eof, 1
 	}
-	return l.input[l.inputIdx]
+	return utf8.DecodeRune(l.input[l.inputIdx:])
 }
 
 func (l *tomlLexer) peekString(size int) string {
-	maxIdx := len(l.input)
-	upperIdx := l.inputIdx + size // FIXME: potential overflow
-	if upperIdx > maxIdx {
-		upperIdx = maxIdx
+	if l.inputIdx >= len(l.input) {
+		return ""
+	}
+	upperIdx := l.inputIdx
+	for i := 0; i < size && upperIdx < len(l.input); i++ {
+		_, n := utf8.DecodeRune(l.input[upperIdx:])
+		upperIdx += n
 	}
 	return string(l.input[l.inputIdx:upperIdx])
 }
 
 func (l *tomlLexer) follow(next string) bool {
-	return next == l.peekString(len(next))
+	if len(l.input)-l.inputIdx < len(next) {
+		return false
+	}
+	for i := 0; i < len(next); i++ {
+		if l.input[l.inputIdx+i] != next[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // Error management
@@ -121,13 +149,13 @@ func (l *tomlLexer) lexVoid() tomlLexStateFn {
 		next := l.peek()
 		switch next {
 		case '}': // after '{'
-			return l.lexRightCurlyBrace
+			return (*tomlLexer).lexRightCurlyBrace
 		case '[':
-			return l.lexTableKey
+			return (*tomlLexer).lexTableKey
 		case '#':
-			return l.lexComment(l.lexVoid)
+			return l.lexComment((*tomlLexer).lexVoid)
 		case '=':
-			return l.lexEqual
+			return (*tomlLexer).lexEqual
 		case '\r':
 			fallthrough
 		case '\n':
@@ -140,7 +168,7 @@ func (l *tomlLexer) lexVoid() tomlLexStateFn {
 		}
 
 		if isKeyStartChar(next) {
-			return l.lexKey
+			return (*tomlLexer).lexKey
 		}
 
 		if next == eof {
@@ -160,47 +188,50 @@ func (l *tomlLexer) lexRvalue() tomlLexStateFn {
 		case '.':
 			return l.errorf("cannot start float with a dot")
 		case '=':
-			return l.lexEqual
+			return (*tomlLexer).lexEqual
 		case '[':
-			return l.lexLeftBracket
+			return (*tomlLexer).lexLeftBracket
 		case ']':
-			return l.lexRightBracket
+			return (*tomlLexer).lexRightBracket
 		case '{':
-			return l.lexLeftCurlyBrace
+			return (*tomlLexer).lexLeftCurlyBrace
 		case '}':
-			return l.lexRightCurlyBrace
+			return (*tomlLexer).lexRightCurlyBrace
 		case '#':
-			return l.lexComment(l.lexRvalue)
+			if l.trailingComments && len(l.brackets) == 0 && len(l.tokens) > 0 && l.tokens[len(l.tokens)-1].typ != tokenEqual {
+				return (*tomlLexer).lexTrailingComment
+			}
+			return l.lexComment((*tomlLexer).lexRvalue)
 		case '"':
-			return l.lexString
+			return (*tomlLexer).lexString
 		case '\'':
-			return l.lexLiteralString
+			return (*tomlLexer).lexLiteralString
 		case ',':
-			return l.lexComma
+			return (*tomlLexer).lexComma
 		case '\r':
 			fallthrough
 		case '\n':
 			l.skip()
 			if len(l.brackets) > 0 && l.brackets[len(l.brackets)-1] == '[' {
-				return l.lexRvalue
+				return (*tomlLexer).lexRvalue
 			}
-			return l.lexVoid
+			return (*tomlLexer).lexVoid
 		}
 
 		if l.follow("true") {
-			return l.lexTrue
+			return (*tomlLexer).lexTrue
 		}
 
 		if l.follow("false") {
-			return l.lexFalse
+			return (*tomlLexer).lexFalse
 		}
 
 		if l.follow("inf") {
-			return l.lexInf
+			return (*tomlLexer).lexInf
 		}
 
 		if l.follow("nan") {
-			return l.lexNan
+			return (*tomlLexer).lexNan
 		}
 
 		if isSpace(next) {
@@ -214,11 +245,11 @@ func (l *tomlLexer) lexRvalue() tomlLexStateFn {
 		}
 
 		if next == '+' || next == '-' {
-			return l.lexNumber
+			return (*tomlLexer).lexNumber
 		}
 
 		if isDigit(next) {
-			return l.lexDateTimeOrNumber
+			return (*tomlLexer).lexDateTimeOrNumber
 		}
 
 		return l.errorf("no value can start with %c", next)
@@ -256,19 +287,19 @@ func (l *tomlLexer) lexDateTimeOrNumber() tomlLexStateFn {
 
 func (l *tomlLexer) lexLeftCurlyBrace() tomlLexStateFn {
 	l.next()
-	l.emit(tokenLeftCurlyBrace)
+	l.emitWithValue(tokenLeftCurlyBrace, "{")
 	l.brackets = append(l.brackets, '{')
-	return l.lexVoid
+	return (*tomlLexer).lexVoid
 }
 
 func (l *tomlLexer) lexRightCurlyBrace() tomlLexStateFn {
 	l.next()
-	l.emit(tokenRightCurlyBrace)
+	l.emitWithValue(tokenRightCurlyBrace, "}")
 	if len(l.brackets) == 0 || l.brackets[len(l.brackets)-1] != '{' {
 		return l.errorf("cannot have '}' here")
 	}
 	l.brackets = l.brackets[:len(l.brackets)-1]
-	return l.lexRvalue
+	return (*tomlLexer).lexRvalue
 }
 
 func (l *tomlLexer) lexDateTimeOrTime() tomlLexStateFn {
@@ -348,7 +379,7 @@ func (l *tomlLexer) lexDateTime() tomlLexStateFn {
 
 	if r == eof {
 
-		return l.lexRvalue
+		return (*tomlLexer).lexRvalue
 	}
 
 	if r != ' ' && r != 'T' {
@@ -358,11 +389,11 @@ func (l *tomlLexer) lexDateTime() tomlLexStateFn {
 	if r == ' ' {
 		lookAhead := l.peekString(3)[1:]
 		if len(lookAhead) < 2 {
-			return l.lexRvalue
+			return (*tomlLexer).lexRvalue
 		}
 		for _, r := range lookAhead {
 			if !isDigit(r) {
-				return l.lexRvalue
+				return (*tomlLexer).lexRvalue
 			}
 		}
 	}
@@ -421,7 +452,7 @@ func (l *tomlLexer) lexDateTime() tomlLexStateFn {
 
 	l.emit(tokenLocalTime)
 
-	return l.lexTimeOffset
+	return (*tomlLexer).lexTimeOffset
 
 }
 
@@ -463,7 +494,7 @@ func (l *tomlLexer) lexTimeOffset() tomlLexStateFn {
 		l.emit(tokenTimeOffset)
 	}
 
-	return l.lexRvalue
+	return (*tomlLexer).lexRvalue
 }
 
 func (l *tomlLexer) lexTime() tomlLexStateFn {
@@ -508,53 +539,55 @@ func (l *tomlLexer) lexTime() tomlLexStateFn {
 	}
 
 	l.emit(tokenLocalTime)
-	return l.lexRvalue
+	return (*tomlLexer).lexRvalue
 
 }
 
 func (l *tomlLexer) lexTrue() tomlLexStateFn {
 	l.fastForward(4)
-	l.emit(tokenTrue)
-	return l.lexRvalue
+	l.emitWithValue(tokenTrue, "true")
+	return (*tomlLexer).lexRvalue
 }
 
 func (l *tomlLexer) lexFalse() tomlLexStateFn {
 	l.fastForward(5)
-	l.emit(tokenFalse)
-	return l.lexRvalue
+	l.emitWithValue(tokenFalse, "false")
+	return (*tomlLexer).lexRvalue
 }
 
 func (l *tomlLexer) lexInf() tomlLexStateFn {
 	l.fastForward(3)
 	l.emit(tokenInf)
-	return l.lexRvalue
+	return (*tomlLexer).lexRvalue
 }
 
 func (l *tomlLexer) lexNan() tomlLexStateFn {
 	l.fastForward(3)
 	l.emit(tokenNan)
-	return l.lexRvalue
+	return (*tomlLexer).lexRvalue
 }
 
 func (l *tomlLexer) lexEqual() tomlLexStateFn {
 	l.next()
-	l.emit(tokenEqual)
-	return l.lexRvalue
+	l.emitWithValue(tokenEqual, "=")
+	return (*tomlLexer).lexRvalue
 }
 
 func (l *tomlLexer) lexComma() tomlLexStateFn {
 	l.next()
-	l.emit(tokenComma)
+	l.emitWithValue(tokenComma, ",")
 	if len(l.brackets) > 0 && l.brackets[len(l.brackets)-1] == '{' {
-		return l.lexVoid
+		return (*tomlLexer).lexVoid
 	}
-	return l.lexRvalue
+	return (*tomlLexer).lexRvalue
 }
 
 // Parse the key and emits its value without escape sequences.
 // bare keys, basic string keys and literal string keys are supported.
 func (l *tomlLexer) lexKey() tomlLexStateFn {
 	var sb strings.Builder
+	// Enough for most keys to be built without growing
+	sb.Grow(32)
 
 	for r := l.peek(); isKeyChar(r) || r == '\n' || r == '\r'; r = l.peek() {
 		if r == '"' {
@@ -582,63 +615,77 @@ func (l *tomlLexer) lexKey() tomlLexStateFn {
 		} else if r == '\n' {
 			return l.errorf("keys cannot contain new lines")
 		} else if isSpace(r) {
-			var str strings.Builder
-			str.WriteString(" ")
-
 			// skip trailing whitespace
 			l.next()
+			spaces := l.inputIdx
 			for r = l.peek(); isSpace(r); r = l.peek() {
-				str.WriteRune(r)
 				l.next()
 			}
 			// break loop if not a dot
 			if r != '.' {
 				break
 			}
-			str.WriteString(".")
+			sb.WriteString(" ")
+			sb.WriteString(string(l.input[spaces:l.inputIdx]))
+			sb.WriteString(".")
 			// skip trailing whitespace after dot
 			l.next()
+			spaces = l.inputIdx
 			for r = l.peek(); isSpace(r); r = l.peek() {
-				str.WriteRune(r)
 				l.next()
 			}
-			sb.WriteString(str.String())
+			sb.WriteString(string(l.input[spaces:l.inputIdx]))
 			continue
-		} else if r == '.' {
-			// skip
-		} else if !isValidBareChar(r) {
+		} else if r != '.' && !isValidBareChar(r) {
 			return l.errorf("keys cannot contain %c character", r)
 		}
-		sb.WriteRune(r)
-		l.next()
+		// Bare characters and dots are copied by runs
+		start := l.inputIdx
+		for ; r == '.' || isValidBareChar(r); r = l.peek() {
+			l.next()
+		}
+		sb.Write(l.input[start:l.inputIdx])
 	}
 	l.emitWithValue(tokenKey, sb.String())
-	return l.lexVoid
+	return (*tomlLexer).lexVoid
 }
 
 func (l *tomlLexer) lexComment(previousState tomlLexStateFn) tomlLexStateFn {
-	return func() tomlLexStateFn {
-		for next := l.peek(); next != '\n' && next != eof; next = l.peek() {
-			if next == '\r' && l.follow("\r\n") {
-				break
-			}
-			l.next()
+	// The comment ends before the end of the line, "\n" or "\r\n"
+	end := len(l.input)
+	if i := bytes.IndexByte(l.input[l.inputIdx:], '\n'); i >= 0 {
+		end = l.inputIdx + i
+		if i > 0 && l.input[end-1] == '\r' {
+			end--
 		}
-		l.ignore()
-		return previousState
 	}
+	l.endbufferCol += utf8.RuneCount(l.input[l.inputIdx:end])
+	l.currentTokenStop += end - l.inputIdx
+	l.inputIdx = end
+	l.ignore()
+	return previousState
+}
+
+// Emits the comment ending the line of a value, "#" included.
+func (l *tomlLexer) lexTrailingComment() tomlLexStateFn {
+	start, position := l.inputIdx, Position{l.line, l.col}
+	l.lexComment(nil)
+	l.tokens = append(l.tokens, token{
+		Position: position,
+		typ:      tokenComment,
+		val:      strings.TrimRight(string(l.input[start:l.inputIdx]), " \t"),
+	})
+	return (*tomlLexer).lexRvalue
 }
 
 func (l *tomlLexer) lexLeftBracket() tomlLexStateFn {
 	l.next()
-	l.emit(tokenLeftBracket)
+	l.emitWithValue(tokenLeftBracket, "[")
 	l.brackets = append(l.brackets, '[')
-	return l.lexRvalue
+	return (*tomlLexer).lexRvalue
 }
 
 func (l *tomlLexer) lexLiteralStringAsString(terminator string, discardLeadingNewLine bool) (string, error) {
-	var sb strings.Builder
-
 	if discardLeadingNewLine {
 		if l.follow("\r\n") {
 			l.skip()
@@ -649,16 +696,17 @@ func (l *tomlLexer) lexLiteralStringAsString(terminator string, discardLeadingNe
 	}
 
 	// find end of string
+	start := l.inputIdx
 	for {
 		if l.follow(terminator) {
-			return sb.String(), nil
+			return string(l.input[start:l.inputIdx]), nil
 		}
 
 		next := l.peek()
 		if next == eof {
 			break
 		}
-		sb.WriteRune(l.next())
+		l.next()
 	}
 
 	return "", errors.New("unclosed string")
@@ -682,10 +730,10 @@ func (l *tomlLexer) lexLiteralString() tomlLexStateFn {
 		return l.errorf(err.Error())
 	}
 
-	l.emitWithValue(tokenString, str)
+	l.emitWithValue(tokenLiteralString, str)
 	l.fastForward(len(terminator))
 	l.ignore()
-	return l.lexRvalue
+	return (*tomlLexer).lexRvalue
 }
 
 // Lex a string and return the results as a string.
@@ -703,12 +751,21 @@ func (l *tomlLexer) lexStringAsString(terminator string, discardLeadingNewLine,
 		}
 	}
 
+	// Strings without escape sequences are copied from the input at once
+	start, escaped := l.inputIdx, false
 	for {
 		if l.follow(terminator) {
+			if !escaped {
+				return string(l.input[start:l.inputIdx]), nil
+			}
 			return sb.String(), nil
 		}
 
 		if l.follow("\\") {
+			if !escaped {
+				sb.WriteString(string(l.input[start:l.inputIdx]))
+				escaped = true
+			}
 			l.next()
 			switch l.peek() {
 			case '\r':
@@ -788,7 +845,9 @@ func (l *tomlLexer) lexStringAsString(terminator string, discardLeadingNewLine,
 				return "", fmt.Errorf("unescaped control character %U", r)
 			}
 			l.next()
-			sb.WriteRune(r)
+			if escaped {
+				sb.WriteRune(r)
+			}
 		}
 
 		if l.peek() == eof {
@@ -822,7 +881,7 @@ func (l *tomlLexer) lexString() tomlLexStateFn {
 	l.emitWithValue(tokenString, str)
 	l.fastForward(len(terminator))
 	l.ignore()
-	return l.lexRvalue
+	return (*tomlLexer).lexRvalue
 }
 
 func (l *tomlLexer) lexTableKey() tomlLexStateFn {
@@ -831,12 +890,12 @@ func (l *tomlLexer) lexTableKey() tomlLexStateFn {
 	if l.peek() == '[' {
 		// token '[[' signifies an array of tables
 		l.next()
-		l.emit(tokenDoubleLeftBracket)
-		return l.lexInsideTableArrayKey
+		l.emitWithValue(tokenDoubleLeftBracket, "[[")
+		return (*tomlLexer).lexInsideTableArrayKey
 	}
 	// vanilla table key
-	l.emit(tokenLeftBracket)
-	return l.lexInsideTableKey
+	l.emitWithValue(tokenLeftBracket, "[")
+	return (*tomlLexer).lexInsideTableKey
 }
 
 // Parse the key till "]]", but only bare keys are supported
@@ -853,7 +912,7 @@ func (l *tomlLexer) lexInsideTableArrayKey() tomlLexStateFn {
 			}
 			l.next()
 			l.emit(tokenDoubleRightBracket)
-			return l.lexVoid
+			return (*tomlLexer).lexVoid
 		case '[':
 			return l.errorf("table array key cannot contain ']'")
 		default:
@@ -873,7 +932,7 @@ func (l *tomlLexer) lexInsideTableKey() tomlLexStateFn {
 			}
 			l.next()
 			l.emit(tokenRightBracket)
-			return l.lexVoid
+			return (*tomlLexer).lexVoid
 		case '[':
 			return l.errorf("table key cannot contain ']'")
 		default:
@@ -885,12 +944,12 @@ func (l *tomlLexer) lexInsideTableKey() tomlLexStateFn {
 
 func (l *tomlLexer) lexRightBracket() tomlLexStateFn {
 	l.next()
-	l.emit(tokenRightBracket)
+	l.emitWithValue(tokenRightBracket, "]")
 	if len(l.brackets) == 0 || l.brackets[len(l.brackets)-1] != '[' {
 		return l.errorf("cannot have ']' here")
 	}
 	l.brackets = l.brackets[:len(l.brackets)-1]
-	return l.lexRvalue
+	return (*tomlLexer).lexRvalue
 }
 
 type validRuneFn func(r rune) bool
@@ -949,7 +1008,7 @@ func (l *tomlLexer) lexNumber() tomlLexStateFn {
 
 				l.emit(tokenInteger)
 
-				return l.lexRvalue
+				return (*tomlLexer).lexRvalue
 			}
 		}
 	}
@@ -957,10 +1016,10 @@ func (l *tomlLexer) lexNumber() tomlLexStateFn {
 	if r == '+' || r == '-' {
 		l.next()
 		if l.follow("inf") {
-			return l.lexInf
+			return (*tomlLexer).lexInf
 		}
 		if l.follow("nan") {
-			return l.lexNan
+			return (*tomlLexer).lexNan
 		}
 	}
 
@@ -1006,26 +1065,51 @@ func (l *tomlLexer) lexNumber() tomlLexStateFn {
 	} else {
 		l.emit(tokenInteger)
 	}
-	return l.lexRvalue
+	return (*tomlLexer).lexRvalue
 }
 
 func (l *tomlLexer) run() {
-	for state := l.lexVoid; state != nil; {
-		state = state()
+	for l.state != nil {
+		l.state = l.state(l)
 	}
 }
 
-// Entry point
-func lexToml(inputBytes []byte) []token {
-	runes := bytes.Runes(inputBytes)
-	l := &tomlLexer{
-		input:         runes,
-		tokens:        make([]token, 0, 256),
+// Number of tokens of the chunks of nextTokens.
+const tokenChunkSize = 64
+
+// Lexes the input until tokens are emitted or the input ends, and returns the
+// tokens emitted. Tokens are emitted in chunks of tokenChunkSize, so that the
+// tokens returned before are neither overwritten nor kept alive by the lexer.
+func (l *tomlLexer) nextTokens() []token {
+	if len(l.tokens) == cap(l.tokens) {
+		l.tokens = make([]token, 0, tokenChunkSize)
+	}
+	start := len(l.tokens)
+	for l.state != nil && len(l.tokens) == start {
+		l.state = l.state(l)
+	}
+	return l.tokens[start:]
+}
+
+func newTomlLexer(inputBytes []byte) *tomlLexer {
+	if !utf8.Valid(inputBytes) {
+		// Each invalid byte is read as utf8.RuneError
+		inputBytes = []byte(string(bytes.Runes(inputBytes)))
+	}
+	return &tomlLexer{
+		input:         inputBytes,
+		state:         (*tomlLexer).lexVoid,
 		line:          1,
 		col:           1,
 		endbufferLine: 1,
 		endbufferCol:  1,
 	}
+}
+
+// Entry point
+func lexToml(inputBytes []byte) []token {
+	l := newTomlLexer(inputBytes)
+	l.tokens = make([]token, 0, 256)
 	l.run()
 	return l.tokens
 }
@@ -843,6 +843,18 @@ func TestKeyEqualStringUnicodeEscape(t *testing.T) {
 	})
 }
 
+func TestInvalidUTF8(t *testing.T) {
+	testFlow(t, "a = \"\xffb\" # \xfe\nc = 'd'", []token{
+		{Position{1, 1}, tokenKey, "a"},
+		{Position{1, 3}, tokenEqual, "="},
+		{Position{1, 6}, tokenString, "\uFFFDb"},
+		{Position{2, 1}, tokenKey, "c"},
+		{Position{2, 3}, tokenEqual, "="},
+		{Position{2, 6}, tokenLiteralString, "d"},
+		{Position{2, 8}, tokenEOF, ""},
+	})
+}
+
 func TestKeyEqualStringNoEscape(t *testing.T) {
 	testFlow(t, "foo = \"hello \u0002\"", []token{
 		{Position{1, 1}, tokenKey, "foo"},
@@ -860,25 +872,25 @@ func TestLiteralString(t *testing.T) {
 	testFlow(t, `foo = 'C:\Users\nodejs\templates'`, []token{
 		{Position{1, 1}, tokenKey, "foo"},
 		{Position{1, 5}, tokenEqual, "="},
-		{Position{1, 8}, tokenString, `C:\Users\nodejs\templates`},
+		{Position{1, 8}, tokenLiteralString, `C:\Users\nodejs\templates`},
 		{Position{1, 34}, tokenEOF, ""},
 	})
 	testFlow(t, `foo = '\\ServerX\admin$\system32\'`, []token{
 		{Position{1, 1}, tokenKey, "foo"},
 		{Position{1, 5}, tokenEqual, "="},
-		{Position{1, 8}, tokenString, `\\ServerX\admin$\system32\`},
+		{Position{1, 8}, tokenLiteralString, `\\ServerX\admin$\system32\`},
 		{Position{1, 35}, tokenEOF, ""},
 	})
 	testFlow(t, `foo = 'Tom "Dubs" Preston-Werner'`, []token{
 		{Position{1, 1}, tokenKey, "foo"},
 		{Position{1, 5}, tokenEqual, "="},
-		{Position{1, 8}, tokenString, `Tom "Dubs" Preston-Werner`},
+		{Position{1, 8}, tokenLiteralString, `Tom "Dubs" Preston-Werner`},
 		{Position{1, 34}, tokenEOF, ""},
 	})
 	testFlow(t, `foo = '<\i\c*\s*>'`, []token{
 		{Position{1, 1}, tokenKey, "foo"},
 		{Position{1, 5}, tokenEqual, "="},
-		{Position{1, 8}, tokenString, `<\i\c*\s*>`},
+		{Position{1, 8}, tokenLiteralString, `<\i\c*\s*>`},
 		{Position{1, 19}, tokenEOF, ""},
 	})
 	testFlow(t, `foo = 'C:\Users\nodejs\unfinis`, []token{
@@ -892,20 +904,20 @@ func TestMultilineLiteralString(t *testing.T) {
 	testFlow(t, `foo = '''hello 'literal' world'''`, []token{
 		{Position{1, 1}, tokenKey, "foo"},
 		{Position{1, 5}, tokenEqual, "="},
-		{Position{1, 10}, tokenString, `hello 'literal' world`},
+		{Position{1, 10}, tokenLiteralString, `hello 'literal' world`},
 		{Position{1, 34}, tokenEOF, ""},
 	})
 
 	testFlow(t, "foo = '''\nhello\n'literal'\nworld'''", []token{
 		{Position{1, 1}, tokenKey, "foo"},
 		{Position{1, 5}, tokenEqual, "="},
-		{Position{2, 1}, tokenString, "hello\n'literal'\nworld"},
+		{Position{2, 1}, tokenLiteralString, "hello\n'literal'\nworld"},
 		{Position{4, 9}, tokenEOF, ""},
 	})
 	testFlow(t, "foo = '''\r\nhello\r\n'literal'\r\nworld'''", []token{
 		{Position{1, 1}, tokenKey, "foo"},
 		{Position{1, 5}, tokenEqual, "="},
-		{Position{2, 1}, tokenString, "hello\r\n'literal'\r\nworld"},
+		{Position{2, 1}, tokenLiteralString, "hello\r\n'literal'\r\nworld"},
 		{Position{4, 9}, tokenEOF, ""},
 	})
 }
@@ -1,12 +1,16 @@
 package toml
 
 import (
+	"bufio"
 	"bytes"
 	"encoding"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -20,6 +24,8 @@ const (
 	tagMultiline    = "multiline"
 	tagLiteral      = "literal"
 	tagDefault      = "default"
+	tagEnv          = "env"
+	tagWidth        = "width"
 )
 
 type tomlOpts struct {
@@ -32,6 +38,10 @@ type tomlOpts struct {
 	include      bool
 	omitempty    bool
 	defaultValue string
+	env          string
+	required     bool
+	inline       bool
+	maxWidth     int
 }
 
 type encOpts struct {
@@ -72,11 +82,27 @@ const (
 	OrderPreserve
 )
 
+// TableStyle is the way the Encoder writes the sub-tables of the document.
+type TableStyle int
+
+// Styles the Encoder can write sub-tables with.
+const (
+	// Write every table with a [table] header.
+	TableHeaders TableStyle = iota
+	// Write every table as dotted keys, such as physical.color = "orange".
+	TableDottedKeys
+	// Write the tables with headers down to a depth, and the deeper ones as
+	// dotted keys under their parent.
+	TableMixed
+)
+
 var timeType = reflect.TypeOf(time.Time{})
 var marshalerType = reflect.TypeOf(new(Marshaler)).Elem()
 var unmarshalerType = reflect.TypeOf(new(Unmarshaler)).Elem()
+var valueUnmarshalerType = reflect.TypeOf(new(ValueUnmarshaler)).Elem()
 var textMarshalerType = reflect.TypeOf(new(encoding.TextMarshaler)).Elem()
 var textUnmarshalerType = reflect.TypeOf(new(encoding.TextUnmarshaler)).Elem()
+var defaulterType = reflect.TypeOf(new(Defaulter)).Elem()
 var localDateType = reflect.TypeOf(LocalDate{})
 var localTimeType = reflect.TypeOf(LocalTime{})
 var localDateTimeType = reflect.TypeOf(LocalDateTime{})
@@ -132,6 +158,20 @@ func isCustomMarshalerSequence(mtype reflect.Type) bool {
 	}
 }
 
+// Check if the given marshal type maps to a slice or array of a custom or value unmarshaler type
+func isCustomUnmarshalerSequence(mtype reflect.Type) bool {
+	switch mtype.Kind() {
+	case reflect.Ptr:
+		return isCustomUnmarshalerSequence(mtype.Elem())
+	case reflect.Slice, reflect.Array:
+		ptype := reflect.New(mtype.Elem()).Type()
+		return isCustomUnmarshaler(mtype.Elem()) || isCustomUnmarshaler(ptype) ||
+			isValueUnmarshaler(mtype.Elem()) || isValueUnmarshaler(ptype)
+	default:
+		return false
+	}
+}
+
 // Check if the given marshal type maps to a slice or array of a text marshaler type
 func isTextMarshalerSequence(mtype reflect.Type) bool {
 	switch mtype.Kind() {
@@ -194,6 +234,42 @@ func callCustomUnmarshaler(mval reflect.Value, tval interface{}) error {
 	return mval.Interface().(Unmarshaler).UnmarshalTOML(tval)
 }
 
+// Converts a value of a tree to the plain Go value given to UnmarshalTOML:
+// tables are maps, and arrays of tables are slices of maps.
+func tomlToGo(tval interface{}) interface{} {
+	switch node := tval.(type) {
+	case *Tree:
+		return node.ToMap()
+	case []*Tree:
+		array := make([]interface{}, len(node))
+		for i, item := range node {
+			array[i] = item.ToMap()
+		}
+		return array
+	default:
+		return tomlValueToGo(node)
+	}
+}
+
+func isValueUnmarshaler(mtype reflect.Type) bool {
+	return mtype.Implements(valueUnmarshalerType)
+}
+
+func (d *Decoder) callValueUnmarshaler(mval reflect.Value, tval interface{}) error {
+	node := tval
+	switch tval.(type) {
+	case *Tree, []*Tree:
+	default:
+		node = &PubTOMLValue{value: tval, position: d.pos.Position}
+	}
+	ctx := DecodeContext{
+		decoder: d,
+		path:    append(KeyPath(nil), d.path...),
+		pos:     d.pos,
+	}
+	return mval.Interface().(ValueUnmarshaler).UnmarshalTOMLValue(node, ctx)
+}
+
 func isTextUnmarshaler(mtype reflect.Type) bool {
 	return mtype.Implements(textUnmarshalerType)
 }
@@ -204,21 +280,118 @@ func callTextUnmarshaler(mval reflect.Value, text []byte) error {
 
 // Marshaler is the interface implemented by types that
 // can marshal themselves into valid TOML.
+//
+// When the value is not the top-level one, MarshalTOML returns either a
+// value literal (e.g. "42", `"text"` or "[1, 2]"), or a document, which becomes
+// a table. A sequence of values returning documents becomes an array of tables.
 type Marshaler interface {
 	MarshalTOML() ([]byte, error)
 }
 
 // Unmarshaler is the interface implemented by types that
 // can unmarshal a TOML description of themselves.
+//
+// UnmarshalTOML is called wherever the type appears, with the plain Go value
+// of the TOML element: a primitive value, a []interface{} for arrays, a
+// map[string]interface{} for tables, and a []interface{} of maps for arrays of
+// tables.
 type Unmarshaler interface {
 	UnmarshalTOML(interface{}) error
 }
 
+// Defaulter is the interface implemented by structs that set their own
+// default values.
+//
+// SetDefaults is called before a table is decoded into the struct, so the
+// fields of the keys missing from the document keep the values it sets,
+// unless they have a default tag.
+type Defaulter interface {
+	SetDefaults()
+}
+
+// ValueUnmarshaler is the interface implemented by types that can unmarshal a
+// TOML description of themselves, knowing where it is in the document.
+//
+// UnmarshalTOMLValue is called wherever the type appears, and takes precedence
+// over UnmarshalTOML. The node is the element of the document: a *Tree for
+// tables, a []*Tree for arrays of tables, and a *PubTOMLValue for other
+// values.
+type ValueUnmarshaler interface {
+	UnmarshalTOMLValue(node interface{}, ctx DecodeContext) error
+}
+
+// KeyPath is the path of keys leading to an element of a document. Elements of
+// arrays are designated by their index.
+type KeyPath []string
+
+// String returns the path as a dotted key, quoting keys when needed.
+func (p KeyPath) String() string {
+	keys := make([]string, len(p))
+	for i, k := range p {
+		keys[i] = quoteKeyIfNeeded(k)
+	}
+	return strings.Join(keys, ".")
+}
+
+// DecodeContext describes the element of a document given to a
+// ValueUnmarshaler.
+type DecodeContext struct {
+	decoder *Decoder
+	path    KeyPath
+	pos     Source
+}
+
+// Path returns the path of the element in the document.
+func (c DecodeContext) Path() KeyPath {
+	return c.path
+}
+
+// Position returns the position of the element in the document. Elements of
+// arrays of values have the position of the array.
+func (c DecodeContext) Position() Position {
+	return c.pos.Position
+}
+
+// Source returns the position of the element and the file it was read from.
+func (c DecodeContext) Source() Source {
+	return c.pos
+}
+
+// Decode decodes the node, or any node within it, into the value pointed to by
+// v, with the options of the Decoder.
+func (c DecodeContext) Decode(node interface{}, v interface{}) error {
+	mval := reflect.ValueOf(v)
+	if mval.Kind() != reflect.Ptr || mval.IsNil() {
+		return errors.New("only a non-nil pointer can be decoded into")
+	}
+	if tv, ok := node.(*PubTOMLValue); ok {
+		node = tv.value
+	}
+
+	d := c.decoder
+	prevPath, prevPos := d.path, d.pos
+	d.path, d.pos = c.path, c.pos
+	elem := mval.Elem()
+	val, err := d.valueFromToml(elem.Type(), node, &elem)
+	d.path, d.pos = prevPath, prevPos
+	if err != nil {
+		return formatError(err, c.pos)
+	}
+	elem.Set(val)
+	return nil
+}
+
+// Errorf returns an error located at the position of the element.
+func (c DecodeContext) Errorf(format string, args ...interface{}) error {
+	return &positionError{pos: c.pos, err: fmt.Errorf(format, args...)}
+}
+
 /*
 Marshal returns the TOML encoding of v.  Behavior is similar to the Go json
-encoder, except that there is no concept of a Marshaler interface or MarshalTOML
-function for sub-structs, and currently only definite types can be marshaled
-(i.e. no `interface{}`).
+encoder, and values implementing the Marshaler interface are encoded with their
+MarshalTOML method at any depth. Functions registered with RegisterEncoder take
+precedence over both. Currently only definite types can be marshaled (i.e. no
+`interface{}`).
 
 The following struct annotations are supported:
 
@@ -226,6 +399,10 @@ The following struct annotations are supported:
   omitempty         When set, empty values and groups are not emitted.
   comment:"comment" Emits a # comment on the same line. This supports new lines.
   commented:"true"  Emits the value as commented.
+  inline            Emits a table or an array of tables inline, such as
+                    toml:"point,inline" for point = { x = 1, y = 2 }.
+  width:"40"        Wraps the arrays of the value longer than 40 characters, see
+                    Encoder.MaxLineWidth.
 
 Note that pointers are automatically assigned the "omitempty" option, as TOML
 explicitly does not handle null values (saying instead the label should be
@@ -264,33 +441,61 @@ type Encoder struct {
 	promoteAnon     bool
 	compactComments bool
 	indentation     string
+	encoders        map[reflect.Type]EncodeFunc
+	commentDefaults bool
+	fieldNamer      FieldNamer
+	inlineMaxKeys   int
+	tableStyle      TableStyle
+	tableDepth      int
+	maxWidth        int
+	alignEquals     bool
+	alignComments   bool
+	format          FormatOptions
+	streamTables    bool
 }
 
 // NewEncoder returns a new encoder that writes to w.
 func NewEncoder(w io.Writer) *Encoder {
 	return &Encoder{
-		w:           w,
-		encOpts:     encOptsDefaults,
-		annotation:  annotationDefault,
-		line:        0,
-		col:         1,
-		order:       OrderAlphabetical,
-		indentation: "  ",
+		w:             w,
+		encOpts:       encOptsDefaults,
+		annotation:    annotationDefault,
+		line:          0,
+		col:           1,
+		order:         OrderAlphabetical,
+		indentation:   "  ",
+		inlineMaxKeys: -1,
+		format:        DefaultFormatOptions(),
 	}
 }
 
 // Encode writes the TOML encoding of v to the stream.
 //
+// Only the arrays of tables are streamed: their tables are encoded and written
+// one at a time, so that a large array of tables is not held in memory. The
+// rest of the document, tables and values included, is converted to a tree
+// before it is written, as are the arrays of tables written inline, because of
+// the inline tag or InlineTables, and the ones encoded by a function
+// registered for their type. The output is the same as the one of Marshal with
+// the same options.
+//
+// When an error occurs, the tables encoded before it have already been
+// written: the stream then holds a well-formed document, truncated before the
+// table that failed.
+//
 // See the documentation for Marshal for details.
 func (e *Encoder) Encode(v interface{}) error {
-	b, err := e.marshal(v)
-	if err != nil {
-		return err
-	}
-	if _, err := e.w.Write(b); err != nil {
-		return err
+	e.streamTables = true
+	defer func() {
+		e.streamTables = false
+	}()
+
+	w := bufio.NewWriter(e.w)
+	err := e.encode(w, v)
+	if errf := w.Flush(); err == nil {
+		err = errf
 	}
-	return nil
+	return err
 }
 
 // QuoteMapKeys sets up the encoder to encode
@@ -376,48 +581,172 @@ func (e *Encoder) CompactComments(cc bool) *Encoder {
 	return e
 }
 
+// InlineTables writes the tables that have at most maxKeys keys, all of them
+// set to values other than arrays and tables, as inline tables. Arrays of
+// such tables are written as arrays of inline tables. A negative maxKeys, the
+// default, disables it.
+//
+// For example, with a maxKeys of 2:
+//
+//   point = { x = 1, y = 2 }
+func (e *Encoder) InlineTables(maxKeys int) *Encoder {
+	e.inlineMaxKeys = maxKeys
+	return e
+}
+
+// TableStyle sets the way sub-tables are written. With TableMixed, the tables
+// nested at most depth levels deep are written with headers, and the deeper
+// ones as dotted keys. The depth is ignored by the other styles. Arrays of
+// tables are always written with headers, unless they are inline.
+//
+// For example, with TableMixed and a depth of 1:
+//
+//   [fruit]
+//     name = "apple"
+//     physical.color = "red"
+//     physical.shape = "round"
+func (e *Encoder) TableStyle(style TableStyle, depth int) *Encoder {
+	e.tableStyle = style
+	e.tableDepth = depth
+	return e
+}
+
+// MaxLineWidth sets the width of the lines beyond which arrays are written
+// with one element per line, with trailing commas. The elements are wrapped
+// the same way when they are arrays too long for their own line. Inline tables
+// too long for their line are written as standard tables, since they cannot
+// span several lines. The width can be set for a field with the width tag,
+// such as width:"40", a width of 0 keeping its value on one line. A width of 0,
+// the default, disables it.
+//
+// ArraysWithOneElementPerLine takes precedence over it.
+func (e *Encoder) MaxLineWidth(width int) *Encoder {
+	e.maxWidth = width
+	return e
+}
+
+// AlignEquals sets whether the equal signs of consecutive key/value lines are
+// written in the same column. The lines are aligned in blocks, which comments
+// and tables interrupt.
+//
+// For example:
+//
+//   name    = "apple"
+//   color   = "red"
+//   weights = [1, 2]
+func (e *Encoder) AlignEquals(align bool) *Encoder {
+	e.alignEquals = align
+	return e
+}
+
+// AlignComments sets whether the trailing comments of key/value lines, read
+// from the document or set with SetOptions.TrailingComment, are written in the
+// same column for the lines of a block. Other comments are written above their
+// line, and interrupt the block.
+//
+// For example, with AlignEquals:
+//
+//   name    = "apple"  # the fruit
+//   color   = "red"    # its color
+//   weights = [1, 2]
+func (e *Encoder) AlignComments(align bool) *Encoder {
+	e.alignComments = align
+	return e
+}
+
+func (e *Encoder) writeOpts() writeOpts {
+	opts := writeOpts{
+		arraysOneElementPerLine: e.arraysOneElementPerLine,
+		order:                   e.order,
+		indentString:            e.indentation,
+		compactComments:         e.compactComments,
+		headerLevels:            -1,
+		maxWidth:                e.maxWidth,
+		alignEquals:             e.alignEquals,
+		alignComments:           e.alignComments,
+	}
+	opts.setFormat(e.format)
+	switch e.tableStyle {
+	case TableDottedKeys:
+		opts.headerLevels = 0
+	case TableMixed:
+		opts.headerLevels = e.tableDepth
+		if e.tableDepth < 0 {
+			opts.headerLevels = 0
+		}
+	}
+	return opts
+}
+
+// CommentDefaults writes the fields that have a default tag and a zero value,
+// or a value equal to their default, as commented-out keys set to their
+// default value. Encoding an empty struct then produces a sample
+// configuration documenting the defaults.
+func (e *Encoder) CommentDefaults(comment bool) *Encoder {
+	e.commentDefaults = comment
+	return e
+}
+
 func (e *Encoder) marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := e.encode(&buf, v); err != nil {
+		return []byte{}, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Writes the TOML encoding of v to w. The document is converted to a tree
+// before being written, except for the arrays of tables when streaming.
+func (e *Encoder) encode(w io.Writer, v interface{}) error {
 	// Check if indentation is valid
 	for _, char := range e.indentation {
 		if !isSpace(char) {
-			return []byte{}, fmt.Errorf("invalid indentation: must only contains space or tab characters")
+			return fmt.Errorf("invalid indentation: must only contains space or tab characters")
 		}
 	}
 
 	mtype := reflect.TypeOf(v)
 	if mtype == nil {
-		return []byte{}, errors.New("nil cannot be marshaled to TOML")
+		return errors.New("nil cannot be marshaled to TOML")
 	}
 
 	switch mtype.Kind() {
 	case reflect.Struct, reflect.Map:
 	case reflect.Ptr:
 		if mtype.Elem().Kind() != reflect.Struct {
-			return []byte{}, errors.New("Only pointer to struct can be marshaled to TOML")
+			return errors.New("Only pointer to struct can be marshaled to TOML")
 		}
 		if reflect.ValueOf(v).IsNil() {
-			return []byte{}, errors.New("nil pointer cannot be marshaled to TOML")
+			return errors.New("nil pointer cannot be marshaled to TOML")
 		}
 	default:
-		return []byte{}, errors.New("Only a struct or map can be marshaled to TOML")
+		return errors.New("Only a struct or map can be marshaled to TOML")
 	}
 
 	sval := reflect.ValueOf(v)
-	if isCustomMarshaler(mtype) {
-		return callCustomMarshaler(sval)
-	}
-	if isTextMarshaler(mtype) {
-		return callTextMarshaler(sval)
+	var b []byte
+	var err error
+	switch {
+	case isCustomMarshaler(mtype):
+		b, err = callCustomMarshaler(sval)
+	case isTextMarshaler(mtype):
+		b, err = callTextMarshaler(sval)
+	default:
+		t, err := e.valueToTree(mtype, sval)
+		if err != nil {
+			return err
+		}
+		fw := newFormatWriter(w, e.format)
+		if _, err := t.writeToOrdered(fw, "", "", 0, e.writeOpts(), false); err != nil {
+			return err
+		}
+		return fw.close()
 	}
-	t, err := e.valueToTree(mtype, sval)
 	if err != nil {
-		return []byte{}, err
+		return err
 	}
-
-	var buf bytes.Buffer
-	_, err = t.writeToOrdered(&buf, "", "", 0, e.arraysOneElementPerLine, e.order, e.indentation, e.compactComments, false)
-
-	return buf.Bytes(), err
+	_, err = w.Write(b)
+	return err
 }
 
 // Create next tree with a position based on Encoder.line
@@ -437,18 +766,48 @@ func (e *Encoder) valueToTree(mtype reflect.Type, mval reflect.Value) (*Tree, er
 		case Tree:
 			reflect.ValueOf(tval).Elem().Set(mval)
 		default:
-			for i := 0; i < mtype.NumField(); i++ {
-				mtypef, mvalf := mtype.Field(i), mval.Field(i)
-				opts := tomlOptions(mtypef, e.annotation)
-				if opts.include && ((mtypef.Type.Kind() != reflect.Interface && !opts.omitempty) || !isZero(mvalf)) {
-					val, err := e.valueToToml(mtypef.Type, mvalf)
+			for _, f := range fieldsCache.get(mtype, e.annotation).list {
+				mtypef, mvalf := f.field, mval.Field(f.index)
+				opts := f.opts
+				if e.fieldNamer != nil && !opts.nameFromTag && !mtypef.Anonymous {
+					opts.name = e.fieldNamer(opts.name)
+				}
+				if e.commentDefaults && opts.defaultValue != "" {
+					dval, ok, err := e.defaultValue(mtypef, mvalf, opts.defaultValue)
+					if err != nil {
+						return nil, err
+					}
+					if ok {
+						mvalf = dval
+						opts.commented = true
+					}
+				}
+				if (mtypef.Type.Kind() != reflect.Interface && !opts.omitempty) || !isZero(mvalf) {
+					source, trees, err := e.tableSource(mtypef.Type, mvalf, opts)
 					if err != nil {
 						return nil, err
 					}
+					if source != nil {
+						tval.values[opts.name] = source
+						continue
+					}
+					var val interface{} = trees
+					if trees == nil {
+						val, err = e.valueToToml(mtypef.Type, mvalf)
+						if err != nil {
+							return nil, err
+						}
+					}
 					if tree, ok := val.(*Tree); ok && mtypef.Anonymous && !opts.nameFromTag && !e.promoteAnon {
 						e.appendTree(tval, tree)
 					} else {
+						if opts.inline || e.isSmallTable(val) {
+							setInline(val)
+						}
 						val = e.wrapTomlValue(val, tval)
+						if opts.maxWidth != 0 {
+							setMaxWidth(val, opts.maxWidth)
+						}
 						tval.SetPathWithOptions([]string{opts.name}, SetOptions{
 							Comment:   opts.comment,
 							Commented: opts.commented,
@@ -484,25 +843,169 @@ func (e *Encoder) valueToTree(mtype reflect.Type, mval reflect.Value) (*Tree, er
 			if (mtype.Elem().Kind() == reflect.Ptr || mtype.Elem().Kind() == reflect.Interface) && mvalf.IsNil() {
 				continue
 			}
-			val, err := e.valueToToml(mtype.Elem(), mvalf)
+			keyStr := key.String()
+			if e.quoteMapKeys {
+				var err error
+				keyStr, err = tomlValueStringRepresentation(key.String(), "", "", e.order, e.arraysOneElementPerLine)
+				if err != nil {
+					return nil, err
+				}
+			}
+			source, trees, err := e.tableSource(mtype.Elem(), mvalf, tomlOpts{})
 			if err != nil {
 				return nil, err
 			}
-			val = e.wrapTomlValue(val, tval)
-			if e.quoteMapKeys {
-				keyStr, err := tomlValueStringRepresentation(key.String(), "", "", e.order, e.arraysOneElementPerLine)
+			if source != nil {
+				tval.values[keyStr] = source
+				continue
+			}
+			var val interface{} = trees
+			if trees == nil {
+				val, err = e.valueToToml(mtype.Elem(), mvalf)
 				if err != nil {
 					return nil, err
 				}
-				tval.SetPath([]string{keyStr}, val)
-			} else {
-				tval.SetPath([]string{key.String()}, val)
 			}
+			if e.isSmallTable(val) {
+				setInline(val)
+			}
+			val = e.wrapTomlValue(val, tval)
+			tval.SetPath([]string{keyStr}, val)
 		}
 	}
 	return tval, nil
 }
 
+// Returns the default value of a field when it is written in place of the
+// value mval of the field, which is the case if mval is zero or equal to it.
+func (e *Encoder) defaultValue(f reflect.StructField, mval reflect.Value, s string) (reflect.Value, bool, error) {
+	d := NewDecoder(nil)
+	d.tagName = e.tag
+	dval := reflect.New(f.Type).Elem()
+	if err := d.valueFromDefault(s, dval); err != nil {
+		return dval, false, fmt.Errorf("field %s: %s", f.Name, err)
+	}
+	if !isZero(mval) && !reflect.DeepEqual(mval.Interface(), dval.Interface()) {
+		return dval, false, nil
+	}
+	return dval, true, nil
+}
+
+// Marks the tables of a toml value as inline tables.
+func setInline(val interface{}) {
+	switch node := val.(type) {
+	case *Tree:
+		node.inline = true
+	case []*Tree:
+		for _, tree := range node {
+			tree.inline = true
+		}
+	}
+}
+
+// Sets the width of the lines of a toml value.
+func setMaxWidth(val interface{}, width int) {
+	switch node := val.(type) {
+	case *tomlValue:
+		node.maxWidth = width
+	case *Tree:
+		node.maxWidth = width
+	case []*Tree:
+		for _, tree := range node {
+			tree.maxWidth = width
+		}
+	}
+}
+
+// Checks if the tables of a toml value are small enough to be written inline,
+// according to the InlineTables option.
+func (e *Encoder) isSmallTable(val interface{}) bool {
+	if e.inlineMaxKeys < 0 {
+		return false
+	}
+	switch node := val.(type) {
+	case *Tree:
+		if len(node.values) > e.inlineMaxKeys {
+			return false
+		}
+		for _, v := range node.values {
+			tv, ok := v.(*tomlValue)
+			if !ok || reflect.ValueOf(tv.value).Kind() == reflect.Slice {
+				return false
+			}
+		}
+		return true
+	case []*Tree:
+		for _, tree := range node {
+			if !e.isSmallTable(tree) {
+				return false
+			}
+		}
+		return len(node) > 0
+	default:
+		return false
+	}
+}
+
+// Returns a source building the tables of mval as they are written, if it is an
+// array of tables and the Encoder is streaming. Inline arrays of tables are
+// not streamed: with InlineTables, the tables are built until one of them is
+// not small, and they are returned instead of a source if all of them are.
+// The source is positioned where the first of its tables would be, and its
+// tables get the options of the field as in valueToTreeSlice.
+func (e *Encoder) tableSource(mtype reflect.Type, mval reflect.Value, opts tomlOpts) (*tableSource, []*Tree, error) {
+	if !e.streamTables || opts.inline || e.encoderFor(mtype) != nil {
+		return nil, nil, nil
+	}
+	switch mtype.Kind() {
+	case reflect.Slice, reflect.Array:
+	default:
+		return nil, nil, nil
+	}
+	if isCustomMarshaler(mtype) || isTextMarshaler(mtype) || isCustomMarshalerSequence(mtype) || isTextMarshalerSequence(mtype) || !isTreeSequence(mtype) || mval.Len() == 0 {
+		return nil, nil, nil
+	}
+
+	source := &tableSource{
+		len:      mval.Len(),
+		position: Position{Line: e.line, Col: 1},
+	}
+	var built []*Tree
+	if e.inlineMaxKeys >= 0 {
+		for i := 0; i < source.len; i++ {
+			tree, err := e.valueToTree(mtype.Elem(), mval.Index(i))
+			if err != nil {
+				return nil, nil, err
+			}
+			built = append(built, tree)
+			if !e.isSmallTable(tree) {
+				break
+			}
+		}
+		if len(built) == source.len && e.isSmallTable(built) {
+			return nil, built, nil
+		}
+	}
+	source.table = func(i int) (*Tree, error) {
+		var tree *Tree
+		if i < len(built) {
+			tree, built[i] = built[i], nil
+		} else {
+			var err error
+			if tree, err = e.valueToTree(mtype.Elem(), mval.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		tree.commented = opts.commented
+		if opts.maxWidth != 0 {
+			tree.maxWidth = opts.maxWidth
+		}
+		return tree, nil
+	}
+	e.line++
+	return source, nil, nil
+}
+
 // Convert given marshal slice to slice of Toml trees
 func (e *Encoder) valueToTreeSlice(mtype reflect.Type, mval reflect.Value) ([]*Tree, error) {
 	tval := make([]*Tree, mval.Len(), mval.Len())
@@ -526,15 +1029,51 @@ func (e *Encoder) valueToOtherSlice(mtype reflect.Type, mval reflect.Value) (int
 		}
 		tval[i] = val
 	}
+	if isCustomMarshalerSequence(mtype) && len(tval) > 0 {
+		// Documents returned by MarshalTOML form an array of tables
+		trees := make([]*Tree, len(tval))
+		for i, val := range tval {
+			tree, ok := val.(*Tree)
+			if !ok || tree.inline {
+				return tval, nil
+			}
+			trees[i] = tree
+		}
+		return trees, nil
+	}
 	return tval, nil
 }
 
+// Convert the output of MarshalTOML to a toml value: either a value literal, or
+// a document, which becomes a table
+func (e *Encoder) customMarshalerToToml(mval reflect.Value) (interface{}, error) {
+	b, err := callCustomMarshaler(mval)
+	if err != nil {
+		return nil, err
+	}
+	if val, err := ParseValue(string(b)); err == nil {
+		if tree, ok := val.(*Tree); ok {
+			tree.position = Position{Line: e.line, Col: 1}
+		}
+		return val, nil
+	}
+	tree, err := LoadBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TOML returned by MarshalTOML of %v: %s", mval.Type(), err)
+	}
+	tree.position = Position{Line: e.line, Col: 1}
+	return tree, nil
+}
+
 // Convert given marshal value to toml value
 func (e *Encoder) valueToToml(mtype reflect.Type, mval reflect.Value) (interface{}, error) {
+	if f := e.encoderFor(mtype); f != nil {
+		return e.valueToTomlWith(f, mtype, mval)
+	}
 	if mtype.Kind() == reflect.Ptr {
 		switch {
 		case isCustomMarshaler(mtype):
-			return callCustomMarshaler(mval)
+			return e.customMarshalerToToml(mval)
 		case isTextMarshaler(mtype):
 			b, err := callTextMarshaler(mval)
 			return string(b), err
@@ -547,7 +1086,7 @@ func (e *Encoder) valueToToml(mtype reflect.Type, mval reflect.Value) (interface
 	}
 	switch {
 	case isCustomMarshaler(mtype):
-		return callCustomMarshaler(mval)
+		return e.customMarshalerToToml(mval)
 	case isTextMarshaler(mtype):
 		b, err := callTextMarshaler(mval)
 		return string(b), err
@@ -614,8 +1153,9 @@ func (e *Encoder) wrapTomlValue(val interface{}, parent *Tree) interface{} {
 }
 
 // Unmarshal attempts to unmarshal the Tree into a Go struct pointed by v.
-// Neither Unmarshaler interfaces nor UnmarshalTOML functions are supported for
-// sub-structs, and only definite types can be unmarshaled.
+// Values implementing the ValueUnmarshaler or Unmarshaler interfaces are
+// decoded with their own method at any depth, and only definite types can be
+// unmarshaled.
 func (t *Tree) Unmarshal(v interface{}) error {
 	d := Decoder{tval: t, tagName: tagFieldName}
 	return d.unmarshal(v)
@@ -633,30 +1173,43 @@ func (t *Tree) Marshal() ([]byte, error) {
 }
 
 // Unmarshal parses the TOML-encoded data and stores the result in the value
-// pointed to by v. Behavior is similar to the Go json encoder, except that there
-// is no concept of an Unmarshaler interface or UnmarshalTOML function for
-// sub-structs, and currently only definite types can be unmarshaled to (i.e. no
-// `interface{}`).
+// pointed to by v. Behavior is similar to the Go json encoder, and values
+// implementing the ValueUnmarshaler or Unmarshaler interfaces are decoded with
+// their own method at any depth. Functions registered with RegisterDecoder take
+// precedence over both. Currently only definite types can be unmarshaled to
+// (i.e. no `interface{}`).
 //
 // The following struct annotations are supported:
 //
 //   toml:"Field" Overrides the field's name to map to.
 //   default:"foo" Provides a default value.
+//   env:"FOO" Overrides the value with the environment variable FOO, if set.
+//   toml:"Field,required" Requires the key to be set.
+//   toml_validate:"min=1,max=10" Checks the decoded value against comma-separated rules.
+//
+// The rules of toml_validate are:
 //
-// For default values, only fields of the following types are supported:
-//   * string
-//   * bool
-//   * int
-//   * int64
-//   * float64
+//   min=1 Sets the minimum of a number, or of the length of a string, array, slice or map.
+//   max=10 Sets the maximum of a number, or of the length of a string, array, slice or map.
+//   len=3 Sets the length of a string, array, slice or map.
+//   oneof=a b c Restricts a string, bool or number to the space-separated values.
+//   pattern=^[a-z]+$ Requires a string to match the regular expression.
+//
+// A required key may also be set by a default value or an environment
+// variable. The rules apply to the fields that are set, once decoded.
+// All the failures of a document are returned as a ValidationError, with the
+// path and position of the keys.
+//
+// Default values and environment variables named by env tags are read as TOML
+// values (e.g. 42, true, [1, 2], { a = 1 } or 1979-05-27), or as strings when
+// they cannot be (e.g. 5m for a time.Duration). Environment variables take
+// precedence over both the document and default values. Structs implementing
+// Defaulter set their own defaults before being decoded into.
 //
 // See Marshal() documentation for types mapping table.
 func Unmarshal(data []byte, v interface{}) error {
-	t, err := LoadReader(bytes.NewReader(data))
-	if err != nil {
-		return err
-	}
-	return t.Unmarshal(v)
+	d := Decoder{tagName: tagFieldName}
+	return d.decodeBytes(data, v)
 }
 
 // Decoder reads and decodes TOML values from an input stream.
@@ -664,9 +1217,20 @@ type Decoder struct {
 	r    io.Reader
 	tval *Tree
 	encOpts
-	tagName string
-	strict  bool
-	visitor visitorState
+	tagName    string
+	strict     bool
+	visitor    visitorState
+	lookupEnv  func(string) (string, bool)
+	decoders   map[reflect.Type]DecodeFunc
+	hooks      []DecodeHook
+	metadata   bool
+	defaulted  []KeyPath
+	invalid    ValidationError
+	keyMatcher KeyMatcher
+
+	// Element being decoded
+	path KeyPath
+	pos  Source
 }
 
 // NewDecoder returns a new decoder that reads from r.
@@ -683,8 +1247,22 @@ func NewDecoder(r io.Reader) *Decoder {
 //
 // See the documentation for Marshal for details.
 func (d *Decoder) Decode(v interface{}) error {
+	b, err := ioutil.ReadAll(d.r)
+	if err != nil {
+		return err
+	}
+	return d.decodeBytes(b, v)
+}
+
+// Decodes the document b into v, directly when possible, or else from the Tree
+// of the document.
+func (d *Decoder) decodeBytes(b []byte, v interface{}) error {
+	if d.decodeDirect(b, v) {
+		d.tval = nil
+		return nil
+	}
 	var err error
-	d.tval, err = LoadReader(d.r)
+	d.tval, err = LoadBytes(b)
 	if err != nil {
 		return err
 	}
@@ -697,6 +1275,30 @@ func (d *Decoder) SetTagName(v string) *Decoder {
 	return d
 }
 
+// LookupEnv changes the function used to read the environment variables named
+// by env struct tags. It defaults to os.LookupEnv.
+func (d *Decoder) LookupEnv(lookup func(string) (string, bool)) *Decoder {
+	d.lookupEnv = lookup
+	return d
+}
+
+// DecodeHook transforms value, an element of a document found at path, before
+// it is decoded into a value of type to. The type from is the type of value:
+// a *Tree for tables, a []*Tree for arrays of tables, a []interface{} for
+// arrays, or the type of a primitive value. The returned value is decoded
+// instead of value, and may be a map[string]interface{} to be decoded as a
+// table.
+type DecodeHook func(from, to reflect.Type, value interface{}, path KeyPath) (interface{}, error)
+
+// Hook adds a function called on every element of the document before it is
+// decoded. Hooks are called in the order they are added, each receiving the
+// value returned by the previous one. Their errors are reported with the
+// position of the element.
+func (d *Decoder) Hook(hook DecodeHook) *Decoder {
+	d.hooks = append(d.hooks, hook)
+	return d
+}
+
 // Strict allows changing to strict decoding. Any fields that are found in the
 // input data and do not have a corresponding struct member cause an error.
 func (d *Decoder) Strict(strict bool) *Decoder {
@@ -729,15 +1331,24 @@ func (d *Decoder) unmarshal(v interface{}) error {
 
 	vv := reflect.ValueOf(v).Elem()
 
-	if d.strict {
+	d.visitor = visitorState{}
+	if d.strict || d.metadata {
 		d.visitor = newVisitorState(d.tval)
 	}
+	d.path, d.pos = nil, d.tval.GetSourcePath(nil)
+	d.defaulted = nil
+	d.invalid = nil
 
 	sval, err := d.valueFromTree(elem, d.tval, &vv)
 	if err != nil {
 		return err
 	}
-	if err := d.visitor.validate(); err != nil {
+	if d.strict {
+		if err := d.visitor.validate(); err != nil {
+			return err
+		}
+	}
+	if err := d.validationError(); err != nil {
 		return err
 	}
 	reflect.ValueOf(v).Elem().Set(sval)
@@ -751,8 +1362,24 @@ func (d *Decoder) valueFromTree(mtype reflect.Type, tval *Tree, mval1 *reflect.V
 		return d.unwrapPointer(mtype, tval, mval1)
 	}
 
+	// Check if pointer to value implements the ValueUnmarshaler interface.
+	if isValueUnmarshaler(reflect.PtrTo(mtype)) {
+		mvalPtr := reflect.New(mtype)
+		d.visitor.visitAll()
+
+		if tval == nil {
+			return mvalPtr.Elem(), nil
+		}
+
+		if err := d.callValueUnmarshaler(mvalPtr, tval); err != nil {
+			return reflect.ValueOf(nil), err
+		}
+		return mvalPtr.Elem(), nil
+	}
+
 	// Check if pointer to value implements the Unmarshaler interface.
-	if mvalPtr := reflect.New(mtype); isCustomUnmarshaler(mvalPtr.Type()) {
+	if isCustomUnmarshaler(reflect.PtrTo(mtype)) {
+		mvalPtr := reflect.New(mtype)
 		d.visitor.visitAll()
 
 		if tval == nil {
@@ -778,24 +1405,17 @@ func (d *Decoder) valueFromTree(mtype reflect.Type, tval *Tree, mval1 *reflect.V
 		case Tree:
 			mval.Set(reflect.ValueOf(tval).Elem())
 		default:
-			for i := 0; i < mtype.NumField(); i++ {
-				mtypef := mtype.Field(i)
-				an := annotation{tag: d.tagName}
-				opts := tomlOptions(mtypef, an)
-				if !opts.include {
-					continue
-				}
-				baseKey := opts.name
-				keysToTry := []string{
-					baseKey,
-					strings.ToLower(baseKey),
-					strings.ToTitle(baseKey),
-					strings.ToLower(string(baseKey[0])) + baseKey[1:],
+			if mval.CanAddr() {
+				if defaulter, ok := mval.Addr().Interface().(Defaulter); ok {
+					defaulter.SetDefaults()
 				}
-
+			}
+			for _, f := range fieldsCache.get(mtype, annotation{tag: d.tagName}).list {
+				i, mtypef, opts := f.index, f.field, f.opts
 				found := false
+				fieldKey, fieldPos := opts.name, d.pos
 				if tval != nil {
-					for _, key := range keysToTry {
+					for _, key := range d.keysToTry(tval, f) {
 						exists := tval.HasPath([]string{key})
 						if !exists {
 							continue
@@ -803,87 +1423,24 @@ func (d *Decoder) valueFromTree(mtype reflect.Type, tval *Tree, mval1 *reflect.V
 
 						d.visitor.push(key)
 						val := tval.GetPath([]string{key})
+						pos := tval.GetSourcePath([]string{key})
 						fval := mval.Field(i)
+						leave := d.enter(key, pos)
 						mvalf, err := d.valueFromToml(mtypef.Type, val, &fval)
+						leave()
 						if err != nil {
-							return mval, formatError(err, tval.GetPositionPath([]string{key}))
+							return mval, formatError(err, pos)
 						}
 						mval.Field(i).Set(mvalf)
 						found = true
+						fieldKey, fieldPos = key, pos
 						d.visitor.pop()
 						break
 					}
 				}
 
-				if !found && opts.defaultValue != "" {
-					mvalf := mval.Field(i)
-					var val interface{}
-					var err error
-					switch mvalf.Kind() {
-					case reflect.String:
-						val = opts.defaultValue
-					case reflect.Bool:
-						val, err = strconv.ParseBool(opts.defaultValue)
-					case reflect.Uint:
-						val, err = strconv.ParseUint(opts.defaultValue, 10, 0)
-					case reflect.Uint8:
-						val, err = strconv.ParseUint(opts.defaultValue, 10, 8)
-					case reflect.Uint16:
-						val, err = strconv.ParseUint(opts.defaultValue, 10, 16)
-					case reflect.Uint32:
-						val, err = strconv.ParseUint(opts.defaultValue, 10, 32)
-					case reflect.Uint64:
-						val, err = strconv.ParseUint(opts.defaultValue, 10, 64)
-					case reflect.Int:
-						val, err = strconv.ParseInt(opts.defaultValue, 10, 0)
-					case reflect.Int8:
-						val, err = strconv.ParseInt(opts.defaultValue, 10, 8)
-					case reflect.Int16:
-						val, err = strconv.ParseInt(opts.defaultValue, 10, 16)
-					case reflect.Int32:
-						val, err = strconv.ParseInt(opts.defaultValue, 10, 32)
-					case reflect.Int64:
-						// Check if the provided number has a non-numeric extension.
-						var hasExtension bool
-						if len(opts.defaultValue) > 0 {
-							lastChar := opts.defaultValue[len(opts.defaultValue)-1]
-							if lastChar < '0' || lastChar > '9' {
-								hasExtension = true
-							}
-						}
-						// If the value is a time.Duration with extension, parse as duration.
-						// If the value is an int64 or a time.Duration without extension, parse as number.
-						if hasExtension && mvalf.Type().String() == "time.Duration" {
-							val, err = time.ParseDuration(opts.defaultValue)
-						} else {
-							val, err = strconv.ParseInt(opts.defaultValue, 10, 64)
-						}
-					case reflect.Float32:
-						val, err = strconv.ParseFloat(opts.defaultValue, 32)
-					case reflect.Float64:
-						val, err = strconv.ParseFloat(opts.defaultValue, 64)
-					default:
-						return mvalf, fmt.Errorf("unsupported field type for default option")
-					}
-
-					if err != nil {
-						return mvalf, err
-					}
-					mvalf.Set(reflect.ValueOf(val).Convert(mvalf.Type()))
-				}
-
-				// save the old behavior above and try to check structs
-				if !found && opts.defaultValue == "" && mtypef.Type.Kind() == reflect.Struct {
-					tmpTval := tval
-					if !mtypef.Anonymous {
-						tmpTval = nil
-					}
-					fval := mval.Field(i)
-					v, err := d.valueFromTree(mtypef.Type, tmpTval, &fval)
-					if err != nil {
-						return v, err
-					}
-					mval.Field(i).Set(v)
+				if err := d.completeField(mval, f, tval, found, fieldKey, fieldPos); err != nil {
+					return mval, err
 				}
 			}
 		}
@@ -893,9 +1450,12 @@ func (d *Decoder) valueFromTree(mtype reflect.Type, tval *Tree, mval1 *reflect.V
 			d.visitor.push(key)
 			// TODO: path splits key
 			val := tval.GetPath([]string{key})
+			pos := tval.GetSourcePath([]string{key})
+			leave := d.enter(key, pos)
 			mvalf, err := d.valueFromToml(mtype.Elem(), val, nil)
+			leave()
 			if err != nil {
-				return mval, formatError(err, tval.GetPositionPath([]string{key}))
+				return mval, formatError(err, pos)
 			}
 			mval.SetMapIndex(reflect.ValueOf(key).Convert(mtype.Key()), mvalf)
 			d.visitor.pop()
@@ -904,6 +1464,65 @@ func (d *Decoder) valueFromTree(mtype reflect.Type, tval *Tree, mval1 *reflect.V
 	return mval, nil
 }
 
+// Completes the decoding of the field f of the struct mval, after looking for
+// it in tval. When the field was not found, it is set from its default value,
+// or decoded from nothing if it is a struct, to set its own fields. It is then
+// set from its environment variable if any, and its requirements are checked.
+// The key and position of the field are those it was found at, or the ones of
+// its table.
+func (d *Decoder) completeField(mval reflect.Value, f structField, tval *Tree, found bool, fieldKey string, fieldPos Source) error {
+	mtypef, opts := f.field, f.opts
+	set := found
+	if !found && opts.defaultValue != "" {
+		if err := d.valueFromDefault(opts.defaultValue, mval.Field(f.index)); err != nil {
+			return err
+		}
+		d.defaulted = append(d.defaulted, append(append(KeyPath(nil), d.path...), opts.name))
+		set = true
+	}
+
+	// save the old behavior above and try to check structs
+	if !found && opts.defaultValue == "" && mtypef.Type.Kind() == reflect.Struct {
+		tmpTval := tval
+		if !mtypef.Anonymous {
+			tmpTval = nil
+		}
+		fval := mval.Field(f.index)
+		leave := func() {}
+		if !mtypef.Anonymous {
+			leave = d.enter(opts.name, d.pos)
+		}
+		v, err := d.valueFromTree(mtypef.Type, tmpTval, &fval)
+		leave()
+		if err != nil {
+			return err
+		}
+		mval.Field(f.index).Set(v)
+	}
+
+	if opts.env != "" {
+		fromEnv, err := d.valueFromEnv(opts.env, mval.Field(f.index))
+		if err != nil {
+			return err
+		}
+		set = set || fromEnv
+	}
+
+	if opts.required && !set {
+		d.fieldError(fieldKey, fieldPos, errors.New("missing required key"))
+	}
+	if set && (f.rules != nil || f.rulesErr != nil) {
+		failures, err := validateField(f, mval.Field(f.index))
+		if err != nil {
+			return err
+		}
+		for _, failure := range failures {
+			d.fieldError(fieldKey, fieldPos, failure)
+		}
+	}
+	return nil
+}
+
 // Convert toml value to marshal struct/map slice, using marshal type
 func (d *Decoder) valueFromTreeSlice(mtype reflect.Type, tval []*Tree) (reflect.Value, error) {
 	mval, err := makeSliceOrArray(mtype, len(tval))
@@ -913,7 +1532,9 @@ func (d *Decoder) valueFromTreeSlice(mtype reflect.Type, tval []*Tree) (reflect.
 
 	for i := 0; i < len(tval); i++ {
 		d.visitor.push(strconv.Itoa(i))
+		leave := d.enter(strconv.Itoa(i), Source{Filename: tval[i].filename, Position: tval[i].position})
 		val, err := d.valueFromTree(mtype.Elem(), tval[i], nil)
+		leave()
 		if err != nil {
 			return mval, err
 		}
@@ -931,7 +1552,9 @@ func (d *Decoder) valueFromOtherSlice(mtype reflect.Type, tval []interface{}) (r
 	}
 
 	for i := 0; i < len(tval); i++ {
+		leave := d.enter(strconv.Itoa(i), d.pos)
 		val, err := d.valueFromToml(mtype.Elem(), tval[i], nil)
+		leave()
 		if err != nil {
 			return mval, err
 		}
@@ -951,7 +1574,9 @@ func (d *Decoder) valueFromOtherSliceI(mtype reflect.Type, tval interface{}) (re
 	}
 
 	for i := 0; i < length; i++ {
+		leave := d.enter(strconv.Itoa(i), d.pos)
 		val, err := d.valueFromToml(mtype.Elem(), val.Index(i).Interface(), nil)
+		leave()
 		if err != nil {
 			return mval, err
 		}
@@ -978,10 +1603,40 @@ func makeSliceOrArray(mtype reflect.Type, tLength int) (reflect.Value, error) {
 // Convert toml value to marshal value, using marshal type. When mval1 is non-nil
 // and the given type is a struct value, merge fields into it.
 func (d *Decoder) valueFromToml(mtype reflect.Type, tval interface{}, mval1 *reflect.Value) (reflect.Value, error) {
-	if mtype.Kind() == reflect.Ptr {
+	f := d.decoderFor(mtype)
+	if f == nil && mtype.Kind() == reflect.Ptr {
 		return d.unwrapPointer(mtype, tval, mval1)
 	}
 
+	tval, err := d.applyHooks(mtype, tval)
+	if err != nil {
+		return reflect.ValueOf(nil), err
+	}
+
+	if f != nil {
+		return d.valueFromTomlWith(f, mtype, tval)
+	}
+
+	// Check if pointer to value implements the ValueUnmarshaler interface.
+	if isValueUnmarshaler(reflect.PtrTo(mtype)) {
+		mvalPtr := reflect.New(mtype)
+		d.visitor.visitAll()
+		if err := d.callValueUnmarshaler(mvalPtr, tval); err != nil {
+			return reflect.ValueOf(nil), err
+		}
+		return mvalPtr.Elem(), nil
+	}
+
+	// Check if pointer to value implements the Unmarshaler interface.
+	if isCustomUnmarshaler(reflect.PtrTo(mtype)) {
+		mvalPtr := reflect.New(mtype)
+		d.visitor.visitAll()
+		if err := callCustomUnmarshaler(mvalPtr, tomlToGo(tval)); err != nil {
+			return reflect.ValueOf(nil), fmt.Errorf("unmarshal toml: %v", err)
+		}
+		return mvalPtr.Elem(), nil
+	}
+
 	switch t := tval.(type) {
 	case *Tree:
 		var mval11 *reflect.Value
@@ -1017,7 +1672,7 @@ func (d *Decoder) valueFromToml(mtype reflect.Type, tval interface{}, mval1 *ref
 		return reflect.ValueOf(nil), fmt.Errorf("Can't convert %v(%T) to trees", tval, tval)
 	case []interface{}:
 		d.visitor.visit()
-		if isOtherSequence(mtype) {
+		if isOtherSequence(mtype) || isCustomUnmarshalerSequence(mtype) {
 			return d.valueFromOtherSlice(mtype, t)
 		}
 		if mtype.Kind() == reflect.Interface {
@@ -1031,18 +1686,10 @@ func (d *Decoder) valueFromToml(mtype reflect.Type, tval interface{}, mval1 *ref
 		return reflect.ValueOf(nil), fmt.Errorf("Can't convert %v(%T) to a slice", tval, tval)
 	default:
 		d.visitor.visit()
-		mvalPtr := reflect.New(mtype)
-
-		// Check if pointer to value implements the Unmarshaler interface.
-		if isCustomUnmarshaler(mvalPtr.Type()) {
-			if err := callCustomUnmarshaler(mvalPtr, tval); err != nil {
-				return reflect.ValueOf(nil), fmt.Errorf("unmarshal toml: %v", err)
-			}
-			return mvalPtr.Elem(), nil
-		}
 
 		// Check if pointer to value implements the encoding.TextUnmarshaler.
-		if isTextUnmarshaler(mvalPtr.Type()) && !isTimeType(mtype) {
+		if isTextUnmarshaler(reflect.PtrTo(mtype)) && !isTimeType(mtype) {
+			mvalPtr := reflect.New(mtype)
 			if err := d.unmarshalText(tval, mvalPtr); err != nil {
 				return reflect.ValueOf(nil), fmt.Errorf("unmarshal text: %v", err)
 			}
@@ -1102,7 +1749,7 @@ func (d *Decoder) valueFromToml(mtype reflect.Type, tval interface{}, mval1 *ref
 			if !val.Type().ConvertibleTo(mtype) || val.Kind() == reflect.Float64 {
 				return reflect.ValueOf(nil), fmt.Errorf("Can't convert %v(%T) to %v", tval, tval, mtype.String())
 			}
-			if reflect.Indirect(reflect.New(mtype)).OverflowInt(val.Convert(reflect.TypeOf(int64(0))).Int()) {
+			if reflect.Zero(mtype).OverflowInt(val.Convert(reflect.TypeOf(int64(0))).Int()) {
 				return reflect.ValueOf(nil), fmt.Errorf("%v(%T) would overflow %v", tval, tval, mtype.String())
 			}
 
@@ -1116,7 +1763,7 @@ func (d *Decoder) valueFromToml(mtype reflect.Type, tval interface{}, mval1 *ref
 			if val.Type().Kind() != reflect.Uint64 && val.Convert(reflect.TypeOf(int(1))).Int() < 0 {
 				return reflect.ValueOf(nil), fmt.Errorf("%v(%T) is negative so does not fit in %v", tval, tval, mtype.String())
 			}
-			if reflect.Indirect(reflect.New(mtype)).OverflowUint(val.Convert(reflect.TypeOf(uint64(0))).Uint()) {
+			if reflect.Zero(mtype).OverflowUint(val.Convert(reflect.TypeOf(uint64(0))).Uint()) {
 				return reflect.ValueOf(nil), fmt.Errorf("%v(%T) would overflow %v", tval, tval, mtype.String())
 			}
 
@@ -1126,7 +1773,7 @@ func (d *Decoder) valueFromToml(mtype reflect.Type, tval interface{}, mval1 *ref
 			if !val.Type().ConvertibleTo(mtype) || val.Kind() == reflect.Int64 {
 				return reflect.ValueOf(nil), fmt.Errorf("Can't convert %v(%T) to %v", tval, tval, mtype.String())
 			}
-			if reflect.Indirect(reflect.New(mtype)).OverflowFloat(val.Convert(reflect.TypeOf(float64(0))).Float()) {
+			if reflect.Zero(mtype).OverflowFloat(val.Convert(reflect.TypeOf(float64(0))).Float()) {
 				return reflect.ValueOf(nil), fmt.Errorf("%v(%T) would overflow %v", tval, tval, mtype.String())
 			}
 
@@ -1139,7 +1786,7 @@ func (d *Decoder) valueFromToml(mtype reflect.Type, tval interface{}, mval1 *ref
 				return d.valueFromToml(mval1.Elem().Type(), t, &ival)
 			}
 		case reflect.Slice, reflect.Array:
-			if isOtherSequence(mtype) && isOtherSequence(reflect.TypeOf(t)) {
+			if (isOtherSequence(mtype) || isCustomUnmarshalerSequence(mtype)) && isOtherSequence(reflect.TypeOf(t)) {
 				return d.valueFromOtherSliceI(mtype, t)
 			}
 			return reflect.ValueOf(nil), fmt.Errorf("Can't convert %v(%T) to %v(%v)", tval, tval, mtype, mtype.Kind())
@@ -1149,6 +1796,38 @@ func (d *Decoder) valueFromToml(mtype reflect.Type, tval interface{}, mval1 *ref
 	}
 }
 
+// Transforms the toml value decoded into a value of type mtype with the hooks
+// of the decoder
+func (d *Decoder) applyHooks(mtype reflect.Type, tval interface{}) (interface{}, error) {
+	if len(d.hooks) == 0 {
+		return tval, nil
+	}
+	path := append(KeyPath(nil), d.path...)
+	for _, hook := range d.hooks {
+		val, err := hook(reflect.TypeOf(tval), mtype, tval, path)
+		if err != nil {
+			return nil, &positionError{pos: d.pos, err: err}
+		}
+		tval = val
+	}
+	if m, ok := tval.(map[string]interface{}); ok {
+		return TreeFromMap(m)
+	}
+	return tval, nil
+}
+
+// Enters the element key of the one being decoded, located at pos. The returned
+// function goes back to the previous element.
+func (d *Decoder) enter(key string, pos Source) func() {
+	prevPos := d.pos
+	d.path = append(d.path, key)
+	d.pos = pos
+	return func() {
+		d.path = d.path[:len(d.path)-1]
+		d.pos = prevPos
+	}
+}
+
 func (d *Decoder) unwrapPointer(mtype reflect.Type, tval interface{}, mval1 *reflect.Value) (reflect.Value, error) {
 	var melem *reflect.Value
 
@@ -1166,6 +1845,58 @@ func (d *Decoder) unwrapPointer(mtype reflect.Type, tval interface{}, mval1 *ref
 	return mval, nil
 }
 
+// Sets mval to the value of the environment variable name, if it is set. It
+// reports whether the variable is set.
+func (d *Decoder) valueFromEnv(name string, mval reflect.Value) (bool, error) {
+	lookup := d.lookupEnv
+	if lookup == nil {
+		lookup = os.LookupEnv
+	}
+	s, ok := lookup(name)
+	if !ok {
+		return false, nil
+	}
+	if err := d.valueFromString(s, mval); err != nil {
+		return true, fmt.Errorf("environment variable %s: %s", name, err)
+	}
+	return true, nil
+}
+
+// Sets mval to the default value s of a field.
+func (d *Decoder) valueFromDefault(s string, mval reflect.Value) error {
+	if err := d.valueFromString(s, mval); err != nil {
+		return fmt.Errorf("invalid default value %q: %s", s, err)
+	}
+	return nil
+}
+
+// Sets mval to the value written in s. The value is read as a TOML value
+// literal, or as a string if it is not one or if it cannot be converted to the
+// type of mval. Integers are accepted for floats.
+func (d *Decoder) valueFromString(s string, mval reflect.Value) error {
+	mtype := mval.Type()
+	for mtype.Kind() == reflect.Ptr {
+		mtype = mtype.Elem()
+	}
+	if mtype.Kind() != reflect.String {
+		if tval, err := ParseValue(s); err == nil {
+			if i, ok := tval.(int64); ok && (mtype.Kind() == reflect.Float32 || mtype.Kind() == reflect.Float64) {
+				tval = float64(i)
+			}
+			if val, err := d.valueFromToml(mval.Type(), tval, &mval); err == nil {
+				mval.Set(val)
+				return nil
+			}
+		}
+	}
+	val, err := d.valueFromToml(mval.Type(), s, &mval)
+	if err != nil {
+		return err
+	}
+	mval.Set(val)
+	return nil
+}
+
 func (d *Decoder) unmarshalText(tval interface{}, mval reflect.Value) error {
 	var buf bytes.Buffer
 	fmt.Fprint(&buf, tval)
@@ -1183,6 +1914,11 @@ func tomlOptions(vf reflect.StructField, an annotation) tomlOpts {
 	multiline, _ := strconv.ParseBool(vf.Tag.Get(an.multiline))
 	literal, _ := strconv.ParseBool(vf.Tag.Get(an.literal))
 	defaultValue := vf.Tag.Get(tagDefault)
+	env := vf.Tag.Get(tagEnv)
+	maxWidth, _ := strconv.Atoi(vf.Tag.Get(tagWidth))
+	if maxWidth == 0 && vf.Tag.Get(tagWidth) == "0" {
+		maxWidth = -1
+	}
 	result := tomlOpts{
 		name:         vf.Name,
 		nameFromTag:  false,
@@ -1193,6 +1929,8 @@ func tomlOptions(vf reflect.StructField, an annotation) tomlOpts {
 		include:      true,
 		omitempty:    false,
 		defaultValue: defaultValue,
+		env:          env,
+		maxWidth:     maxWidth,
 	}
 	if parse[0] != "" {
 		if parse[0] == "-" && len(parse) == 1 {
@@ -1205,8 +1943,15 @@ func tomlOptions(vf reflect.StructField, an annotation) tomlOpts {
 	if vf.PkgPath != "" {
 		result.include = false
 	}
-	if len(parse) > 1 && strings.Trim(parse[1], " ") == "omitempty" {
-		result.omitempty = true
+	for _, option := range parse[1:] {
+		switch strings.Trim(option, " ") {
+		case "omitempty":
+			result.omitempty = true
+		case "required":
+			result.required = true
+		case "inline":
+			result.inline = true
+		}
 	}
 	if vf.Type.Kind() == reflect.Ptr {
 		result.omitempty = true
@@ -1223,23 +1968,46 @@ func isZero(val reflect.Value) bool {
 	}
 }
 
-func formatError(err error, pos Position) error {
-	if err.Error()[0] == '(' { // Error already contains position information
+// positionError is an error about the element at pos of a document.
+type positionError struct {
+	pos Source
+	err error
+}
+
+func (e *positionError) Error() string {
+	return fmt.Sprintf("%s: %s", e.pos, e.err)
+}
+
+func (e *positionError) Unwrap() error {
+	return e.err
+}
+
+func formatError(err error, pos Source) error {
+	var perr *positionError
+	if errors.As(err, &perr) { // Error already contains position information
+		return err
+	}
+	if positionPrefix.MatchString(err.Error()) {
+		// Position formatted into the message of an error, for example by an
+		// UnmarshalTOML method wrapping the error of a nested decoding
 		return err
 	}
-	return fmt.Errorf("%s: %s", pos, err)
+	return &positionError{pos: pos, err: err}
 }
 
+// Matches the messages starting with a position, as formatted by Position.
+var positionPrefix = regexp.MustCompile(`^(\S*:)?\(\d+, \d+\)`)
+
 // visitorState keeps track of which keys were unmarshaled.
 type visitorState struct {
 	tree   *Tree
 	path   []string
-	keys   map[string]struct{}
+	keys   map[string]Key
 	active bool
 }
 
 func newVisitorState(tree *Tree) visitorState {
-	path, result := []string{}, map[string]struct{}{}
+	path, result := []string{}, map[string]Key{}
 	insertKeys(path, result, tree)
 	return visitorState{
 		tree:   tree,
@@ -1263,20 +2031,31 @@ func (s *visitorState) pop() {
 
 func (s *visitorState) visit() {
 	if s.active {
-		delete(s.keys, strings.Join(s.path, "."))
+		delete(s.keys, KeyPath(s.path).String())
 	}
 }
 
 func (s *visitorState) visitAll() {
 	if s.active {
+		prefix := KeyPath(s.path).String()
 		for k := range s.keys {
-			if strings.HasPrefix(k, strings.Join(s.path, ".")) {
+			if prefix == "" || k == prefix || strings.HasPrefix(k, prefix+".") {
 				delete(s.keys, k)
 			}
 		}
 	}
 }
 
+// Returns the keys that were not unmarshaled, in the order of the document.
+func (s *visitorState) undecoded() []Key {
+	keys := make([]Key, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	sortKeys(keys)
+	return keys
+}
+
 func (s *visitorState) validate() error {
 	if !s.active {
 		return nil
@@ -1292,7 +2071,7 @@ func (s *visitorState) validate() error {
 	return nil
 }
 
-func insertKeys(path []string, m map[string]struct{}, tree *Tree) {
+func insertKeys(path []string, m map[string]Key, tree *Tree) {
 	for k, v := range tree.values {
 		switch node := v.(type) {
 		case []*Tree:
@@ -1302,7 +2081,8 @@ func insertKeys(path []string, m map[string]struct{}, tree *Tree) {
 		case *Tree:
 			insertKeys(append(path, k), m, node)
 		case *tomlValue:
-			m[strings.Join(append(path, k), ".")] = struct{}{}
+			keyPath := append(KeyPath(nil), append(path, k)...)
+			m[keyPath.String()] = Key{Path: keyPath, Position: node.position, Filename: node.filename}
 		}
 	}
 }
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -2293,6 +2294,18 @@ func TestUnmarshalNegativeUint(t *testing.T) {
 	}
 }
 
+func TestUnmarshalErrorFilename(t *testing.T) {
+	type check struct {
+		Sub struct{ U uint }
+	}
+
+	tree, _ := LoadReaderNamed(strings.NewReader("[sub]\nu = -1"), "app.toml")
+	err := tree.Clone().Unmarshal(&check{})
+	if err.Error() != "app.toml:(2, 1): -1(int64) is negative so does not fit in uint" {
+		t.Error("expect err:app.toml:(2, 1): -1(int64) is negative so does not fit in uint but got:", err)
+	}
+}
+
 func TestUnmarshalCheckConversionFloatInt(t *testing.T) {
 	type conversionCheck struct {
 		U uint
@@ -2505,6 +2518,198 @@ func TestUnmarshalDefaultFailureUnsupported(t *testing.T) {
 	}
 }
 
+type defaultsSubConfig struct {
+	Level string `toml:"level" default:"info"`
+	Path  string `toml:"path"`
+}
+
+func (c *defaultsSubConfig) SetDefaults() {
+	c.Path = "/var/log"
+	c.Level = "debug"
+}
+
+func TestUnmarshalDefaultLiterals(t *testing.T) {
+	var doc struct {
+		Ints     []int                  `toml:"ints" default:"[1, 2, 3]"`
+		Limits   map[string]int         `toml:"limits" default:"{ cpu = 2 }"`
+		Log      defaultsSubConfig      `toml:"log" default:"{ path = '/tmp' }"`
+		Date     LocalDate              `toml:"date" default:"1979-05-27"`
+		Time     time.Time              `toml:"time" default:"1979-05-27T07:32:00Z"`
+		Timeout  time.Duration          `toml:"timeout" default:"5m"`
+		Ratio    float64                `toml:"ratio" default:"1"`
+		Number   *int                   `toml:"number" default:"3"`
+		Text     textUnmarshalerDefault `toml:"text" default:"a b"`
+		Existing []int                  `toml:"existing" default:"[1]"`
+	}
+
+	err := Unmarshal([]byte("existing = [4]"), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(doc.Ints, []int{1, 2, 3}) || !reflect.DeepEqual(doc.Existing, []int{4}) {
+		t.Errorf("unexpected slices: %v, %v", doc.Ints, doc.Existing)
+	}
+	if !reflect.DeepEqual(doc.Limits, map[string]int{"cpu": 2}) {
+		t.Errorf("unexpected map: %v", doc.Limits)
+	}
+	if doc.Log != (defaultsSubConfig{Level: "info", Path: "/tmp"}) {
+		t.Errorf("unexpected struct: %+v", doc.Log)
+	}
+	if doc.Date != (LocalDate{1979, 5, 27}) || !doc.Time.Equal(time.Date(1979, 5, 27, 7, 32, 0, 0, time.UTC)) {
+		t.Errorf("unexpected dates: %v, %v", doc.Date, doc.Time)
+	}
+	if doc.Timeout != 5*time.Minute || doc.Ratio != 1 || *doc.Number != 3 || doc.Text != "A B" {
+		t.Errorf("unexpected values: %v, %v, %v, %q", doc.Timeout, doc.Ratio, *doc.Number, doc.Text)
+	}
+
+	var invalid struct {
+		Ints []int `default:"[1, true]"`
+	}
+	err = Unmarshal([]byte(""), &invalid)
+	if err == nil || !strings.HasPrefix(err.Error(), `invalid default value "[1, true]": `) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+type textUnmarshalerDefault string
+
+func (t *textUnmarshalerDefault) UnmarshalText(text []byte) error {
+	*t = textUnmarshalerDefault(strings.ToUpper(string(text)))
+	return nil
+}
+
+func TestUnmarshalDefaulter(t *testing.T) {
+	var doc struct {
+		Log  defaultsSubConfig   `toml:"log"`
+		Logs []defaultsSubConfig `toml:"logs"`
+	}
+	err := Unmarshal([]byte("[[logs]]\npath = \"a\"\n[[logs]]\nlevel = \"warn\""), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []defaultsSubConfig{{Level: "info", Path: "a"}, {Level: "warn", Path: "/var/log"}}
+	if doc.Log != (defaultsSubConfig{Level: "info", Path: "/var/log"}) || !reflect.DeepEqual(doc.Logs, expected) {
+		t.Errorf("unexpected values: %+v", doc)
+	}
+}
+
+func TestEncoderCommentDefaults(t *testing.T) {
+	type config struct {
+		Name    string            `toml:"name" comment:"application name"`
+		Port    int               `toml:"port" default:"8080" comment:"listen port"`
+		Tags    []string          `toml:"tags" default:"[\"a\", \"b\"]"`
+		Timeout time.Duration     `toml:"timeout" default:"5m"`
+		Log     defaultsSubConfig `toml:"log"`
+		Limits  map[string]int    `toml:"limits" default:"{ cpu = 2 }"`
+	}
+
+	var buf bytes.Buffer
+	v := config{Name: "app", Port: 8080, Tags: []string{"c"}}
+	if err := NewEncoder(&buf).CommentDefaults(true).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+# application name
+name = "app"
+
+# listen port
+# port = 8080
+tags = ["c"]
+# timeout = "5m0s"
+
+# [limits]
+  # cpu = 2
+
+[log]
+  # level = "info"
+  path = ""
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n-----\n%s\n-----\ngot\n-----\n%s\n-----\n", expected, buf.String())
+	}
+
+	var decoded config
+	if err := Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Port != 8080 || decoded.Timeout != 5*time.Minute || decoded.Log.Level != "info" || decoded.Limits["cpu"] != 2 {
+		t.Errorf("unexpected decoded value: %+v", decoded)
+	}
+
+	var invalid struct {
+		Port int `default:"x"`
+	}
+	_, err := NewEncoder(nil).CommentDefaults(true).marshal(invalid)
+	if err == nil || err.Error() != `field Port: invalid default value "x": Can't convert x(string) to int` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestUnmarshalEnv(t *testing.T) {
+	type Database struct {
+		Host string `toml:"host" env:"DB_HOST"`
+		Port int    `toml:"port" env:"DB_PORT"`
+	}
+	type config struct {
+		Name      string        `toml:"name" env:"NAME"`
+		Debug     bool          `toml:"debug" default:"false" env:"DEBUG"`
+		Timeout   time.Duration `toml:"timeout" env:"TIMEOUT"`
+		Ports     []int         `toml:"ports" env:"PORTS"`
+		Tags      []string      `toml:"tags" env:"TAGS"`
+		Ratio     *float64      `toml:"ratio" env:"RATIO"`
+		Untouched string        `toml:"untouched" env:"UNSET"`
+		Database  Database      `toml:"database"`
+	}
+
+	env := map[string]string{
+		"NAME":    "42",
+		"DEBUG":   "true",
+		"TIMEOUT": "5m",
+		"PORTS":   "[80, 443]",
+		"TAGS":    `["a", "b"]`,
+		"RATIO":   "0.5",
+		"DB_PORT": "5432",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	var cfg config
+	err := NewDecoder(strings.NewReader(`
+name = "app"
+untouched = "kept"
+
+[database]
+host = "localhost"
+port = 3306
+`)).LookupEnv(lookup).Decode(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ratio := 0.5
+	expected := config{
+		Name:      "42",
+		Debug:     true,
+		Timeout:   5 * time.Minute,
+		Ports:     []int{80, 443},
+		Tags:      []string{"a", "b"},
+		Ratio:     &ratio,
+		Untouched: "kept",
+		Database:  Database{Host: "localhost", Port: 5432},
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("Bad unmarshal: expected %+v, got %+v", expected, cfg)
+	}
+
+	env["DB_PORT"] = "not a number"
+	err = NewDecoder(strings.NewReader("")).LookupEnv(lookup).Decode(&cfg)
+	if err == nil || err.Error() != "environment variable DB_PORT: Can't convert not a number(string) to int" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
 func TestMarshalNestedAnonymousStructs(t *testing.T) {
 	type Embedded struct {
 		Value string `toml:"value"`
@@ -4119,3 +4324,913 @@ ErrorField = "foo"
 		t.Fatalf("error was expected")
 	}
 }
+
+type quantity struct {
+	Value int64
+	Unit  string
+}
+
+func (q *quantity) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case int64:
+		q.Value = v
+	case string:
+		_, err := fmt.Sscanf(v, "%d%s", &q.Value, &q.Unit)
+		return err
+	default:
+		return fmt.Errorf("invalid quantity: %v", v)
+	}
+	return nil
+}
+
+func (q quantity) MarshalTOML() ([]byte, error) {
+	if q.Unit == "" {
+		return []byte(strconv.FormatInt(q.Value, 10)), nil
+	}
+	return []byte(fmt.Sprintf(`"%d%s"`, q.Value, q.Unit)), nil
+}
+
+type portList []int
+
+func (l *portList) UnmarshalTOML(v interface{}) error {
+	array, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("invalid port list: %v", v)
+	}
+	for _, item := range array {
+		*l = append(*l, int(item.(int64))+1)
+	}
+	return nil
+}
+
+type selector struct {
+	labels map[string]string
+}
+
+func (s *selector) UnmarshalTOML(v interface{}) error {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("invalid selector: %v", v)
+	}
+	s.labels = make(map[string]string)
+	for k, v := range m {
+		s.labels[k] = fmt.Sprint(v)
+	}
+	return nil
+}
+
+func (s selector) MarshalTOML() ([]byte, error) {
+	var buf bytes.Buffer
+	keys := make([]string, 0, len(s.labels))
+	for k := range s.labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s = %q\n", k, s.labels[k])
+	}
+	return buf.Bytes(), nil
+}
+
+type nestedCodecs struct {
+	Limits struct {
+		Memory  quantity            `toml:"memory"`
+		CPU     *quantity           `toml:"cpu"`
+		Quotas  []quantity          `toml:"quotas"`
+		ByTeam  map[string]quantity `toml:"by_team"`
+		Ports   portList            `toml:"ports"`
+		Matcher selector            `toml:"matcher"`
+	} `toml:"limits"`
+	Selectors []selector `toml:"selectors"`
+}
+
+func TestNestedUnmarshaler(t *testing.T) {
+	doc := []byte(`
+[limits]
+memory = "512Mi"
+cpu = 2
+quotas = [1, "10Gi"]
+by_team = { a = "1k", b = 2 }
+ports = [80, 442]
+
+[limits.matcher]
+app = "web"
+tier = 1
+
+[[selectors]]
+app = "api"
+
+[[selectors]]
+app = "db"
+`)
+
+	var v nestedCodecs
+	if err := Unmarshal(doc, &v); err != nil {
+		t.Fatal(err)
+	}
+	limits := v.Limits
+	if limits.Memory != (quantity{512, "Mi"}) || *limits.CPU != (quantity{Value: 2}) {
+		t.Errorf("unexpected quantities: %+v, %+v", limits.Memory, limits.CPU)
+	}
+	if !reflect.DeepEqual(limits.Quotas, []quantity{{Value: 1}, {10, "Gi"}}) {
+		t.Errorf("unexpected quotas: %+v", limits.Quotas)
+	}
+	if !reflect.DeepEqual(limits.ByTeam, map[string]quantity{"a": {1, "k"}, "b": {Value: 2}}) {
+		t.Errorf("unexpected quotas by team: %+v", limits.ByTeam)
+	}
+	if !reflect.DeepEqual(limits.Ports, portList{81, 443}) {
+		t.Errorf("unexpected ports: %v", limits.Ports)
+	}
+	if !reflect.DeepEqual(limits.Matcher.labels, map[string]string{"app": "web", "tier": "1"}) {
+		t.Errorf("unexpected matcher: %v", limits.Matcher.labels)
+	}
+	if len(v.Selectors) != 2 || v.Selectors[1].labels["app"] != "db" {
+		t.Errorf("unexpected selectors: %v", v.Selectors)
+	}
+
+	var strict nestedCodecs
+	if err := NewDecoder(bytes.NewReader(doc)).Strict(true).Decode(&strict); err != nil {
+		t.Errorf("strict decoding: %s", err)
+	}
+
+	err := Unmarshal([]byte("[limits]\nmemory = true"), &v)
+	if err == nil || err.Error() != "(2, 1): unmarshal toml: invalid quantity: true" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNestedMarshaler(t *testing.T) {
+	var v nestedCodecs
+	v.Limits.Memory = quantity{512, "Mi"}
+	v.Limits.CPU = &quantity{Value: 2}
+	v.Limits.Quotas = []quantity{{Value: 1}, {10, "Gi"}}
+	v.Limits.Matcher = selector{map[string]string{"app": "web"}}
+	v.Selectors = []selector{
+		{map[string]string{"app": "api"}},
+		{map[string]string{"app": "db", "tier": "2"}},
+	}
+
+	result, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+[limits]
+  cpu = 2
+  memory = "512Mi"
+  ports = []
+  quotas = [1, "10Gi"]
+
+  [limits.by_team]
+
+  [limits.matcher]
+    app = "web"
+
+[[selectors]]
+  app = "api"
+
+[[selectors]]
+  app = "db"
+  tier = "2"
+`
+	if string(result) != expected {
+		t.Errorf("expected\n-----\n%s\n-----\ngot\n-----\n%s\n-----\n", expected, result)
+	}
+
+	var decoded nestedCodecs
+	if err := Unmarshal(result, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Limits.Memory != v.Limits.Memory || !reflect.DeepEqual(decoded.Selectors, v.Selectors) {
+		t.Errorf("unexpected round trip: %+v", decoded)
+	}
+
+	_, err = Marshal(struct {
+		Q quantity `toml:"q"`
+	}{quantity{1, "x\"y"}})
+	if err == nil || !strings.HasPrefix(err.Error(), "invalid TOML returned by MarshalTOML of toml.quantity") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+type locatedPort struct {
+	Port int
+	Path string
+	Pos  Position
+}
+
+func (p *locatedPort) UnmarshalTOMLValue(node interface{}, ctx DecodeContext) error {
+	v, ok := node.(*PubTOMLValue)
+	if !ok {
+		return ctx.Errorf("port must be a value")
+	}
+	n, ok := v.Value().(int64)
+	if !ok || n <= 0 || n > 65535 {
+		return ctx.Errorf("invalid port %v", v.Value())
+	}
+	p.Port, p.Path, p.Pos = int(n), ctx.Path().String(), ctx.Position()
+	return nil
+}
+
+type locatedServer struct {
+	Host string
+	Port locatedPort
+	Path string
+}
+
+func (s *locatedServer) UnmarshalTOMLValue(node interface{}, ctx DecodeContext) error {
+	tree, ok := node.(*Tree)
+	if !ok {
+		return ctx.Errorf("server must be a table")
+	}
+	var fields struct {
+		Host string      `toml:"host"`
+		Port locatedPort `toml:"port"`
+	}
+	if err := ctx.Decode(tree, &fields); err != nil {
+		return err
+	}
+	s.Host, s.Port, s.Path = fields.Host, fields.Port, ctx.Path().String()
+	return nil
+}
+
+func TestValueUnmarshaler(t *testing.T) {
+	doc := `
+admin = 9000
+
+[[servers]]
+host = "alpha"
+port = 80
+
+["backup servers".main]
+host = "beta"
+port = 8080
+`
+	var v struct {
+		Admin   locatedPort              `toml:"admin"`
+		Servers []locatedServer          `toml:"servers"`
+		Backup  map[string]locatedServer `toml:"backup servers"`
+	}
+	if err := Unmarshal([]byte(doc), &v); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := locatedPort{Port: 9000, Path: "admin", Pos: Position{Line: 2, Col: 1}}
+	if v.Admin != expected {
+		t.Errorf("expected %+v, got %+v", expected, v.Admin)
+	}
+	expected = locatedPort{Port: 80, Path: "servers.0.port", Pos: Position{Line: 6, Col: 1}}
+	if len(v.Servers) != 1 || v.Servers[0].Host != "alpha" || v.Servers[0].Path != "servers.0" || v.Servers[0].Port != expected {
+		t.Errorf("unexpected servers: %+v", v.Servers)
+	}
+	expected = locatedPort{Port: 8080, Path: `"backup servers".main.port`, Pos: Position{Line: 10, Col: 1}}
+	if main := v.Backup["main"]; main.Host != "beta" || main.Path != `"backup servers".main` || main.Port != expected {
+		t.Errorf("unexpected backup servers: %+v", v.Backup)
+	}
+}
+
+func TestValueUnmarshalerErrors(t *testing.T) {
+	tests := []struct {
+		doc string
+		err string
+	}{
+		{"admin = 0", "config.toml:(1, 1): invalid port 0"},
+		{"admin = [1]", "config.toml:(1, 1): invalid port [1]"},
+		{"[admin]\nport = 80", "config.toml:(1, 1): port must be a value"},
+		{"[[servers]]\nhost = \"alpha\"\nport = 70000", "config.toml:(3, 1): invalid port 70000"},
+		{"[[servers]]\nhost = 1", "config.toml:(2, 1): Can't convert 1(int64) to string"},
+		{"servers = [1]", "config.toml:(1, 1): server must be a table"},
+	}
+
+	for _, test := range tests {
+		tree, err := LoadReaderNamed(strings.NewReader(test.doc), "config.toml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v struct {
+			Admin   locatedPort     `toml:"admin"`
+			Servers []locatedServer `toml:"servers"`
+		}
+		err = tree.Unmarshal(&v)
+		if err == nil {
+			t.Errorf("%q: expected error %q, got none", test.doc, test.err)
+			continue
+		}
+		if err.Error() != test.err {
+			t.Errorf("%q: expected error %q, got %q", test.doc, test.err, err.Error())
+		}
+	}
+}
+
+// Returns the errors of its fields as plain text, positions included.
+type flattenedServer struct {
+	Port locatedPort
+}
+
+func (s *flattenedServer) UnmarshalTOMLValue(node interface{}, ctx DecodeContext) error {
+	var fields struct {
+		Port locatedPort `toml:"port"`
+	}
+	if err := ctx.Decode(node, &fields); err != nil {
+		return fmt.Errorf("%v", err)
+	}
+	s.Port = fields.Port
+	return nil
+}
+
+func TestValueUnmarshalerPositionedErrorText(t *testing.T) {
+	for _, name := range []string{"", "config.toml"} {
+		tree, err := LoadReaderNamed(strings.NewReader("[server]\n\nport = 0"), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v struct {
+			Server flattenedServer `toml:"server"`
+		}
+		err = tree.Unmarshal(&v)
+		expected := Source{Filename: name, Position: Position{Line: 3, Col: 1}}.String() + ": invalid port 0"
+		if err == nil || err.Error() != expected {
+			t.Errorf("expected error %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestDecoderHook(t *testing.T) {
+	doc := `
+mode = "legacy"
+tags = "a, b,c"
+
+[cache]
+size = "10MiB"
+sizes = ["1KiB", 2048]
+endpoint = "localhost:6379"
+`
+	type cache struct {
+		Size     int64             `toml:"size"`
+		Sizes    []int             `toml:"sizes"`
+		Endpoint map[string]string `toml:"endpoint"`
+	}
+	var v struct {
+		Mode  string   `toml:"mode"`
+		Tags  []string `toml:"tags"`
+		Cache *cache   `toml:"cache"`
+	}
+
+	var paths []string
+	sizes := map[string]int64{"KiB": 1 << 10, "MiB": 1 << 20}
+	err := NewDecoder(strings.NewReader(doc)).
+		Hook(func(from, to reflect.Type, value interface{}, path KeyPath) (interface{}, error) {
+			paths = append(paths, fmt.Sprintf("%s:%v>%v", path, from, to))
+			if value == "legacy" {
+				return "compat", nil
+			}
+			return value, nil
+		}).
+		Hook(func(from, to reflect.Type, value interface{}, path KeyPath) (interface{}, error) {
+			s, ok := value.(string)
+			if !ok {
+				return value, nil
+			}
+			switch {
+			case to == reflect.TypeOf([]string{}):
+				tags := strings.Split(s, ",")
+				for i := range tags {
+					tags[i] = strings.TrimSpace(tags[i])
+				}
+				return tags, nil
+			case to.Kind() == reflect.Int64 || to.Kind() == reflect.Int:
+				for unit, size := range sizes {
+					if strings.HasSuffix(s, unit) {
+						n, err := strconv.ParseInt(strings.TrimSuffix(s, unit), 10, 64)
+						return n * size, err
+					}
+				}
+			case to.Kind() == reflect.Map:
+				parts := strings.SplitN(s, ":", 2)
+				return map[string]interface{}{"host": parts[0], "port": parts[1]}, nil
+			}
+			return value, nil
+		}).
+		Decode(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.Mode != "compat" || !reflect.DeepEqual(v.Tags, []string{"a", "b", "c"}) {
+		t.Errorf("unexpected values: %+v", v)
+	}
+	if v.Cache.Size != 10<<20 || !reflect.DeepEqual(v.Cache.Sizes, []int{1024, 2048}) {
+		t.Errorf("unexpected cache: %+v", v.Cache)
+	}
+	if !reflect.DeepEqual(v.Cache.Endpoint, map[string]string{"host": "localhost", "port": "6379"}) {
+		t.Errorf("unexpected endpoint: %v", v.Cache.Endpoint)
+	}
+	for _, expected := range []string{
+		"mode:string>string",
+		"cache:*toml.Tree>toml.cache",
+		"cache.sizes:[]interface {}>[]int",
+		"cache.sizes.1:int64>int",
+	} {
+		found := false
+		for _, path := range paths {
+			found = found || path == expected
+		}
+		if !found {
+			t.Errorf("hook not called with %s: %v", expected, paths)
+		}
+	}
+
+	err = NewDecoder(strings.NewReader(doc)).
+		Hook(func(from, to reflect.Type, value interface{}, path KeyPath) (interface{}, error) {
+			if path.String() == "cache.size" {
+				return nil, errors.New("invalid size")
+			}
+			return value, nil
+		}).
+		Decode(&map[string]interface{}{})
+	if err == nil || err.Error() != "(6, 1): invalid size" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMarshalInlineTables(t *testing.T) {
+	type point struct {
+		X int `toml:"x"`
+		Y int `toml:"y"`
+	}
+	type shape struct {
+		Name   string           `toml:"name"`
+		Origin point            `toml:"origin,inline" comment:"top left corner"`
+		Points []point          `toml:"points,inline"`
+		Labels map[string]point `toml:"labels"`
+		Style  struct {
+			Color string   `toml:"color"`
+			Dash  []int    `toml:"dash"`
+			Size  struct{} `toml:"size"`
+		} `toml:"style"`
+	}
+	v := shape{
+		Name:   "square",
+		Origin: point{1, 2},
+		Points: []point{{1, 2}, {3, 4}},
+		Labels: map[string]point{"a": {5, 6}},
+	}
+	v.Style.Color = "red"
+	v.Style.Dash = []int{1}
+
+	result, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `name = "square"
+
+# top left corner
+origin = { x = 1, y = 2 }
+points = [{ x = 1, y = 2 }, { x = 3, y = 4 }]
+
+[labels]
+
+  [labels.a]
+    x = 5
+    y = 6
+
+[style]
+  color = "red"
+  dash = [1]
+
+  [style.size]
+`
+	if string(result) != expected {
+		t.Errorf("expected\n-----\n%s\n-----\ngot\n-----\n%s\n-----\n", expected, result)
+	}
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).InlineTables(2).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	expected = `name = "square"
+
+# top left corner
+origin = { x = 1, y = 2 }
+points = [{ x = 1, y = 2 }, { x = 3, y = 4 }]
+
+[labels]
+  a = { x = 5, y = 6 }
+
+[style]
+  color = "red"
+  dash = [1]
+  size = {}
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n-----\n%s\n-----\ngot\n-----\n%s\n-----\n", expected, buf.String())
+	}
+
+	var decoded shape
+	if err := Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, v) {
+		t.Errorf("expected %+v, got %+v", v, decoded)
+	}
+}
+
+func TestMarshalTableStyle(t *testing.T) {
+	type variety struct {
+		Name string `toml:"name"`
+		Info struct {
+			Origin string `toml:"origin"`
+		} `toml:"info"`
+	}
+	type fruit struct {
+		Name     string `toml:"name"`
+		Physical struct {
+			Color string   `toml:"color" comment:"skin color"`
+			Shape string   `toml:"the shape"`
+			Size  struct{} `toml:"size"`
+		} `toml:"physical"`
+		Varieties []variety `toml:"varieties"`
+	}
+	type basket struct {
+		Owner string `toml:"owner"`
+		Fruit fruit  `toml:"fruit"`
+	}
+	v := basket{Owner: "me", Fruit: fruit{Name: "apple"}}
+	v.Fruit.Physical.Color = "red"
+	v.Fruit.Physical.Shape = "round"
+	v.Fruit.Varieties = []variety{{Name: "gala"}}
+	v.Fruit.Varieties[0].Info.Origin = "nz"
+
+	tests := []struct {
+		style    TableStyle
+		depth    int
+		expected string
+	}{
+		{TableDottedKeys, 0, `owner = "me"
+fruit.name = "apple"
+
+# skin color
+fruit.physical.color = "red"
+fruit.physical."the shape" = "round"
+fruit.physical.size = {}
+
+[[fruit.varieties]]
+  name = "gala"
+  info.origin = "nz"
+`},
+		{TableMixed, 1, `owner = "me"
+
+[fruit]
+  name = "apple"
+
+  # skin color
+  physical.color = "red"
+  physical."the shape" = "round"
+  physical.size = {}
+
+  [[fruit.varieties]]
+    name = "gala"
+    info.origin = "nz"
+`},
+		{TableMixed, 2, `owner = "me"
+
+[fruit]
+  name = "apple"
+
+  [fruit.physical]
+
+    # skin color
+    color = "red"
+    "the shape" = "round"
+    size = {}
+
+  [[fruit.varieties]]
+    name = "gala"
+    info.origin = "nz"
+`},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf).TableStyle(test.style, test.depth).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("style %d, depth %d: expected\n-----\n%s\n-----\ngot\n-----\n%s\n-----\n", test.style, test.depth, test.expected, buf.String())
+		}
+
+		var decoded basket
+		if err := Unmarshal(buf.Bytes(), &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, v) {
+			t.Errorf("expected %+v, got %+v", v, decoded)
+		}
+	}
+}
+
+func TestMarshalMaxLineWidth(t *testing.T) {
+	type point struct {
+		X int `toml:"x"`
+		Y int `toml:"y"`
+	}
+	type config struct {
+		Short  []int    `toml:"short"`
+		Long   []string `toml:"long"`
+		Nested [][]int  `toml:"nested"`
+		Points []point  `toml:"points,inline"`
+		Origin point    `toml:"origin,inline"`
+		Wide   point    `toml:"wide,inline" width:"20"`
+		Keep   []int    `toml:"keep" width:"0"`
+	}
+	v := config{
+		Short:  []int{1, 2},
+		Long:   []string{"alpha", "beta", "gamma", "delta"},
+		Nested: [][]int{{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, {1}},
+		Points: []point{{1, 2}, {3, 4}},
+		Origin: point{1, 2},
+		Wide:   point{10, 20},
+		Keep:   []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+	}
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).MaxLineWidth(30).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	expected := `keep = [1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12]
+long = [
+  "alpha",
+  "beta",
+  "gamma",
+  "delta",
+]
+nested = [
+  [
+    1,
+    2,
+    3,
+    4,
+    5,
+    6,
+    7,
+    8,
+    9,
+    10,
+  ],
+  [1],
+]
+origin = { x = 1, y = 2 }
+points = [
+  { x = 1, y = 2 },
+  { x = 3, y = 4 },
+]
+short = [1, 2]
+
+[wide]
+  x = 10
+  y = 20
+`
+	if buf.String() != expected {
+		t.Errorf("expected\n-----\n%s\n-----\ngot\n-----\n%s\n-----\n", expected, buf.String())
+	}
+
+	var decoded config
+	if err := Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, v) {
+		t.Errorf("expected %+v, got %+v", v, decoded)
+	}
+
+	buf.Reset()
+	if err := NewEncoder(&buf).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\n[wide]\n") || !strings.Contains(buf.String(), "\nlong = [\"alpha\", \"beta\", \"gamma\", \"delta\"]\n") {
+		t.Errorf("expected only the field with a width tag to be wrapped, got\n%s", buf.String())
+	}
+}
+
+func TestMarshalAlign(t *testing.T) {
+	type server struct {
+		Host    string `toml:"host" comment:"address"`
+		Port    int    `toml:"port"`
+		Timeout int    `toml:"timeout" commented:"true"`
+		Name    string `toml:"name" comment:"shown to users\nin the list"`
+		ID      int    `toml:"id"`
+	}
+	type config struct {
+		Title   string `toml:"title"`
+		Version int    `toml:"version" comment:"format"`
+		Server  server `toml:"server"`
+	}
+	v := config{"app", 2, server{"localhost", 80, 30, "main", 1}}
+
+	tests := []struct {
+		comments bool
+		expected string
+	}{
+		{false, `title = "app"
+
+# format
+version = 2
+
+[server]
+
+    # address
+    host      = "localhost"
+    port      = 80
+    # timeout = 30
+
+    # shown to users
+    #in the list
+    name = "main"
+    id   = 1
+`},
+		{true, `title = "app"
+
+# format
+version = 2
+
+[server]
+
+    # address
+    host      = "localhost"
+    port      = 80
+    # timeout = 30
+
+    # shown to users
+    #in the list
+    name = "main"
+    id   = 1
+`},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err := NewEncoder(&buf).Order(OrderPreserve).Indentation("    ").AlignEquals(true).AlignComments(test.comments).Encode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("expected\n-----\n%s\n-----\ngot\n-----\n%s\n-----\n", test.expected, buf.String())
+		}
+
+		var decoded config
+		if err := Unmarshal(buf.Bytes(), &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Title != v.Title || decoded.Server.Host != v.Server.Host || decoded.Server.ID != v.Server.ID {
+			t.Errorf("expected %+v, got %+v", v, decoded)
+		}
+	}
+}
+
+type streamedLabel string
+
+func (l streamedLabel) MarshalText() ([]byte, error) {
+	if l == "" {
+		return nil, errors.New("empty label")
+	}
+	return []byte(l), nil
+}
+
+type streamedEntry struct {
+	Name   string            `toml:"name" comment:"entry name"`
+	Label  streamedLabel     `toml:"label"`
+	Ports  []int             `toml:"ports" width:"12"`
+	Tags   map[string]string `toml:"tags"`
+	Checks []struct {
+		Path string `toml:"path"`
+	} `toml:"checks"`
+}
+
+type streamedAlias struct {
+	Name string `toml:"name"`
+}
+
+type streamedConfig struct {
+	Title    string                     `toml:"title"`
+	Aliases  []streamedAlias            `toml:"aliases"`
+	Entries  []streamedEntry            `toml:"entries"`
+	Disabled []streamedEntry            `toml:"disabled" commented:"true"`
+	Groups   map[string][]streamedEntry `toml:"groups"`
+	Version  int                        `toml:"version"`
+}
+
+func TestEncoderStreamsLikeMarshal(t *testing.T) {
+	entry := func(i int) streamedEntry {
+		e := streamedEntry{
+			Name:  fmt.Sprintf("entry%d", i),
+			Label: streamedLabel(fmt.Sprintf("l%d", i)),
+			Ports: []int{80, 443, 8080},
+			Tags:  map[string]string{"env": "prod"},
+		}
+		e.Checks = append(e.Checks, struct {
+			Path string `toml:"path"`
+		}{"/health"})
+		return e
+	}
+	v := streamedConfig{
+		Title:    "streamed",
+		Aliases:  []streamedAlias{{"a"}, {"b"}},
+		Entries:  []streamedEntry{entry(1), entry(2), entry(3)},
+		Disabled: []streamedEntry{entry(4)},
+		Groups:   map[string][]streamedEntry{"a": {entry(5)}, "b": {entry(6), entry(7)}},
+		Version:  2,
+	}
+
+	encoders := []func(*Encoder) *Encoder{
+		func(e *Encoder) *Encoder { return e },
+		func(e *Encoder) *Encoder { return e.Order(OrderPreserve) },
+		func(e *Encoder) *Encoder { return e.TableStyle(TableDottedKeys, 0) },
+		func(e *Encoder) *Encoder { return e.TableStyle(TableMixed, 1).AlignEquals(true).AlignComments(true) },
+		func(e *Encoder) *Encoder { return e.InlineTables(1).Indentation("\t") },
+		func(e *Encoder) *Encoder {
+			return e.InlineTables(8).RegisterEncoder(reflect.TypeOf(streamedLabel("")), upperLabel)
+		},
+		func(e *Encoder) *Encoder {
+			return e.FormatOptions(FormatOptions{TableSpacing: 2, CRLF: true}).ArraysWithOneElementPerLine(true)
+		},
+	}
+	for i, setup := range encoders {
+		marshaled, err := setup(NewEncoder(nil)).marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := setup(NewEncoder(&buf)).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != string(marshaled) {
+			t.Errorf("%d: expected\n-----\n%s\n-----\ngot\n-----\n%s\n-----\n", i, marshaled, buf.String())
+		}
+	}
+}
+
+func upperLabel(v interface{}) (interface{}, error) {
+	if v.(streamedLabel) == "" {
+		return nil, errors.New("empty label")
+	}
+	return strings.ToUpper(string(v.(streamedLabel))), nil
+}
+
+func TestEncoderStreamsArraysOfTables(t *testing.T) {
+	v := streamedConfig{Entries: make([]streamedEntry, 5000)}
+	for i := range v.Entries[:4999] {
+		v.Entries[i].Label = "ok"
+	}
+
+	encoders := []func(*Encoder) *Encoder{
+		func(e *Encoder) *Encoder { return e },
+		func(e *Encoder) *Encoder { return e.InlineTables(8) },
+		func(e *Encoder) *Encoder { return e.RegisterEncoder(reflect.TypeOf(streamedLabel("")), upperLabel) },
+	}
+	for i, setup := range encoders {
+		var buf bytes.Buffer
+		err := setup(NewEncoder(&buf)).Encode(v)
+		if err == nil || !strings.Contains(err.Error(), "empty label") {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if n := strings.Count(buf.String(), "[[entries]]"); n != 4999 {
+			t.Errorf("%d: expected the tables before the error to be written, got %d", i, n)
+		}
+	}
+}
+
+type streamedPort int
+
+func (p streamedPort) MarshalTOML() ([]byte, error) {
+	if p == 0 {
+		return nil, errors.New("no port")
+	}
+	return []byte(strconv.Itoa(int(p))), nil
+}
+
+func TestEncoderPartialOutput(t *testing.T) {
+	type server struct {
+		Name string       `toml:"name"`
+		Port streamedPort `toml:"port"`
+	}
+	type config struct {
+		Title   string   `toml:"title"`
+		Servers []server `toml:"servers"`
+	}
+	v := config{Title: "partial", Servers: []server{{"a", 80}, {"b", 443}, {"c", 0}, {"d", 8080}}}
+
+	var buf bytes.Buffer
+	err := NewEncoder(&buf).Encode(v)
+	if err == nil || !strings.Contains(err.Error(), "no port") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	marshaled, err := Marshal(config{Title: v.Title, Servers: v.Servers[:2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The separator following the last table is not written.
+	expected := strings.TrimSuffix(string(marshaled), "\n")
+	if buf.String() != expected {
+		t.Errorf("expected\n-----\n%s\n-----\ngot\n-----\n%s\n-----\n", expected, buf.String())
+	}
+	if _, err := LoadBytes(buf.Bytes()); err != nil {
+		t.Errorf("partial output is not well-formed: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+// Metadata about the keys of decoded documents.
+
+package toml
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Key is a key of a document, and the position where it is defined. Filename
+// is the file defining the key, if any.
+type Key struct {
+	Path     KeyPath
+	Position Position
+	Filename string
+}
+
+// MetaData describes how a document was decoded by
+// Decoder.DecodeWithMetadata.
+type MetaData struct {
+	tree      *Tree
+	undecoded []Key
+	defaulted []KeyPath
+}
+
+// DecodeWithMetadata is the same as Decode, but also returns metadata about the
+// keys of the document.
+func (d *Decoder) DecodeWithMetadata(v interface{}) (MetaData, error) {
+	var err error
+	d.tval, err = LoadReader(d.r)
+	if err != nil {
+		return MetaData{}, err
+	}
+	d.metadata = true
+	defer func() {
+		d.metadata = false
+	}()
+	if err := d.unmarshal(v); err != nil {
+		return MetaData{}, err
+	}
+	return MetaData{
+		tree:      d.tval,
+		undecoded: d.visitor.undecoded(),
+		defaulted: d.defaulted,
+	}, nil
+}
+
+// Keys returns all the keys of the document, in the order they are defined:
+// tables, arrays of tables and their elements, and values.
+func (m MetaData) Keys() []Key {
+	var keys []Key
+	if m.tree != nil {
+		keys = appendKeys(keys, nil, m.tree)
+	}
+	sortKeys(keys)
+	return keys
+}
+
+func appendKeys(keys []Key, path KeyPath, tree *Tree) []Key {
+	for k, v := range tree.values {
+		keyPath := append(path[:len(path):len(path)], k)
+		switch node := v.(type) {
+		case *Tree:
+			keys = append(keys, Key{Path: keyPath, Position: node.position, Filename: node.filename})
+			keys = appendKeys(keys, keyPath, node)
+		case []*Tree:
+			if len(node) > 0 {
+				keys = append(keys, Key{Path: keyPath, Position: node[0].position, Filename: node[0].filename})
+			}
+			for i, item := range node {
+				itemPath := append(keyPath[:len(keyPath):len(keyPath)], strconv.Itoa(i))
+				keys = append(keys, Key{Path: itemPath, Position: item.position, Filename: item.filename})
+				keys = appendKeys(keys, itemPath, item)
+			}
+		case *tomlValue:
+			keys = append(keys, Key{Path: keyPath, Position: node.position, Filename: node.filename})
+		}
+	}
+	return keys
+}
+
+func sortKeys(keys []Key) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Filename != keys[j].Filename {
+			return keys[i].Filename < keys[j].Filename
+		}
+		a, b := keys[i].Position, keys[j].Position
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		if a.Col != b.Col {
+			return a.Col < b.Col
+		}
+		return keys[i].Path.String() < keys[j].Path.String()
+	})
+}
+
+// IsDefined reports whether the key at path is defined in the document.
+// Elements of arrays of tables are designated by their index.
+func (m MetaData) IsDefined(path ...string) bool {
+	return m.node(path) != nil
+}
+
+// Undecoded returns the values of the document that were not decoded into a
+// field or map entry, in the order they are defined.
+func (m MetaData) Undecoded() []Key {
+	return m.undecoded
+}
+
+// Defaulted returns the paths of the struct fields that were set from their
+// default tag, because the document does not define them.
+func (m MetaData) Defaulted() []KeyPath {
+	return m.defaulted
+}
+
+// Type returns the TOML type of the key at path: "String", "Integer",
+// "Float", "Boolean", "Offset Date-Time", "Local Date-Time", "Local Date",
+// "Local Time", "Array", "Table", "Inline Table" or "Array of Tables". It
+// returns an empty string if the key is not defined.
+func (m MetaData) Type(path ...string) string {
+	switch node := m.node(path).(type) {
+	case *Tree:
+		if node.inline {
+			return "Inline Table"
+		}
+		return "Table"
+	case []*Tree:
+		return "Array of Tables"
+	case *tomlValue:
+		return tomlTypeName(node.value)
+	}
+	return ""
+}
+
+func tomlTypeName(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "String"
+	case int64, uint64:
+		return "Integer"
+	case float64:
+		return "Float"
+	case bool:
+		return "Boolean"
+	case time.Time:
+		return "Offset Date-Time"
+	case LocalDateTime:
+		return "Local Date-Time"
+	case LocalDate:
+		return "Local Date"
+	case LocalTime:
+		return "Local Time"
+	case *Tree:
+		return "Inline Table"
+	}
+	if reflect.ValueOf(v).Kind() == reflect.Slice {
+		return "Array"
+	}
+	return ""
+}
+
+// Returns the node of the document at path, or nil if there is none.
+func (m MetaData) node(path []string) interface{} {
+	if m.tree == nil || len(path) == 0 {
+		return nil
+	}
+	var node interface{} = m.tree
+	for _, key := range path {
+		switch n := node.(type) {
+		case *Tree:
+			node = n.values[key]
+		case []*Tree:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(n) {
+				return nil
+			}
+			node = n[i]
+		default:
+			return nil
+		}
+		if node == nil {
+			return nil
+		}
+	}
+	return node
+}
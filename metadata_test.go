@@ -0,0 +1,108 @@
+package toml
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeWithMetadata(t *testing.T) {
+	doc := `
+title = "app"
+unknown = 1
+point = { x = 1, y = 2 }
+
+[server]
+host = "localhost"
+"legacy option" = true
+
+[[plugins]]
+name = "a"
+
+[[plugins]]
+name = "b"
+enabled = false
+`
+	var v struct {
+		Title  string `toml:"title"`
+		Point  map[string]int
+		Server struct {
+			Host string `toml:"host"`
+			Port int    `toml:"port" default:"8080"`
+		} `toml:"server"`
+		Plugins []struct {
+			Name string `toml:"name"`
+		} `toml:"plugins"`
+		Log struct {
+			Level string `toml:"level" default:"info"`
+		} `toml:"log"`
+	}
+
+	md, err := NewDecoder(strings.NewReader(doc)).DecodeWithMetadata(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Server.Port != 8080 || v.Log.Level != "info" {
+		t.Errorf("unexpected values: %+v", v)
+	}
+
+	var keys []string
+	for _, key := range md.Keys() {
+		keys = append(keys, key.Path.String())
+	}
+	expected := []string{
+		"title", "unknown", "point", "point.x", "point.y",
+		"server", "server.host", `server."legacy option"`,
+		"plugins", "plugins.0", "plugins.0.name",
+		"plugins.1", "plugins.1.name", "plugins.1.enabled",
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %v, got %v", expected, keys)
+	}
+
+	undecoded := []Key{
+		{Path: KeyPath{"unknown"}, Position: Position{Line: 3, Col: 1}},
+		{Path: KeyPath{"server", "legacy option"}, Position: Position{Line: 8, Col: 1}},
+		{Path: KeyPath{"plugins", "1", "enabled"}, Position: Position{Line: 15, Col: 1}},
+	}
+	if !reflect.DeepEqual(md.Undecoded(), undecoded) {
+		t.Errorf("expected undecoded keys %v, got %v", undecoded, md.Undecoded())
+	}
+
+	defaulted := []KeyPath{{"server", "port"}, {"log", "level"}}
+	if !reflect.DeepEqual(md.Defaulted(), defaulted) {
+		t.Errorf("expected defaulted keys %v, got %v", defaulted, md.Defaulted())
+	}
+
+	if !md.IsDefined("server", "host") || !md.IsDefined("plugins", "1", "enabled") {
+		t.Error("expected keys to be defined")
+	}
+	if md.IsDefined("server", "port") || md.IsDefined("plugins", "2") || md.IsDefined() {
+		t.Error("expected keys not to be defined")
+	}
+
+	types := map[string][]string{
+		"String":          {"title"},
+		"Integer":         {"point", "x"},
+		"Boolean":         {"plugins", "1", "enabled"},
+		"Inline Table":    {"point"},
+		"Table":           {"server"},
+		"Array of Tables": {"plugins"},
+		"":                {"server", "port"},
+	}
+	for typ, path := range types {
+		if got := md.Type(path...); got != typ {
+			t.Errorf("type of %v: expected %q, got %q", path, typ, got)
+		}
+	}
+}
+
+func TestDecodeWithMetadataStrict(t *testing.T) {
+	var v struct {
+		A int `toml:"a"`
+	}
+	_, err := NewDecoder(strings.NewReader("a = 1\nb = 2")).Strict(true).DecodeWithMetadata(&v)
+	if err == nil || err.Error() != `undecoded keys: ["b"]` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
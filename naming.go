@@ -0,0 +1,111 @@
+// Mapping between the keys of documents and the names of struct fields.
+
+package toml
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// KeyMatcher reports whether the key of a document designates the struct field
+// named name.
+type KeyMatcher func(key, name string) bool
+
+// FieldNamer returns the key of the struct field named name.
+type FieldNamer func(name string) string
+
+// Built-in key matchers. Each of them mirrors a FieldNamer: MatchExact writes
+// the field names as is, MatchCaseInsensitive is satisfied by strings.ToLower,
+// MatchSnakeCase by SnakeCase and MatchKebabCase by KebabCase.
+var (
+	// MatchExact matches the keys equal to the field name.
+	MatchExact KeyMatcher = func(key, name string) bool {
+		return key == name
+	}
+	// MatchCaseInsensitive matches the keys equal to the field name, ignoring
+	// case.
+	MatchCaseInsensitive KeyMatcher = strings.EqualFold
+	// MatchSnakeCase matches the keys equal to the field name or to its
+	// snake_case form, such as host_name for HostName.
+	MatchSnakeCase KeyMatcher = func(key, name string) bool {
+		return key == name || key == SnakeCase(name)
+	}
+	// MatchKebabCase matches the keys equal to the field name or to its
+	// kebab-case form, such as host-name for HostName.
+	MatchKebabCase KeyMatcher = func(key, name string) bool {
+		return key == name || key == KebabCase(name)
+	}
+)
+
+// SnakeCase returns the snake_case form of a CamelCase name, such as
+// http_server for HTTPServer.
+func SnakeCase(name string) string {
+	return splitWords(name, '_')
+}
+
+// KebabCase returns the kebab-case form of a CamelCase name, such as
+// http-server for HTTPServer.
+func KebabCase(name string) string {
+	return splitWords(name, '-')
+}
+
+// Lowercases name, separating its words with sep. A word starts at an
+// uppercase letter following a lowercase letter or a digit, or at the last
+// uppercase letter of an acronym followed by a lowercase letter.
+func splitWords(name string, sep rune) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteRune(sep)
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// KeyMatcher sets the function matching the keys of documents to the names of
+// struct fields that do not have a name in their toml tag. Those fields match
+// their key exactly. If several keys match a field, the one equal to its name
+// is decoded, or else the first one in lexical order.
+//
+// By default, a field matches the keys equal to its name, to its name in lower
+// case or upper case, or to its name with a lower case first letter.
+func (d *Decoder) KeyMatcher(m KeyMatcher) *Decoder {
+	d.keyMatcher = m
+	return d
+}
+
+// FieldNamer sets the function naming the keys of struct fields that do not
+// have a name in their toml tag, such as SnakeCase. By default, the keys are
+// the names of the fields.
+func (e *Encoder) FieldNamer(n FieldNamer) *Encoder {
+	e.fieldNamer = n
+	return e
+}
+
+// Returns the keys of tval that may be decoded into a field, in order of
+// preference.
+func (d *Decoder) keysToTry(tval *Tree, f structField) []string {
+	opts := f.opts
+	if opts.nameFromTag && d.keyMatcher != nil {
+		return []string{opts.name}
+	}
+	if d.keyMatcher == nil {
+		return f.keys
+	}
+
+	var keys []string
+	for key := range tval.values {
+		if key != opts.name && d.keyMatcher(key, opts.name) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return append([]string{opts.name}, keys...)
+}
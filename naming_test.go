@@ -0,0 +1,96 @@
+package toml
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCaseConversions(t *testing.T) {
+	tests := []struct {
+		name, snake, kebab string
+	}{
+		{"Host", "host", "host"},
+		{"HostName", "host_name", "host-name"},
+		{"HTTPServer", "http_server", "http-server"},
+		{"ServerID", "server_id", "server-id"},
+		{"Port2Name", "port2_name", "port2-name"},
+		{"already_snake", "already_snake", "already_snake"},
+	}
+	for _, test := range tests {
+		if got := SnakeCase(test.name); got != test.snake {
+			t.Errorf("SnakeCase(%q): expected %q, got %q", test.name, test.snake, got)
+		}
+		if got := KebabCase(test.name); got != test.kebab {
+			t.Errorf("KebabCase(%q): expected %q, got %q", test.name, test.kebab, got)
+		}
+	}
+}
+
+type namingConfig struct {
+	HostName   string
+	HTTPPort   int
+	MaxRetries int `toml:"retries"`
+}
+
+func TestDecoderKeyMatcher(t *testing.T) {
+	tests := []struct {
+		matcher  KeyMatcher
+		doc      string
+		expected namingConfig
+	}{
+		{nil, "hostname = 'a'\nHTTPPORT = 1\nRETRIES = 2", namingConfig{"a", 1, 2}},
+		{MatchExact, "hostname = 'a'\nHTTPPort = 1\nRetries = 2", namingConfig{"", 1, 0}},
+		{MatchCaseInsensitive, "hostNAME = 'a'\nhttpport = 1\nretries = 2", namingConfig{"a", 1, 2}},
+		{MatchSnakeCase, "host_name = 'a'\nhttp_port = 1\nretries = 2", namingConfig{"a", 1, 2}},
+		{MatchKebabCase, "host-name = 'a'\nhttp-port = 1\nmax-retries = 2", namingConfig{"a", 1, 0}},
+		{MatchCaseInsensitive, "HostName = 'a'\nhostname = 'b'\nHOSTNAME = 'c'", namingConfig{HostName: "a"}},
+		{MatchCaseInsensitive, "hostname = 'b'\nHOSTNAME = 'c'", namingConfig{HostName: "c"}},
+	}
+	for _, test := range tests {
+		var v namingConfig
+		if err := NewDecoder(strings.NewReader(test.doc)).KeyMatcher(test.matcher).Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		if v != test.expected {
+			t.Errorf("%q: expected %+v, got %+v", test.doc, test.expected, v)
+		}
+	}
+
+	var v namingConfig
+	err := NewDecoder(strings.NewReader("host_name = 'a'\nhostname = 'b'")).KeyMatcher(MatchSnakeCase).Strict(true).Decode(&v)
+	if err == nil || err.Error() != `undecoded keys: ["hostname"]` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEncoderFieldNamer(t *testing.T) {
+	v := namingConfig{HostName: "a", HTTPPort: 1, MaxRetries: 2}
+	tests := []struct {
+		namer    FieldNamer
+		matcher  KeyMatcher
+		expected string
+	}{
+		{nil, MatchExact, "HTTPPort = 1\nHostName = \"a\"\nretries = 2\n"},
+		{strings.ToLower, MatchCaseInsensitive, "hostname = \"a\"\nhttpport = 1\nretries = 2\n"},
+		{SnakeCase, MatchSnakeCase, "host_name = \"a\"\nhttp_port = 1\nretries = 2\n"},
+		{KebabCase, MatchKebabCase, "host-name = \"a\"\nhttp-port = 1\nretries = 2\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf).FieldNamer(test.namer).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, buf.String())
+		}
+
+		var decoded namingConfig
+		if err := NewDecoder(&buf).KeyMatcher(test.matcher).Decode(&decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded != v {
+			t.Errorf("expected %+v to round trip, got %+v", v, decoded)
+		}
+	}
+}
@@ -13,18 +13,22 @@ import (
 )
 
 type tomlParser struct {
-	flowIdx       int
-	flow          []token
+	flowIdx int
+	flow    []token
+	// Lexer emitting the tokens of the flow as they are read, if any
+	lexer         *tomlLexer
 	tree          *Tree
 	currentTable  []string
 	seenTableKeys []string
+	options       loadOptions
 }
 
 type tomlParserStateFn func() tomlParserStateFn
 
 // Formats and panics an error message based on a token
 func (p *tomlParser) raiseError(tok *token, msg string, args ...interface{}) {
-	panic(tok.Position.String() + ": " + fmt.Sprintf(msg, args...))
+	src := Source{Filename: p.options.filename, Position: tok.Position}
+	panic(src.String() + ": " + fmt.Sprintf(msg, args...))
 }
 
 func (p *tomlParser) run() {
@@ -35,7 +39,13 @@ func (p *tomlParser) run() {
 
 func (p *tomlParser) peek() *token {
 	if p.flowIdx >= len(p.flow) {
-		return nil
+		if p.lexer == nil {
+			return nil
+		}
+		p.flow, p.flowIdx = p.lexer.nextTokens(), 0
+		if len(p.flow) == 0 {
+			return nil
+		}
 	}
 	return &p.flow[p.flowIdx]
 }
@@ -177,6 +187,10 @@ func (p *tomlParser) parseAssign() tomlParserStateFn {
 	}
 
 	value := p.parseRvalue()
+	var trailingComment string
+	if tok := p.peek(); tok != nil && tok.typ == tokenComment {
+		trailingComment = p.getToken().val
+	}
 	var tableKey []string
 	if len(p.currentTable) > 0 {
 		tableKey = p.currentTable
@@ -220,11 +234,15 @@ func (p *tomlParser) parseAssign() tomlParserStateFn {
 	}
 	var toInsert interface{}
 
-	switch value.(type) {
-	case *Tree, []*Tree:
+	switch node := value.(type) {
+	case *Tree:
+		node.position = key.Position
+		node.trailingComment = trailingComment
+		toInsert = value
+	case []*Tree:
 		toInsert = value
 	default:
-		toInsert = &tomlValue{value: value, position: key.Position}
+		toInsert = &tomlValue{value: value, trailingComment: trailingComment, position: key.Position}
 	}
 	targetNode.values[keyVal] = toInsert
 	return p.parseStart
@@ -279,6 +297,15 @@ func (p *tomlParser) parseRvalue() interface{} {
 
 	switch tok.typ {
 	case tokenString:
+		return p.expandEnv(tok)
+	case tokenLiteralString:
+		if p.options.expandLiteral {
+			return p.expandEnv(tok)
+		}
+		if p.options.resolve {
+			// Escaped so that Tree.Resolve gives the string back as written
+			return strings.ReplaceAll(tok.val, "$", "$$")
+		}
 		return tok.val
 	case tokenTrue:
 		return true
@@ -292,32 +319,9 @@ func (p *tomlParser) parseRvalue() interface{} {
 	case tokenNan:
 		return math.NaN()
 	case tokenInteger:
-		cleanedVal := cleanupNumberToken(tok.val)
-		base := 10
-		s := cleanedVal
-		checkInvalidUnderscore := numberContainsInvalidUnderscore
-		if len(cleanedVal) >= 3 && cleanedVal[0] == '0' {
-			switch cleanedVal[1] {
-			case 'x':
-				checkInvalidUnderscore = hexNumberContainsInvalidUnderscore
-				base = 16
-			case 'o':
-				base = 8
-			case 'b':
-				base = 2
-			default:
-				panic("invalid base") // the lexer should catch this first
-			}
-			s = cleanedVal[2:]
-		}
-
-		err := checkInvalidUnderscore(tok.val)
-		if err != nil {
-			p.raiseError(tok, "%s", err)
-		}
-
+		s, base := p.integerDigits(tok)
 		var val interface{}
-		val, err = strconv.ParseInt(s, base, 64)
+		val, err := strconv.ParseInt(s, base, 64)
 		if err == nil {
 			return val
 		}
@@ -329,16 +333,7 @@ func (p *tomlParser) parseRvalue() interface{} {
 		}
 		p.raiseError(tok, "%s", err)
 	case tokenFloat:
-		err := numberContainsInvalidUnderscore(tok.val)
-		if err != nil {
-			p.raiseError(tok, "%s", err)
-		}
-		cleanedVal := cleanupNumberToken(tok.val)
-		val, err := strconv.ParseFloat(cleanedVal, 64)
-		if err != nil {
-			p.raiseError(tok, "%s", err)
-		}
-		return val
+		return p.parseFloat(tok)
 	case tokenLocalTime:
 		val, err := ParseLocalTime(tok.val)
 		if err != nil {
@@ -384,7 +379,7 @@ func (p *tomlParser) parseRvalue() interface{} {
 	case tokenLeftBracket:
 		return p.parseArray()
 	case tokenLeftCurlyBrace:
-		return p.parseInlineTable()
+		return p.parseInlineTable(tok)
 	case tokenEqual:
 		p.raiseError(tok, "cannot have multiple equals for the same key")
 	case tokenError:
@@ -396,12 +391,53 @@ func (p *tomlParser) parseRvalue() interface{} {
 	return nil
 }
 
+// Returns the digits of an integer token, without its base prefix, and their
+// base.
+func (p *tomlParser) integerDigits(tok *token) (string, int) {
+	cleanedVal := cleanupNumberToken(tok.val)
+	base := 10
+	s := cleanedVal
+	checkInvalidUnderscore := numberContainsInvalidUnderscore
+	if len(cleanedVal) >= 3 && cleanedVal[0] == '0' {
+		switch cleanedVal[1] {
+		case 'x':
+			checkInvalidUnderscore = hexNumberContainsInvalidUnderscore
+			base = 16
+		case 'o':
+			base = 8
+		case 'b':
+			base = 2
+		default:
+			panic("invalid base") // the lexer should catch this first
+		}
+		s = cleanedVal[2:]
+	}
+
+	if err := checkInvalidUnderscore(tok.val); err != nil {
+		p.raiseError(tok, "%s", err)
+	}
+	return s, base
+}
+
+func (p *tomlParser) parseFloat(tok *token) float64 {
+	err := numberContainsInvalidUnderscore(tok.val)
+	if err != nil {
+		p.raiseError(tok, "%s", err)
+	}
+	cleanedVal := cleanupNumberToken(tok.val)
+	val, err := strconv.ParseFloat(cleanedVal, 64)
+	if err != nil {
+		p.raiseError(tok, "%s", err)
+	}
+	return val
+}
+
 func tokenIsComma(t *token) bool {
 	return t != nil && t.typ == tokenComma
 }
 
-func (p *tomlParser) parseInlineTable() *Tree {
-	tree := newTree()
+func (p *tomlParser) parseInlineTable(start *token) *Tree {
+	tree := newTreeWithPosition(start.Position)
 	var previous *token
 Loop:
 	for {
@@ -413,7 +449,7 @@ Loop:
 		case tokenRightCurlyBrace:
 			p.getToken()
 			break Loop
-		case tokenKey, tokenInteger, tokenString:
+		case tokenKey, tokenInteger, tokenString, tokenLiteralString:
 			if !tokenIsComma(previous) && previous != nil {
 				p.raiseError(follow, "comma expected between fields in inline table")
 			}
@@ -427,6 +463,7 @@ Loop:
 
 			value := p.parseRvalue()
 			tree.SetPath(parsedKey, value)
+			tree.SetPositionPath(parsedKey, key.Position)
 		case tokenComma:
 			if tokenIsComma(previous) {
 				p.raiseError(follow, "need field between two commas in inline table")
@@ -492,7 +529,7 @@ func (p *tomlParser) parseArray() interface{} {
 	return array
 }
 
-func parseToml(flow []token) *Tree {
+func parseToml(flow []token, options loadOptions) *Tree {
 	result := newTree()
 	result.position = Position{1, 1}
 	parser := &tomlParser{
@@ -501,7 +538,11 @@ func parseToml(flow []token) *Tree {
 		tree:          result,
 		currentTable:  make([]string, 0),
 		seenTableKeys: make([]string, 0),
+		options:       options,
 	}
 	parser.run()
+	if options.filename != "" {
+		result.setFilename(options.filename)
+	}
 	return result
 }
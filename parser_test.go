@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -839,6 +840,49 @@ func TestParseFile(t *testing.T) {
 	})
 }
 
+func TestParseFilePositions(t *testing.T) {
+	tree, err := LoadFile("example.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Source{Filename: "example.toml", Position: Position{3, 1}}
+	if src := tree.GetSource("title"); src != expected {
+		t.Errorf("expected source %v, got %v", expected, src)
+	}
+	expected = Source{Filename: "example.toml", Position: Position{20, 3}}
+	if src := tree.GetSource("servers.alpha"); src != expected {
+		t.Errorf("expected source %v, got %v", expected, src)
+	}
+}
+
+func TestParseInlineTablePositions(t *testing.T) {
+	tree, err := Load("a = 1\npoint = { x = 1, nested = { y = 2 } }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	positions := map[string]Position{
+		"point":          {2, 1},
+		"point.x":        {2, 11},
+		"point.nested":   {2, 18},
+		"point.nested.y": {2, 29},
+	}
+	for key, expected := range positions {
+		if pos := tree.GetPosition(key); pos != expected {
+			t.Errorf("position of %s: expected %v, got %v", key, expected, pos)
+		}
+	}
+}
+
+func TestParseErrorFilename(t *testing.T) {
+	_, err := LoadReaderNamed(strings.NewReader("a = 1\nb = "), "conf.d/app.toml")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if err.Error() != "conf.d/app.toml:(2, 5): expecting a value" {
+		t.Error("Bad error message:", err.Error())
+	}
+}
+
 func TestParseFileCRLF(t *testing.T) {
 	tree, err := LoadFile("example-crlf.toml")
 
@@ -27,3 +27,20 @@ func (p Position) String() string {
 func (p Position) Invalid() bool {
 	return p.Line <= 0 || p.Col <= 0
 }
+
+// Source of a document element: its position, and the name of the file it was
+// read from. Filename is empty when the document does not come from a named
+// file.
+type Source struct {
+	Filename string // file containing the document, if any
+	Position
+}
+
+// String representation of the source.
+// Displays the position prefixed by the file name if there is one.
+func (s Source) String() string {
+	if s.Filename != "" {
+		return s.Filename + ":" + s.Position.String()
+	}
+	return s.Position.String()
+}
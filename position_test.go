@@ -16,6 +16,16 @@ func TestPositionString(t *testing.T) {
 	}
 }
 
+func TestSourceString(t *testing.T) {
+	s := Source{Filename: "conf.d/app.toml", Position: Position{123, 456}}
+	expected := "conf.d/app.toml:(123, 456)"
+	value := s.String()
+
+	if value != expected {
+		t.Errorf("Expected %v, got %v instead", expected, value)
+	}
+}
+
 func TestInvalid(t *testing.T) {
 	for i, v := range []Position{
 		{0, 1234},
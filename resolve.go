@@ -0,0 +1,208 @@
+// Resolution of references between keys of a document.
+
+package toml
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ResolveReferences returns a LoadOption that calls Tree.Resolve on the
+// loaded Tree.
+//
+// When used together with ExpandEnv, references are resolved against the
+// document first: a reference is only expanded from the environment when the
+// document has no such key, or when it uses the ${VAR:-default} or
+// ${VAR:?message} forms. A reference found neither in the document nor in the
+// environment is reported as unresolved.
+//
+// Literal strings are left as written, unless ExpandEnvInLiteralStrings is
+// also provided.
+func ResolveReferences() LoadOption {
+	return func(o *loadOptions) {
+		o.resolve = true
+	}
+}
+
+type resolveState int
+
+const (
+	resolveInProgress resolveState = iota + 1
+	resolveDone
+)
+
+type resolver struct {
+	root  *Tree
+	state map[*tomlValue]resolveState
+	stack []string
+	// Lookup of the environment variables references fall back to, if any
+	lookupEnv func(string) (string, bool)
+}
+
+// Resolve replaces references to other keys of the document, such as
+// "${server.host}", found in string values by the value of the referenced
+// key. References are absolute key paths, parsed like keys of the document,
+// and may index arrays of tables (e.g. "${servers.0.host}").
+//
+// When a string consists of a single reference, it takes the value of the
+// referenced key, whatever its type. Otherwise, referenced keys must hold
+// strings, numbers, booleans or dates, which are interpolated using their TOML
+// representation. Use $$ to write a literal $.
+//
+// Resolve returns an error when a reference does not exist, or when references
+// form a cycle.
+func (t *Tree) Resolve() error {
+	return t.resolve(nil)
+}
+
+// Resolves the references of the tree, falling back to the environment
+// variables found with lookupEnv if it is not nil.
+func (t *Tree) resolve(lookupEnv func(string) (string, bool)) error {
+	r := &resolver{
+		root:      t,
+		state:     make(map[*tomlValue]resolveState),
+		lookupEnv: lookupEnv,
+	}
+	return r.resolveTree(t, nil)
+}
+
+func (r *resolver) resolveTree(t *Tree, path []string) error {
+	keys := t.Keys()
+	sort.Strings(keys)
+	for _, k := range keys {
+		keyPath := append(path[:len(path):len(path)], k)
+		switch node := t.values[k].(type) {
+		case *Tree:
+			if err := r.resolveTree(node, keyPath); err != nil {
+				return err
+			}
+		case []*Tree:
+			for i, item := range node {
+				if err := r.resolveTree(item, append(keyPath, strconv.Itoa(i))); err != nil {
+					return err
+				}
+			}
+		case *tomlValue:
+			if err := r.resolveValue(node, keyPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *resolver) resolveValue(v *tomlValue, path []string) error {
+	switch r.state[v] {
+	case resolveDone:
+		return nil
+	case resolveInProgress:
+		cycle := append(r.stack, strings.Join(path, "."))
+		for i := range cycle {
+			if cycle[i] == cycle[len(cycle)-1] {
+				cycle = cycle[i:]
+				break
+			}
+		}
+		return &positionError{pos: Source{Filename: v.filename, Position: v.position}, err: fmt.Errorf("reference cycle: %s", strings.Join(cycle, " -> "))}
+	}
+
+	r.state[v] = resolveInProgress
+	r.stack = append(r.stack, strings.Join(path, "."))
+	value, err := r.resolveItem(v.value, path)
+	r.stack = r.stack[:len(r.stack)-1]
+	if err != nil {
+		return formatError(err, Source{Filename: v.filename, Position: v.position})
+	}
+	v.value = value
+	r.state[v] = resolveDone
+	return nil
+}
+
+func (r *resolver) resolveItem(value interface{}, path []string) (interface{}, error) {
+	switch node := value.(type) {
+	case string:
+		return r.resolveString(node)
+	case []interface{}:
+		for i, item := range node {
+			resolved, err := r.resolveItem(item, path)
+			if err != nil {
+				return nil, err
+			}
+			node[i] = resolved
+		}
+	case *Tree:
+		if err := r.resolveTree(node, path); err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+func (r *resolver) resolveString(s string) (interface{}, error) {
+	if strings.HasPrefix(s, "${") && strings.IndexByte(s, '}') == len(s)-1 {
+		return r.target(s[2 : len(s)-1])
+	}
+
+	return replaceReferences(s, false, func(ref string) (string, bool, error) {
+		target, err := r.target(ref)
+		if err != nil {
+			return "", false, err
+		}
+		switch value := target.(type) {
+		case string:
+			return value, true, nil
+		case []interface{}, *Tree:
+			return "", false, fmt.Errorf("reference ${%s} cannot be interpolated in a string", ref)
+		default:
+			repr, err := tomlValueStringRepresentation(value, "", "", OrderAlphabetical, false)
+			return repr, true, err
+		}
+	})
+}
+
+// Finds and resolves the value the reference points to, in the document or
+// else in the environment.
+func (r *resolver) target(ref string) (interface{}, error) {
+	if r.lookupEnv != nil && envReferenceName(ref) != ref {
+		return expandReference(ref, r.lookupEnv)
+	}
+	keys, err := parseKey(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reference ${%s}: %s", ref, err)
+	}
+
+	var node interface{} = r.root
+	for _, k := range keys {
+		switch n := node.(type) {
+		case *Tree:
+			node = n.values[k]
+		case []*Tree:
+			idx, err := strconv.Atoi(k)
+			if err != nil || idx < 0 || idx >= len(n) {
+				node = nil
+			} else {
+				node = n[idx]
+			}
+		default:
+			node = nil
+		}
+	}
+
+	switch n := node.(type) {
+	case *tomlValue:
+		if err := r.resolveValue(n, keys); err != nil {
+			return nil, err
+		}
+		return n.value, nil
+	case *Tree, []*Tree:
+		return nil, fmt.Errorf("reference ${%s} points to a table", ref)
+	}
+	if r.lookupEnv != nil && isValidEnvName(ref) {
+		if value, ok := r.lookupEnv(ref); ok {
+			return value, nil
+		}
+	}
+	return nil, fmt.Errorf("unresolved reference ${%s}", ref)
+}
@@ -0,0 +1,160 @@
+package toml
+
+import (
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	tree, err := Load(`
+url = "http://${server.host}:${server.port}/${server.'base path'}"
+port = "${server.port}"
+hosts = ["${server.host}", "${first}"]
+first = "${servers.0.name}"
+enabled = "${server.enabled}"
+ratio = "ratio=${server.ratio}"
+escaped = "$${server.host} costs $$5"
+
+[server]
+host = "example.com"
+port = 8080
+enabled = true
+ratio = 0.5
+"base path" = "${server.prefix}/api"
+prefix = "v1"
+
+[[servers]]
+name = "alpha"
+
+[[servers]]
+name = "beta"
+`, ResolveReferences())
+	assertTree(t, tree, err, map[string]interface{}{
+		"url":     "http://example.com:8080/v1/api",
+		"port":    int64(8080),
+		"hosts":   []interface{}{"example.com", "alpha"},
+		"first":   "alpha",
+		"enabled": true,
+		"ratio":   "ratio=0.5",
+		"escaped": "${server.host} costs $5",
+	})
+}
+
+func TestResolveNested(t *testing.T) {
+	tree, err := Load(`
+a = "${b}-a"
+b = "${c}-b"
+c = "c"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Resolve(); err != nil {
+		t.Fatal(err)
+	}
+	assertTree(t, tree, nil, map[string]interface{}{
+		"a": "c-b-a",
+		"b": "c-b",
+		"c": "c",
+	})
+}
+
+func TestResolveWithExpandEnv(t *testing.T) {
+	tree, err := Load(`
+url = "http://${HOST}:${server.port}"
+escaped = "$${HOST}"
+
+[server]
+port = 80
+`, ExpandEnv(testLookupEnv), ResolveReferences())
+	assertTree(t, tree, err, map[string]interface{}{
+		"url":     "http://example.com:80",
+		"escaped": "${HOST}",
+	})
+}
+
+func TestResolveKeysBeforeEnv(t *testing.T) {
+	tree, err := Load(`
+HOST = "local"
+host = "db.example.com"
+url = "${host}"
+port = "${PORT}"
+user = "${USER:-admin}"
+`, ExpandEnv(testLookupEnv), ResolveReferences())
+	assertTree(t, tree, err, map[string]interface{}{
+		"HOST": "local",
+		"host": "db.example.com",
+		"url":  "db.example.com",
+		"port": "8080",
+		"user": "admin",
+	})
+
+	for _, ref := range []string{"missing_key", "missing.key"} {
+		_, err = Load(`url = "${`+ref+`}"`, ExpandEnv(testLookupEnv), ResolveReferences())
+		if expected := "(1, 1): unresolved reference ${" + ref + "}"; err == nil || err.Error() != expected {
+			t.Errorf("expected error %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestResolveLiteralStrings(t *testing.T) {
+	const doc = `
+host = "db.example.com"
+env = '${HOST}'
+ref = '${host}'
+cost = '$$5 ${'
+list = ['${host}', "${host}"]
+`
+	tree, err := Load(doc, ExpandEnv(testLookupEnv), ResolveReferences())
+	assertTree(t, tree, err, map[string]interface{}{
+		"host": "db.example.com",
+		"env":  "${HOST}",
+		"ref":  "${host}",
+		"cost": "$$5 ${",
+		"list": []interface{}{"${host}", "db.example.com"},
+	})
+
+	tree, err = Load(doc, ResolveReferences())
+	assertTree(t, tree, err, map[string]interface{}{
+		"host": "db.example.com",
+		"env":  "${HOST}",
+		"ref":  "${host}",
+		"cost": "$$5 ${",
+		"list": []interface{}{"${host}", "db.example.com"},
+	})
+
+	tree, err = Load(`
+host = "db.example.com"
+env = '${HOST}'
+ref = '${host}'
+`, ExpandEnv(testLookupEnv), ExpandEnvInLiteralStrings(), ResolveReferences())
+	assertTree(t, tree, err, map[string]interface{}{
+		"host": "db.example.com",
+		"env":  "example.com",
+		"ref":  "db.example.com",
+	})
+}
+
+func TestResolveErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"a = \"${missing}\"", "(1, 1): unresolved reference ${missing}"},
+		{"a = \"${b}\"\nb = \"${c}\"\nc = \"x${a}\"", "(1, 1): reference cycle: a -> b -> c -> a"},
+		{"a = \"${a}\"", "(1, 1): reference cycle: a -> a"},
+		{"a = \"${t}\"\n[t]\nb = 1", "(1, 1): reference ${t} points to a table"},
+		{"a = \"x${b}\"\nb = [1, 2]", "(1, 1): reference ${b} cannot be interpolated in a string"},
+		{"a = \"${servers.2.name}\"\n[[servers]]\nname = 1", "(1, 1): unresolved reference ${servers.2.name}"},
+	}
+
+	for _, test := range tests {
+		_, err := Load(test.input, ResolveReferences())
+		if err == nil {
+			t.Errorf("%q: expected error %q, got none", test.input, test.err)
+			continue
+		}
+		if err.Error() != test.err {
+			t.Errorf("%q: expected error %q, got %q", test.input, test.err, err.Error())
+		}
+	}
+}
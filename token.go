@@ -15,6 +15,7 @@ const (
 	tokenComment
 	tokenKey
 	tokenString
+	tokenLiteralString
 	tokenInteger
 	tokenTrue
 	tokenFalse
@@ -51,6 +52,7 @@ var tokenTypeNames = []string{
 	"Comment",
 	"Key",
 	"String",
+	"LiteralString",
 	"Integer",
 	"True",
 	"False",
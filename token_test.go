@@ -12,6 +12,7 @@ func TestTokenStringer(t *testing.T) {
 		{tokenComment, "Comment"},
 		{tokenKey, "Key"},
 		{tokenString, "String"},
+		{tokenLiteralString, "LiteralString"},
 		{tokenInteger, "Integer"},
 		{tokenTrue, "True"},
 		{tokenFalse, "False"},
@@ -11,21 +11,27 @@ import (
 )
 
 type tomlValue struct {
-	value     interface{} // string, int64, uint64, float64, bool, time.Time, [] of any of this list
-	comment   string
-	commented bool
-	multiline bool
-	literal   bool
-	position  Position
+	value           interface{} // string, int64, uint64, float64, bool, time.Time, [] of any of this list
+	comment         string
+	trailingComment string // comment ending the line of the value, "#" included
+	commented       bool
+	multiline       bool
+	literal         bool
+	position        Position
+	filename        string // file the value was read from, if any
+	maxWidth        int    // width of its lines if non-zero, unlimited if negative
 }
 
 // Tree is the result of the parsing of a TOML file.
 type Tree struct {
-	values    map[string]interface{} // string -> *tomlValue, *Tree, []*Tree
-	comment   string
-	commented bool
-	inline    bool
-	position  Position
+	values          map[string]interface{} // string -> *tomlValue, *Tree, []*Tree
+	comment         string
+	trailingComment string // comment ending the line of the tree when inline
+	commented       bool
+	inline          bool
+	position        Position
+	filename        string // file the tree was read from, if any
+	maxWidth        int    // width of its line when inline if non-zero, unlimited if negative
 }
 
 func newTree() *Tree {
@@ -48,6 +54,42 @@ func TreeFromMap(m map[string]interface{}) (*Tree, error) {
 	return result.(*Tree), nil
 }
 
+// Clone returns a deep copy of the tree. Comments, formatting options and
+// positions of all its elements are preserved.
+func (t *Tree) Clone() *Tree {
+	clone := *t
+	clone.values = make(map[string]interface{}, len(t.values))
+	for k, v := range t.values {
+		clone.values[k] = cloneNode(v)
+	}
+	return &clone
+}
+
+func cloneNode(v interface{}) interface{} {
+	switch node := v.(type) {
+	case *Tree:
+		return node.Clone()
+	case []*Tree:
+		trees := make([]*Tree, len(node))
+		for i, item := range node {
+			trees[i] = item.Clone()
+		}
+		return trees
+	case *tomlValue:
+		value := *node
+		value.value = cloneNode(node.value)
+		return &value
+	case []interface{}:
+		values := make([]interface{}, len(node))
+		for i, item := range node {
+			values[i] = cloneNode(item)
+		}
+		return values
+	default:
+		return v
+	}
+}
+
 // Position returns the position of the tree.
 func (t *Tree) Position() Position {
 	return t.position
@@ -300,6 +342,80 @@ func (t *Tree) GetPositionPath(keys []string) Position {
 	}
 }
 
+// GetSource returns the source of the given key: its position and the file it
+// was read from.
+func (t *Tree) GetSource(key string) Source {
+	if key == "" {
+		return Source{Filename: t.filename, Position: t.position}
+	}
+	return t.GetSourcePath(strings.Split(key, "."))
+}
+
+// GetSourcePath returns the source of the element in the tree indicated by
+// 'keys'. If keys is of length zero, the source of the current tree is
+// returned.
+func (t *Tree) GetSourcePath(keys []string) Source {
+	if len(keys) == 0 {
+		return Source{Filename: t.filename, Position: t.position}
+	}
+	parent := t
+	if len(keys) > 1 {
+		switch node := t.GetPath(keys[:len(keys)-1]).(type) {
+		case *Tree:
+			parent = node
+		case []*Tree:
+			if len(node) == 0 {
+				return Source{}
+			}
+			parent = node[len(node)-1]
+		default:
+			return Source{}
+		}
+	}
+	switch node := parent.values[keys[len(keys)-1]].(type) {
+	case *tomlValue:
+		return Source{Filename: node.filename, Position: node.position}
+	case *Tree:
+		return Source{Filename: node.filename, Position: node.position}
+	case []*Tree:
+		if len(node) == 0 {
+			return Source{}
+		}
+		return Source{Filename: node[len(node)-1].filename, Position: node[len(node)-1].position}
+	default:
+		return Source{}
+	}
+}
+
+// Sets the file name of the tree and all its elements.
+func (t *Tree) setFilename(name string) {
+	t.filename = name
+	for _, v := range t.values {
+		switch node := v.(type) {
+		case *Tree:
+			node.setFilename(name)
+		case []*Tree:
+			for _, item := range node {
+				item.setFilename(name)
+			}
+		case *tomlValue:
+			node.filename = name
+			setFilenameInArray(node.value, name)
+		}
+	}
+}
+
+func setFilenameInArray(v interface{}, name string) {
+	switch node := v.(type) {
+	case *Tree:
+		node.setFilename(name)
+	case []interface{}:
+		for _, item := range node {
+			setFilenameInArray(item, name)
+		}
+	}
+}
+
 // GetDefault works like Get but with a default value
 func (t *Tree) GetDefault(key string, def interface{}) interface{} {
 	val := t.Get(key)
@@ -316,6 +432,10 @@ type SetOptions struct {
 	Commented bool
 	Multiline bool
 	Literal   bool
+	// TrailingComment is written at the end of the line of the value, instead
+	// of above it like Comment. It is prefixed by "# " unless it starts with
+	// "#".
+	TrailingComment string
 }
 
 // SetWithOptions is the same as Set, but allows you to provide formatting
@@ -353,6 +473,7 @@ func (t *Tree) SetPathWithOptions(keys []string, opts SetOptions, value interfac
 	switch v := value.(type) {
 	case *Tree:
 		v.comment = opts.Comment
+		v.trailingComment = opts.TrailingComment
 		v.commented = opts.Commented
 		toInsert = value
 	case []*Tree:
@@ -362,17 +483,19 @@ func (t *Tree) SetPathWithOptions(keys []string, opts SetOptions, value interfac
 		toInsert = value
 	case *tomlValue:
 		v.comment = opts.Comment
+		v.trailingComment = opts.TrailingComment
 		v.commented = opts.Commented
 		v.multiline = opts.Multiline
 		v.literal = opts.Literal
 		toInsert = v
 	default:
 		toInsert = &tomlValue{value: value,
-			comment:   opts.Comment,
-			commented: opts.Commented,
-			multiline: opts.Multiline,
-			literal:   opts.Literal,
-			position:  Position{Line: subtree.position.Line + len(subtree.values) + 1, Col: subtree.position.Col}}
+			comment:         opts.Comment,
+			trailingComment: opts.TrailingComment,
+			commented:       opts.Commented,
+			multiline:       opts.Multiline,
+			literal:         opts.Literal,
+			position:        Position{Line: subtree.position.Line + len(subtree.values) + 1, Col: subtree.position.Col}}
 	}
 
 	subtree.values[keys[len(keys)-1]] = toInsert
@@ -432,6 +555,20 @@ func (t *Tree) DeletePath(keys []string) error {
 	return errors.New("no such key to delete")
 }
 
+// merge copies the values of o into t, replacing the values t already holds
+// except for standard tables, which are merged recursively.
+func (t *Tree) merge(o *Tree) {
+	for k, v := range o.values {
+		if src, ok := v.(*Tree); ok && !src.inline {
+			if dst, ok := t.values[k].(*Tree); ok && !dst.inline {
+				dst.merge(src)
+				continue
+			}
+		}
+		t.values[k] = v
+	}
+}
+
 // createSubTree takes a tree and a key and create the necessary intermediate
 // subtrees to create a subtree at that point. In-place.
 //
@@ -464,8 +601,46 @@ func (t *Tree) createSubTree(keys []string, pos Position) error {
 	return nil
 }
 
+// LoadOption changes how the Load* functions build a Tree.
+type LoadOption func(*loadOptions)
+
+type loadOptions struct {
+	lookupEnv     func(string) (string, bool)
+	expandLiteral bool
+	resolve       bool
+	filename      string
+	include       string
+}
+
+// Sets the name of the file the document is read from.
+func withFilename(name string) LoadOption {
+	return func(o *loadOptions) {
+		o.filename = name
+	}
+}
+
+func newLoadOptions(opts []LoadOption) loadOptions {
+	var o loadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
 // LoadBytes creates a Tree from a []byte.
-func LoadBytes(b []byte) (tree *Tree, err error) {
+func LoadBytes(b []byte, opts ...LoadOption) (tree *Tree, err error) {
+	options := newLoadOptions(opts)
+	tree, err = loadBytes(b, options)
+	if err == nil && options.resolve {
+		if err = tree.resolve(options.lookupEnv); err != nil {
+			tree = nil
+		}
+	}
+	return
+}
+
+// Parses b into a Tree, without resolving references.
+func loadBytes(b []byte, options loadOptions) (tree *Tree, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			if _, ok := r.(runtime.Error); ok {
@@ -475,16 +650,25 @@ func LoadBytes(b []byte) (tree *Tree, err error) {
 		}
 	}()
 
+	// The trailing comments are kept, to be written back by the Encoder
+	l := newTomlLexer(trimBOM(b))
+	l.tokens = make([]token, 0, 256)
+	l.trailingComments = true
+	l.run()
+	tree = parseToml(l.tokens, options)
+	return
+}
+
+// Removes the byte order mark at the start of b, if any.
+func trimBOM(b []byte) []byte {
 	if len(b) >= 4 && (hasUTF32BigEndianBOM4(b) || hasUTF32LittleEndianBOM4(b)) {
-		b = b[4:]
+		return b[4:]
 	} else if len(b) >= 3 && hasUTF8BOM3(b) {
-		b = b[3:]
+		return b[3:]
 	} else if len(b) >= 2 && (hasUTF16BigEndianBOM2(b) || hasUTF16LittleEndianBOM2(b)) {
-		b = b[2:]
+		return b[2:]
 	}
-
-	tree = parseToml(lexToml(b))
-	return
+	return b
 }
 
 func hasUTF16BigEndianBOM2(b []byte) bool {
@@ -508,26 +692,54 @@ func hasUTF32LittleEndianBOM4(b []byte) bool {
 }
 
 // LoadReader creates a Tree from any io.Reader.
-func LoadReader(reader io.Reader) (tree *Tree, err error) {
+func LoadReader(reader io.Reader, opts ...LoadOption) (tree *Tree, err error) {
 	inputBytes, err := ioutil.ReadAll(reader)
 	if err != nil {
 		return
 	}
-	tree, err = LoadBytes(inputBytes)
+	tree, err = LoadBytes(inputBytes, opts...)
 	return
 }
 
+// LoadReaderNamed creates a Tree from any io.Reader. The sources of the
+// elements of the Tree, as well as errors, refer to the given file name.
+func LoadReaderNamed(reader io.Reader, name string, opts ...LoadOption) (tree *Tree, err error) {
+	return LoadReader(reader, append(opts, withFilename(name))...)
+}
+
 // Load creates a Tree from a string.
-func Load(content string) (tree *Tree, err error) {
-	return LoadBytes([]byte(content))
+func Load(content string, opts ...LoadOption) (tree *Tree, err error) {
+	return LoadBytes([]byte(content), opts...)
+}
+
+// ParseValue parses s as a single TOML value, such as 42, "text", [1, 2] or
+// { x = 1 }. The value is returned as Tree.Get would return it: inline tables
+// are returned as a *Tree.
+func ParseValue(s string) (interface{}, error) {
+	tree, err := Load("v = " + s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tree.values) != 1 {
+		return nil, fmt.Errorf("invalid value literal: %q", s)
+	}
+	switch node := tree.values["v"].(type) {
+	case *tomlValue:
+		return node.value, nil
+	case nil:
+		return nil, fmt.Errorf("invalid value literal: %q", s)
+	default:
+		return node, nil
+	}
 }
 
-// LoadFile creates a Tree from a file.
-func LoadFile(path string) (tree *Tree, err error) {
+// LoadFile creates a Tree from a file. The sources of the elements of the Tree,
+// as well as errors, refer to the given path.
+func LoadFile(path string, opts ...LoadOption) (tree *Tree, err error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
-	return LoadReader(file)
+	return LoadReaderNamed(file, path, opts...)
 }
@@ -4,7 +4,9 @@ package toml
 
 import (
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestTomlHas(t *testing.T) {
@@ -240,6 +242,33 @@ func TestTomlFromMap(t *testing.T) {
 	}
 }
 
+func TestTomlClone(t *testing.T) {
+	tree, _ := LoadReaderNamed(strings.NewReader(`
+a = [1, { b = 2 }]
+
+[t]
+c = "d"
+
+[[arr]]
+e = 1
+`), "a.toml")
+
+	clone := tree.Clone()
+	if !reflect.DeepEqual(tree, clone) {
+		t.Fatalf("clone differs from the original:\n%v\n%v", tree, clone)
+	}
+	if src := clone.GetSource("t.c"); src != (Source{Filename: "a.toml", Position: Position{5, 1}}) {
+		t.Errorf("source not preserved: %v", src)
+	}
+
+	clone.Set("t.c", "changed")
+	clone.Get("arr").([]*Tree)[0].Set("e", int64(2))
+	clone.Get("a").([]interface{})[1].(*Tree).Set("b", int64(3))
+	if tree.Get("t.c") != "d" || tree.Get("arr.e") != int64(1) || tree.Get("a").([]interface{})[1].(*Tree).Get("b") != int64(2) {
+		t.Errorf("modifying the clone changed the original: %v", tree)
+	}
+}
+
 func TestLoadBytesBOM(t *testing.T) {
 	payloads := [][]byte{
 		[]byte("\xFE\xFFhello=1"),
@@ -259,3 +288,25 @@ func TestLoadBytesBOM(t *testing.T) {
 		}
 	}
 }
+
+func TestParseValue(t *testing.T) {
+	for s, expected := range map[string]interface{}{
+		"42":         int64(42),
+		`"text"`:     "text",
+		"[1, 2]":     []interface{}{int64(1), int64(2)},
+		"true":       true,
+		"1979-05-27": LocalDate{1979, time.May, 27},
+	} {
+		if value, err := ParseValue(s); err != nil || !reflect.DeepEqual(value, expected) {
+			t.Errorf("ParseValue(%q): expected %v, got %v (%v)", s, expected, value, err)
+		}
+	}
+	if value, err := ParseValue("{ x = 1 }"); err != nil || value.(*Tree).Get("x") != int64(1) {
+		t.Errorf("unexpected inline table %v (%v)", value, err)
+	}
+	for _, s := range []string{"", "text", "1\nw = 2"} {
+		if _, err := ParseValue(s); err == nil {
+			t.Errorf("ParseValue(%q): expected an error", s)
+		}
+	}
+}
@@ -9,6 +9,9 @@ func (ptv *PubTOMLValue) Value() interface{} {
 func (ptv *PubTOMLValue) Comment() string {
 	return ptv.comment
 }
+func (ptv *PubTOMLValue) TrailingComment() string {
+	return ptv.trailingComment
+}
 func (ptv *PubTOMLValue) Commented() bool {
 	return ptv.commented
 }
@@ -25,6 +28,9 @@ func (ptv *PubTOMLValue) SetValue(v interface{}) {
 func (ptv *PubTOMLValue) SetComment(s string) {
 	ptv.comment = s
 }
+func (ptv *PubTOMLValue) SetTrailingComment(s string) {
+	ptv.trailingComment = s
+}
 func (ptv *PubTOMLValue) SetCommented(c bool) {
 	ptv.commented = c
 }
@@ -35,7 +35,7 @@ func typeFor(k reflect.Kind) reflect.Type {
 
 func simpleValueCoercion(object interface{}) (interface{}, error) {
 	switch original := object.(type) {
-	case string, bool, int64, uint64, float64, time.Time:
+	case string, bool, int64, uint64, float64, time.Time, LocalDate, LocalTime, LocalDateTime:
 		return original, nil
 	case int:
 		return int64(original), nil
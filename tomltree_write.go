@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type valueComplexity int
@@ -123,6 +124,9 @@ func tomlTreeStringRepresentation(t *Tree, ord MarshalOrder) (string, error) {
 		}
 		values = append(values, quoteKeyIfNeeded(k)+" = "+repr)
 	}
+	if len(values) == 0 {
+		return "{}", nil
+	}
 	return "{ " + strings.Join(values, ", ") + " }", nil
 }
 
@@ -225,6 +229,79 @@ func tomlValueStringRepresentation(v interface{}, commented string, indent strin
 	return "", fmt.Errorf("unsupported value type %T: %v", v, v)
 }
 
+// An array of tables of a tree being written whose tables are built one at a
+// time, as they are written, so that they are not all held in memory.
+type tableSource struct {
+	len      int
+	table    func(i int) (*Tree, error)
+	position Position
+}
+
+// Checks if a node of a tree is an array of tables.
+func isTableArray(v interface{}) bool {
+	switch v.(type) {
+	case []*Tree, *tableSource:
+		return true
+	default:
+		return false
+	}
+}
+
+// Checks if a node of a tree is written as a value: an inline table, or an
+// array of inline tables.
+func isInlineNode(v interface{}) bool {
+	switch node := v.(type) {
+	case *Tree:
+		return node.inline
+	case []*Tree:
+		for _, tree := range node {
+			if !tree.inline {
+				return false
+			}
+		}
+		return len(node) > 0
+	default:
+		return false
+	}
+}
+
+// Returns the representation of a value following prefix characters on its
+// line. Arrays that do not fit in width are written with one element per line,
+// their elements being wrapped the same way.
+func wrappedValueStringRepresentation(v interface{}, commented string, indent string, ord MarshalOrder, prefix, width int) (string, error) {
+	repr, err := tomlValueStringRepresentation(v, commented, indent, ord, false)
+	if err != nil || prefix+utf8.RuneCountInString(repr) <= width {
+		return repr, err
+	}
+
+	value := v
+	if tv, ok := v.(*tomlValue); ok {
+		value = tv.value
+	}
+	if _, ok := value.([]byte); ok {
+		return repr, nil
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice || rv.Len() == 0 {
+		return repr, nil
+	}
+
+	stringBuffer := bytes.Buffer{}
+	valueIndent := indent + `  `
+	stringBuffer.WriteString("[\n")
+	for i := 0; i < rv.Len(); i++ {
+		// The trailing comma counts as part of the prefix
+		itemPrefix := utf8.RuneCountInString(valueIndent+commented) + 1
+		itemRepr, err := wrappedValueStringRepresentation(rv.Index(i).Interface(), commented, valueIndent, ord, itemPrefix, width)
+		if err != nil {
+			return "", err
+		}
+		stringBuffer.WriteString(valueIndent + commented + itemRepr + ",\n")
+	}
+	stringBuffer.WriteString(indent + commented + "]")
+	return stringBuffer.String(), nil
+}
+
 func getTreeArrayLine(trees []*Tree) (line int) {
 	// Prevent returning 0 for empty trees
 	line = int(^uint(0) >> 1)
@@ -237,42 +314,50 @@ func getTreeArrayLine(trees []*Tree) (line int) {
 	return
 }
 
+// Sorts the keys of t by the position of their node, keys defined on the same
+// line being sorted by column, then by name. Values come before tables, since
+// a value written after a table header would belong to the table.
 func sortByLines(t *Tree) (vals []sortNode) {
-	var (
-		line  int
-		lines []int
-		tv    *Tree
-		tom   *tomlValue
-		node  sortNode
-	)
-	vals = make([]sortNode, 0)
-	m := make(map[int]sortNode)
-
-	for k := range t.values {
-		v := t.values[k]
-		switch v.(type) {
+	type positionedNode struct {
+		sortNode
+		position Position
+	}
+	nodes := make([]positionedNode, 0, len(t.values))
+	for k, v := range t.values {
+		var node positionedNode
+		switch v := v.(type) {
 		case *Tree:
-			tv = v.(*Tree)
-			line = tv.position.Line
-			node = sortNode{key: k, complexity: valueComplex}
+			node = positionedNode{sortNode{key: k, complexity: valueComplex}, v.position}
 		case []*Tree:
-			line = getTreeArrayLine(v.([]*Tree))
-			node = sortNode{key: k, complexity: valueComplex}
+			node = positionedNode{sortNode{key: k, complexity: valueComplex}, Position{Line: getTreeArrayLine(v)}}
+		case *tableSource:
+			node = positionedNode{sortNode{key: k, complexity: valueComplex}, v.position}
 		default:
-			tom = v.(*tomlValue)
-			line = tom.position.Line
-			node = sortNode{key: k, complexity: valueSimple}
+			node = positionedNode{sortNode{key: k, complexity: valueSimple}, v.(*tomlValue).position}
 		}
-		lines = append(lines, line)
-		vals = append(vals, node)
-		m[line] = node
+		if isInlineNode(v) {
+			node.complexity = valueSimple
+		}
+		nodes = append(nodes, node)
 	}
-	sort.Ints(lines)
+	sort.Slice(nodes, func(i, j int) bool {
+		a, b := nodes[i], nodes[j]
+		if a.complexity != b.complexity {
+			return a.complexity == valueSimple
+		}
+		if a.position.Line != b.position.Line {
+			return a.position.Line < b.position.Line
+		}
+		if a.position.Col != b.position.Col {
+			return a.position.Col < b.position.Col
+		}
+		return a.key < b.key
+	})
 
-	for i, line := range lines {
-		vals[i] = m[line]
+	vals = make([]sortNode, len(nodes))
+	for i, node := range nodes {
+		vals[i] = node.sortNode
 	}
-
 	return vals
 }
 
@@ -288,7 +373,12 @@ func sortAlphabetical(t *Tree) (vals []sortNode) {
 	for k := range t.values {
 		v := t.values[k]
 		switch v.(type) {
-		case *Tree, []*Tree:
+		case *Tree, []*Tree, *tableSource:
+			if isInlineNode(v) {
+				node = sortNode{key: k, complexity: valueSimple}
+				simpVals = append(simpVals, node.key)
+				break
+			}
 			node = sortNode{key: k, complexity: valueComplex}
 			compVals = append(compVals, node.key)
 		default:
@@ -316,20 +406,141 @@ func sortAlphabetical(t *Tree) (vals []sortNode) {
 	return vals
 }
 
+// Options of the writer.
+type writeOpts struct {
+	arraysOneElementPerLine bool
+	order                   MarshalOrder
+	indentString            string
+	compactComments         bool
+	// Number of levels of sub-tables written with headers, the deeper ones
+	// being written as dotted keys. All of them have headers if negative.
+	headerLevels int
+	// Width of the lines beyond which arrays are wrapped, if positive.
+	maxWidth int
+	// Alignment of the equal signs and trailing comments of consecutive lines
+	alignEquals   bool
+	alignComments bool
+	// Number of blank lines before table headers
+	tableSpacing int
+	// Whether a blank line separates the key groups of a table
+	keyGroupSpacing bool
+}
+
+// Returns the blank lines written before a table header.
+func (opts writeOpts) tableSeparator() string {
+	if opts.tableSpacing <= 0 {
+		return ""
+	}
+	return strings.Repeat("\n", opts.tableSpacing)
+}
+
+// Returns the width of the lines of a value, given its own maxWidth, or 0 if it
+// is unlimited.
+func (opts writeOpts) width(maxWidth int) int {
+	if maxWidth == 0 {
+		maxWidth = opts.maxWidth
+	}
+	if maxWidth < 0 {
+		return 0
+	}
+	return maxWidth
+}
+
+// Checks if an inline table fits on its line, as the value of key.
+func (opts writeOpts) fitsLine(tree *Tree, indent, key string, commented bool) bool {
+	width := opts.width(tree.maxWidth)
+	if width == 0 {
+		return true
+	}
+	repr, err := tomlTreeStringRepresentation(tree, opts.order)
+	if err != nil {
+		return true
+	}
+	line := indent + key + " = " + repr
+	if commented {
+		line = "# " + line
+	}
+	return utf8.RuneCountInString(line) <= width
+}
+
+// Returns the tree with the inline tables too long for their line replaced by
+// standard tables.
+func (t *Tree) expandWideTables(indent string, opts writeOpts, commented bool) *Tree {
+	result := t
+	for k, v := range t.values {
+		tree, ok := v.(*Tree)
+		if !ok || !tree.inline || opts.fitsLine(tree, indent, quoteKeyIfNeeded(k), commented || tree.commented) {
+			continue
+		}
+		if result == t {
+			result = &Tree{}
+			*result = *t
+			result.values = make(map[string]interface{}, len(t.values))
+			for k, v := range t.values {
+				result.values[k] = v
+			}
+		}
+		expanded := *tree
+		expanded.inline = false
+		result.values[k] = &expanded
+	}
+	return result
+}
+
 func (t *Tree) writeTo(w io.Writer, indent, keyspace string, bytesCount int64, arraysOneElementPerLine bool) (int64, error) {
-	return t.writeToOrdered(w, indent, keyspace, bytesCount, arraysOneElementPerLine, OrderAlphabetical, "  ", false, false)
+	opts := writeOpts{
+		arraysOneElementPerLine: arraysOneElementPerLine,
+		order:                   OrderAlphabetical,
+		indentString:            "  ",
+		headerLevels:            -1,
+		tableSpacing:            1,
+	}
+	return t.writeToOrdered(w, indent, keyspace, bytesCount, opts, false)
+}
+
+// An array of tables, written with [[key]] headers. Its tables are built by
+// source, if set.
+type tableArray struct {
+	key       string
+	trees     []*Tree
+	source    *tableSource
+	commented bool
 }
 
-func (t *Tree) writeToOrdered(w io.Writer, indent, keyspace string, bytesCount int64, arraysOneElementPerLine bool, ord MarshalOrder, indentString string, compactComments, parentCommented bool) (int64, error) {
+func (t *Tree) writeToOrdered(w io.Writer, indent, keyspace string, bytesCount int64, opts writeOpts, parentCommented bool) (int64, error) {
+	t = t.expandWideTables(indent, opts, parentCommented || t.commented)
+
 	var orderedVals []sortNode
 
-	switch ord {
+	switch opts.order {
 	case OrderPreserve:
 		orderedVals = sortByLines(t)
 	default:
 		orderedVals = sortAlphabetical(t)
 	}
 
+	dotted := opts.headerLevels == 0
+	if dotted {
+		// Tables written as dotted keys must come before any header
+		sort.SliceStable(orderedVals, func(i, j int) bool {
+			return !isTableArray(t.values[orderedVals[i].key]) && isTableArray(t.values[orderedVals[j].key])
+		})
+	}
+	subOpts := opts
+	if opts.headerLevels > 0 {
+		subOpts.headerLevels--
+	}
+	var arrays []tableArray
+
+	// Consecutive key/value lines are written together, to be aligned
+	var lines []keyValueLine
+	flush := func() error {
+		var err error
+		bytesCount, err = writeKeyValueLines(w, indent, lines, bytesCount, opts)
+		lines = nil
+		return err
+	}
+
 	for _, node := range orderedVals {
 		switch node.complexity {
 		case valueComplex:
@@ -348,98 +559,379 @@ func (t *Tree) writeToOrdered(w io.Writer, indent, keyspace string, bytesCount i
 				if !ok {
 					return bytesCount, fmt.Errorf("invalid value type at %s: %T", k, t.values[k])
 				}
+				if dotted {
+					n := len(lines)
+					var err error
+					lines, arrays, err = tv.dottedLines(indent, combinedKey, quoteKeyIfNeeded(k), lines, arrays, opts, parentCommented || t.commented)
+					if err != nil {
+						return bytesCount, err
+					}
+					for i := n; i < len(lines); i++ {
+						lines[i].group = k
+					}
+					continue
+				}
+				if err := flush(); err != nil {
+					return bytesCount, err
+				}
+				separator := opts.tableSeparator()
 				if tv.comment != "" {
 					comment := strings.Replace(tv.comment, "\n", "\n"+indent+"#", -1)
 					start := "# "
 					if strings.HasPrefix(comment, "#") {
 						start = ""
 					}
-					writtenBytesCountComment, errc := writeStrings(w, "\n", indent, start, comment)
+					writtenBytesCountComment, errc := writeStrings(w, separator, indent, start, comment, "\n")
 					bytesCount += int64(writtenBytesCountComment)
 					if errc != nil {
 						return bytesCount, errc
 					}
+					separator = ""
 				}
 
 				var commented string
 				if parentCommented || t.commented || tv.commented {
 					commented = "# "
 				}
-				writtenBytesCount, err := writeStrings(w, "\n", indent, commented, "[", combinedKey, "]\n")
+				writtenBytesCount, err := writeStrings(w, separator, indent, commented, "[", combinedKey, "]\n")
 				bytesCount += int64(writtenBytesCount)
 				if err != nil {
 					return bytesCount, err
 				}
-				bytesCount, err = node.writeToOrdered(w, indent+indentString, combinedKey, bytesCount, arraysOneElementPerLine, ord, indentString, compactComments, parentCommented || t.commented || tv.commented)
+				bytesCount, err = node.writeToOrdered(w, indent+opts.indentString, combinedKey, bytesCount, subOpts, parentCommented || t.commented || tv.commented)
 				if err != nil {
 					return bytesCount, err
 				}
 			case []*Tree:
-				for _, subTree := range node {
-					var commented string
-					if parentCommented || t.commented || subTree.commented {
-						commented = "# "
-					}
-					writtenBytesCount, err := writeStrings(w, "\n", indent, commented, "[[", combinedKey, "]]\n")
-					bytesCount += int64(writtenBytesCount)
-					if err != nil {
-						return bytesCount, err
-					}
-
-					bytesCount, err = subTree.writeToOrdered(w, indent+indentString, combinedKey, bytesCount, arraysOneElementPerLine, ord, indentString, compactComments, parentCommented || t.commented || subTree.commented)
-					if err != nil {
-						return bytesCount, err
-					}
+				array := tableArray{key: combinedKey, trees: node, commented: parentCommented || t.commented}
+				if dotted {
+					arrays = append(arrays, array)
+					continue
+				}
+				if err := flush(); err != nil {
+					return bytesCount, err
+				}
+				var err error
+				bytesCount, err = array.writeTo(w, indent, bytesCount, subOpts)
+				if err != nil {
+					return bytesCount, err
+				}
+			case *tableSource:
+				array := tableArray{key: combinedKey, source: node, commented: parentCommented || t.commented}
+				if dotted {
+					arrays = append(arrays, array)
+					continue
+				}
+				if err := flush(); err != nil {
+					return bytesCount, err
+				}
+				var err error
+				bytesCount, err = array.writeTo(w, indent, bytesCount, subOpts)
+				if err != nil {
+					return bytesCount, err
 				}
 			}
 		default: // Simple
 			k := node.key
-			v, ok := t.values[k].(*tomlValue)
+			v, ok := asTomlValue(t.values[k])
 			if !ok {
 				return bytesCount, fmt.Errorf("invalid value type at %s: %T", k, t.values[k])
 			}
+			lines = append(lines, keyValueLine{key: quoteKeyIfNeeded(k), value: v, commented: parentCommented || t.commented || v.commented})
+		}
+	}
+	if err := flush(); err != nil {
+		return bytesCount, err
+	}
 
+	for _, array := range arrays {
+		var err error
+		bytesCount, err = array.writeTo(w, indent, bytesCount, subOpts)
+		if err != nil {
+			return bytesCount, err
+		}
+	}
+
+	return bytesCount, nil
+}
+
+func (a tableArray) writeTo(w io.Writer, indent string, bytesCount int64, opts writeOpts) (int64, error) {
+	n := len(a.trees)
+	if a.source != nil {
+		n = a.source.len
+	}
+	for i := 0; i < n; i++ {
+		var subTree *Tree
+		if a.source != nil {
+			var err error
+			if subTree, err = a.source.table(i); err != nil {
+				return bytesCount, err
+			}
+		} else {
+			subTree = a.trees[i]
+		}
+
+		var commented string
+		if a.commented || subTree.commented {
+			commented = "# "
+		}
+		writtenBytesCount, err := writeStrings(w, opts.tableSeparator(), indent, commented, "[[", a.key, "]]\n")
+		bytesCount += int64(writtenBytesCount)
+		if err != nil {
+			return bytesCount, err
+		}
+
+		bytesCount, err = subTree.writeToOrdered(w, indent+opts.indentString, a.key, bytesCount, opts, a.commented || subTree.commented)
+		if err != nil {
+			return bytesCount, err
+		}
+	}
+	return bytesCount, nil
+}
+
+// A line setting a key of a table, or the comment of a table written as dotted
+// keys when value is nil. The lines of a table written as dotted keys have the
+// key of the table as group.
+type keyValueLine struct {
+	key       string
+	value     *tomlValue
+	commented bool
+	comment   string
+	group     string
+}
+
+// Returns the width of the key of the line, comment mark included.
+func (l keyValueLine) keyWidth() int {
+	width := utf8.RuneCountInString(l.key)
+	if l.commented {
+		width += len("# ")
+	}
+	return width
+}
+
+// Appends the lines of the tree written as dotted keys starting with key, the
+// dotted key of the tree in the table being written. The arrays of tables
+// within the tree are appended to arrays, to be written after the lines.
+func (t *Tree) dottedLines(indent, keyspace, key string, lines []keyValueLine, arrays []tableArray, opts writeOpts, parentCommented bool) ([]keyValueLine, []tableArray, error) {
+	commented := parentCommented || t.commented
+	if len(t.values) == 0 {
+		v := &tomlValue{value: t, comment: t.comment}
+		return append(lines, keyValueLine{key: key, value: v, commented: commented}), arrays, nil
+	}
+	if t.comment != "" {
+		lines = append(lines, keyValueLine{comment: t.comment})
+	}
+
+	var orderedVals []sortNode
+	switch opts.order {
+	case OrderPreserve:
+		orderedVals = sortByLines(t)
+	default:
+		orderedVals = sortAlphabetical(t)
+	}
+
+	for _, node := range orderedVals {
+		k := node.key
+		v := t.values[k]
+		subKeyspace := keyspace + "." + quoteKeyIfNeeded(k)
+		subKey := key + "." + quoteKeyIfNeeded(k)
+
+		switch node := v.(type) {
+		case *Tree:
+			if !node.inline || !opts.fitsLine(node, indent, subKey, commented || node.commented) {
+				var err error
+				lines, arrays, err = node.dottedLines(indent, subKeyspace, subKey, lines, arrays, opts, commented)
+				if err != nil {
+					return lines, arrays, err
+				}
+				continue
+			}
+		case []*Tree:
+			if !isInlineNode(node) {
+				arrays = append(arrays, tableArray{key: subKeyspace, trees: node, commented: commented})
+				continue
+			}
+		case *tableSource:
+			arrays = append(arrays, tableArray{key: subKeyspace, source: node, commented: commented})
+			continue
+		}
+
+		tv, ok := asTomlValue(v)
+		if !ok {
+			return lines, arrays, fmt.Errorf("invalid value type at %s: %T", k, v)
+		}
+		lines = append(lines, keyValueLine{key: subKey, value: tv, commented: commented || tv.commented})
+	}
+	return lines, arrays, nil
+}
+
+// Returns the node of a tree written as a value: a value, an inline table, or
+// an array of inline tables.
+func asTomlValue(node interface{}) (*tomlValue, bool) {
+	switch node := node.(type) {
+	case *tomlValue:
+		return node, true
+	case *Tree:
+		return &tomlValue{value: node, comment: node.comment, trailingComment: node.trailingComment, commented: node.commented, maxWidth: node.maxWidth}, node.inline
+	case []*Tree:
+		tv := &tomlValue{value: node}
+		if len(node) > 0 {
+			tv.maxWidth = node[0].maxWidth
+		}
+		return tv, isInlineNode(node)
+	default:
+		return nil, false
+	}
+}
+
+// Writes consecutive key/value lines, with their comments. The lines form
+// blocks separated by comment lines and by key groups, in which the equal signs
+// are aligned with alignEquals. Trailing comments are written at the end of
+// their line, aligned within the block with alignComments. With
+// keyGroupSpacing, a blank line separates the key groups.
+func writeKeyValueLines(w io.Writer, indent string, lines []keyValueLine, bytesCount int64, opts writeOpts) (int64, error) {
+	trailing := func(l keyValueLine) bool {
+		return l.value.trailingComment != "" && !strings.Contains(l.value.trailingComment, "\n")
+	}
+	commentAbove := func(l keyValueLine) bool {
+		return l.value == nil || l.value.comment != ""
+	}
+	newGroup := func(i int) bool {
+		return i > 0 && lines[i].group != lines[i-1].group
+	}
+
+	for start := 0; start < len(lines); {
+		// Comments are already preceded by a blank line, unless compact
+		if opts.keyGroupSpacing && newGroup(start) && (opts.compactComments || !commentAbove(lines[start])) {
+			writtenBytesCount, err := writeStrings(w, "\n")
+			bytesCount += int64(writtenBytesCount)
+			if err != nil {
+				return bytesCount, err
+			}
+		}
+		if lines[start].value == nil {
+			var err error
+			bytesCount, err = writeComment(w, indent, lines[start].comment, bytesCount, opts.compactComments)
+			if err != nil {
+				return bytesCount, err
+			}
+			start++
+			continue
+		}
+
+		// A block ends before the next comment line or key group
+		end := start + 1
+		for end < len(lines) && !commentAbove(lines[end]) && !newGroup(end) {
+			end++
+		}
+		block := lines[start:end]
+
+		// Commented lines are aligned with the others, their keys included
+		keyWidth := 0
+		if opts.alignEquals {
+			for _, l := range block {
+				if width := l.keyWidth(); width > keyWidth {
+					keyWidth = width
+				}
+			}
+		}
+
+		prefixes := make([]string, len(block))
+		reprs := make([]string, len(block))
+		commentColumn := 0
+		for i, l := range block {
 			var commented string
-			if parentCommented || t.commented || v.commented {
+			if l.commented {
 				commented = "# "
 			}
-			repr, err := tomlValueStringRepresentation(v, commented, indent, ord, arraysOneElementPerLine)
+			var padding string
+			if width := l.keyWidth(); width < keyWidth {
+				padding = strings.Repeat(" ", keyWidth-width)
+			}
+			prefixes[i] = indent + commented + l.key + padding + " = "
+
+			var err error
+			if width := opts.width(l.value.maxWidth); width > 0 && !opts.arraysOneElementPerLine {
+				reprs[i], err = wrappedValueStringRepresentation(l.value, commented, indent, opts.order, utf8.RuneCountInString(prefixes[i]), width)
+			} else {
+				reprs[i], err = tomlValueStringRepresentation(l.value, commented, indent, opts.order, opts.arraysOneElementPerLine)
+			}
 			if err != nil {
 				return bytesCount, err
 			}
 
-			if v.comment != "" {
-				comment := strings.Replace(v.comment, "\n", "\n"+indent+"#", -1)
-				start := "# "
-				if strings.HasPrefix(comment, "#") {
-					start = ""
+			lastLine := prefixes[i] + reprs[i]
+			if n := strings.LastIndex(lastLine, "\n"); n >= 0 {
+				lastLine = lastLine[n+1:]
+			}
+			if width := utf8.RuneCountInString(lastLine); width > commentColumn {
+				commentColumn = width
+			}
+		}
+
+		for i, l := range block {
+			if l.value.comment != "" {
+				var err error
+				bytesCount, err = writeComment(w, indent, l.value.comment, bytesCount, opts.compactComments)
+				if err != nil {
+					return bytesCount, err
 				}
-				if !compactComments {
-					writtenBytesCountComment, errc := writeStrings(w, "\n")
-					bytesCount += int64(writtenBytesCountComment)
-					if errc != nil {
-						return bytesCount, errc
+			}
+			// A trailing comment of several lines is written above as well
+			if l.value.trailingComment != "" && !trailing(l) {
+				var err error
+				bytesCount, err = writeComment(w, indent, l.value.trailingComment, bytesCount, opts.compactComments)
+				if err != nil {
+					return bytesCount, err
+				}
+			}
+
+			var comment string
+			if trailing(l) {
+				padding := " "
+				if opts.alignComments {
+					lastLine := prefixes[i] + reprs[i]
+					if n := strings.LastIndex(lastLine, "\n"); n >= 0 {
+						lastLine = lastLine[n+1:]
 					}
+					padding = strings.Repeat(" ", commentColumn-utf8.RuneCountInString(lastLine)+1)
 				}
-				writtenBytesCountComment, errc := writeStrings(w, indent, start, comment, "\n")
-				bytesCount += int64(writtenBytesCountComment)
-				if errc != nil {
-					return bytesCount, errc
+				start := "# "
+				if strings.HasPrefix(l.value.trailingComment, "#") {
+					start = ""
 				}
+				comment = padding + start + l.value.trailingComment
 			}
 
-			quotedKey := quoteKeyIfNeeded(k)
-			writtenBytesCount, err := writeStrings(w, indent, commented, quotedKey, " = ", repr, "\n")
+			writtenBytesCount, err := writeStrings(w, prefixes[i], reprs[i], comment, "\n")
 			bytesCount += int64(writtenBytesCount)
 			if err != nil {
 				return bytesCount, err
 			}
 		}
+		start = end
 	}
-
 	return bytesCount, nil
 }
 
+func writeComment(w io.Writer, indent, comment string, bytesCount int64, compactComments bool) (int64, error) {
+	comment = strings.Replace(comment, "\n", "\n"+indent+"#", -1)
+	start := "# "
+	if strings.HasPrefix(comment, "#") {
+		start = ""
+	}
+	if !compactComments {
+		writtenBytesCountComment, errc := writeStrings(w, "\n")
+		bytesCount += int64(writtenBytesCountComment)
+		if errc != nil {
+			return bytesCount, errc
+		}
+	}
+	writtenBytesCountComment, errc := writeStrings(w, indent, start, comment, "\n")
+	bytesCount += int64(writtenBytesCountComment)
+	return bytesCount, errc
+}
+
 // quote a key if it does not fit the bare key format (A-Za-z0-9_-)
 // quoted keys use the same rules as strings
 func quoteKeyIfNeeded(k string) string {
@@ -480,6 +972,7 @@ func writeStrings(w io.Writer, s ...string) (int, error) {
 
 // WriteTo encode the Tree as Toml and writes it to the writer w.
 // Returns the number of bytes written in case of success, or an error if anything happened.
+// See WriteFormatted to change the layout of the document.
 func (t *Tree) WriteTo(w io.Writer) (int64, error) {
 	return t.writeTo(w, "", "", 0, false)
 }
@@ -364,6 +364,57 @@ c = nan`
 	}
 }
 
+func TestTreeWriteToInlineTables(t *testing.T) {
+	doc := `name = "x"
+point = { x = 1, y = { z = "a" } }
+points = [{ x = 1 }, { tags = [1, 2], x = 2 }]
+
+[[servers]]
+  host = "a"
+
+[table]
+  inner = { a = 1 }
+`
+	tree, err := Load(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	str, err := tree.ToTomlString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str != doc {
+		t.Fatalf("Expected:\n%s\nGot:\n%s", doc, str)
+	}
+
+	tree.GetPath([]string{"table"}).(*Tree).SetPath([]string{"empty"}, &Tree{values: map[string]interface{}{}, inline: true})
+	tree.Get("points").([]*Tree)[0].inline = false
+	str, err = tree.ToTomlString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `name = "x"
+point = { x = 1, y = { z = "a" } }
+
+[[points]]
+  x = 1
+
+[[points]]
+  tags = [1, 2]
+  x = 2
+
+[[servers]]
+  host = "a"
+
+[table]
+  empty = {}
+  inner = { a = 1 }
+`
+	if str != expected {
+		t.Fatalf("Expected:\n%s\nGot:\n%s", expected, str)
+	}
+}
+
 func TestOrderedEmptyTrees(t *testing.T) {
 	type val struct {
 		Key string `toml:"key"`
@@ -484,3 +535,147 @@ test_string = "You'll hate me after this - #"          # " Annoying, isn't it?
 #         and here"
 #         ]     End of array comment, forgot the #
 #number = 3.14  pi <--again forgot the #         `
+
+func TestOrderedInlineTablesRoundTrip(t *testing.T) {
+	tree, err := Load(`a = {x=1, y={z=2}, w = 3}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := NewEncoder(buf).Order(OrderPreserve).Encode(tree); err != nil {
+		t.Fatal(err)
+	}
+	expected := "a = { x = 1, y = { z = 2 }, w = 3 }\n"
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+	reloaded, err := Load(buf.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reloaded.ToMap(), tree.ToMap()) {
+		t.Errorf("round trip changed the tree: %v, want %v", reloaded.ToMap(), tree.ToMap())
+	}
+}
+
+func TestOrderedInlineTablesSourceOrder(t *testing.T) {
+	input := `zeta = 1
+point = {y = 2, x = 1, c = {b = 2, a = 1}}
+alpha = "a"
+points = [{y = 2, x = 1}, {b = 2, a = 1}]
+
+[table]
+inline = {m = 1, l = 2, k = 3}
+`
+	tree, err := Load(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := NewEncoder(buf).Order(OrderPreserve).Encode(tree); err != nil {
+		t.Fatal(err)
+	}
+	expected := `zeta = 1
+point = { y = 2, x = 1, c = { b = 2, a = 1 } }
+alpha = "a"
+points = [{ y = 2, x = 1 }, { b = 2, a = 1 }]
+
+[table]
+  inline = { m = 1, l = 2, k = 3 }
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestOrderedMaxLineWidth(t *testing.T) {
+	input := `name = "wide"
+a = {first = "aaaaaaaaaaaa", second = "bbbbbbbbbbbb", third = "cccccccccccc"}
+pts = 1
+b = {x = 1}
+`
+	tree, err := Load(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := NewEncoder(buf).Order(OrderPreserve).MaxLineWidth(40).Encode(tree); err != nil {
+		t.Fatal(err)
+	}
+	expected := `name = "wide"
+pts = 1
+b = { x = 1 }
+
+[a]
+  first = "aaaaaaaaaaaa"
+  second = "bbbbbbbbbbbb"
+  third = "cccccccccccc"
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+	reloaded, err := Load(buf.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reloaded.ToMap(), tree.ToMap()) {
+		t.Errorf("round trip changed the tree: %v, want %v", reloaded.ToMap(), tree.ToMap())
+	}
+}
+
+func TestTreeWriteTrailingComments(t *testing.T) {
+	input := `# the title
+title = "app" # shown
+version = 2
+point = {x = 1} #origin
+
+[server]
+host = "localhost" ## address
+ports = [
+  80, # http
+  443,
+] # served
+`
+	tree, err := Load(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.SetWithOptions("server.name", SetOptions{Comment: "above", TrailingComment: "after"}, "main")
+
+	tests := []struct {
+		align    bool
+		expected string
+	}{
+		{false, `title   = "app" # shown
+version = 2
+point   = { x = 1 } #origin
+
+[server]
+  host  = "localhost" ## address
+  ports = [80, 443] # served
+
+  # above
+  name = "main" # after
+`},
+		{true, `title   = "app"     # shown
+version = 2
+point   = { x = 1 } #origin
+
+[server]
+  host  = "localhost" ## address
+  ports = [80, 443]   # served
+
+  # above
+  name = "main" # after
+`},
+	}
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		if err := NewEncoder(buf).Order(OrderPreserve).AlignEquals(true).AlignComments(test.align).Encode(tree); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("expected:\n%s\ngot:\n%s", test.expected, buf.String())
+		}
+	}
+}
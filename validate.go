@@ -0,0 +1,309 @@
+// Validation of the struct fields filled by the Decoder.
+
+package toml
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Struct tag holding the validation rules of a field, such as
+// toml_validate:"min=1,max=10".
+const tagValidate = "toml_validate"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// FieldError is a requirement of a struct field that the decoded document does
+// not meet. The path and position are those of the key the field is decoded
+// from, or of its table when the key is missing. Filename is the file defining
+// them, if any.
+type FieldError struct {
+	Path     KeyPath
+	Position Position
+	Filename string
+	Err      error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", Source{Filename: e.Filename, Position: e.Position}, e.Path, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError is the error returned by a Decoder when struct fields do not
+// meet their requirements. It lists every failure of the document, in the
+// order of their positions.
+type ValidationError []*FieldError
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Records a failed requirement of the field decoded from key, located at pos.
+func (d *Decoder) fieldError(key string, pos Source, err error) {
+	path := append(append(KeyPath(nil), d.path...), key)
+	d.invalid = append(d.invalid, &FieldError{Path: path, Position: pos.Position, Filename: pos.Filename, Err: err})
+}
+
+// Returns the failed requirements recorded while decoding, if any.
+func (d *Decoder) validationError() error {
+	if len(d.invalid) == 0 {
+		return nil
+	}
+	sort.SliceStable(d.invalid, func(i, j int) bool {
+		a, b := d.invalid[i].Position, d.invalid[j].Position
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	return d.invalid
+}
+
+type validationCheck func(mval reflect.Value, arg string) (string, error)
+
+var validations = map[string]validationCheck{
+	"min":     validateMin,
+	"max":     validateMax,
+	"len":     validateLen,
+	"oneof":   validateOneOf,
+	"pattern": validatePattern,
+}
+
+// A rule of the toml_validate tag of a field.
+type validationRule struct {
+	name  string
+	arg   string
+	check validationCheck
+}
+
+// Parses the rules of a toml_validate tag, written as name=arg and separated
+// by commas. A comma is part of the argument of a rule unless it is followed
+// by the name of a rule and "=", so that patterns may contain commas.
+func parseValidationRules(tag string) ([]validationRule, error) {
+	var rules []validationRule
+	for tag != "" {
+		eq := strings.IndexByte(tag, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("missing argument of rule %q", tag)
+		}
+		name, rest := tag[:eq], tag[eq+1:]
+		check, ok := validations[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown rule %q", name)
+		}
+		end := len(rest)
+		for i := 0; i < len(rest); i++ {
+			if rest[i] == ',' && startsWithRule(rest[i+1:]) {
+				end = i
+				break
+			}
+		}
+		rules = append(rules, validationRule{name: name, arg: rest[:end], check: check})
+		tag = strings.TrimPrefix(rest[end:], ",")
+	}
+	return rules, nil
+}
+
+func startsWithRule(s string) bool {
+	for name := range validations {
+		if strings.HasPrefix(s, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the value of a field against its validation rules. It returns the
+// failures of the value, or an error if a rule is invalid. Nil pointers are
+// not checked.
+func validateField(f structField, mval reflect.Value) ([]error, error) {
+	if f.rulesErr != nil {
+		return nil, fmt.Errorf("invalid %s tag of field %s: %s", tagValidate, f.field.Name, f.rulesErr)
+	}
+	for mval.Kind() == reflect.Ptr || mval.Kind() == reflect.Interface {
+		if mval.IsNil() {
+			return nil, nil
+		}
+		mval = mval.Elem()
+	}
+	var failures []error
+	for _, rule := range f.rules {
+		failure, err := rule.check(mval, rule.arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s rule of field %s: %s", rule.name, f.field.Name, err)
+		}
+		if failure != "" {
+			failures = append(failures, errors.New(failure))
+		}
+	}
+	return failures, nil
+}
+
+func validateMin(mval reflect.Value, arg string) (string, error) {
+	c, length, err := compareBound(mval, arg)
+	switch {
+	case err != nil || c >= 0:
+		return "", err
+	case length:
+		return "length must be at least " + arg, nil
+	default:
+		return "must be at least " + arg, nil
+	}
+}
+
+func validateMax(mval reflect.Value, arg string) (string, error) {
+	c, length, err := compareBound(mval, arg)
+	switch {
+	case err != nil || c <= 0:
+		return "", err
+	case length:
+		return "length must be at most " + arg, nil
+	default:
+		return "must be at most " + arg, nil
+	}
+}
+
+func validateLen(mval reflect.Value, arg string) (string, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		return "", err
+	}
+	l, ok := length(mval)
+	if !ok {
+		return "", fmt.Errorf("unsupported type %v", mval.Type())
+	}
+	if l != n {
+		return "length must be " + arg, nil
+	}
+	return "", nil
+}
+
+func validateOneOf(mval reflect.Value, arg string) (string, error) {
+	options := strings.Fields(arg)
+	for _, option := range options {
+		var equal bool
+		switch mval.Kind() {
+		case reflect.String:
+			equal = mval.String() == option
+		case reflect.Bool:
+			b, err := strconv.ParseBool(option)
+			if err != nil {
+				return "", err
+			}
+			equal = mval.Bool() == b
+		default:
+			c, err := compareNumber(mval, option)
+			if err != nil {
+				return "", err
+			}
+			equal = c == 0
+		}
+		if equal {
+			return "", nil
+		}
+	}
+	return "must be one of " + strings.Join(options, ", "), nil
+}
+
+func validatePattern(mval reflect.Value, arg string) (string, error) {
+	if mval.Kind() != reflect.String {
+		return "", fmt.Errorf("unsupported type %v", mval.Type())
+	}
+	re, err := regexp.Compile(arg)
+	if err != nil {
+		return "", err
+	}
+	if !re.MatchString(mval.String()) {
+		return "must match pattern " + arg, nil
+	}
+	return "", nil
+}
+
+// Compares a value to the bound of a min or max rule. Numbers are compared by
+// value, and strings, arrays, slices and maps by length.
+func compareBound(mval reflect.Value, arg string) (c int, isLength bool, err error) {
+	if l, ok := length(mval); ok {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return 0, true, err
+		}
+		return compareInts(int64(l), int64(n)), true, nil
+	}
+	c, err = compareNumber(mval, arg)
+	return c, false, err
+}
+
+// Returns the length of strings in characters, and of arrays, slices and maps
+// in elements.
+func length(mval reflect.Value) (int, bool) {
+	switch mval.Kind() {
+	case reflect.String:
+		return utf8.RuneCountInString(mval.String()), true
+	case reflect.Array, reflect.Slice, reflect.Map:
+		return mval.Len(), true
+	default:
+		return 0, false
+	}
+}
+
+// Compares a number to the one written in s. Durations can also be written
+// with units, such as "5m".
+func compareNumber(mval reflect.Value, s string) (int, error) {
+	switch mval.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil && mval.Type() == durationType {
+			var d time.Duration
+			d, err = time.ParseDuration(s)
+			n = int64(d)
+		}
+		return compareInts(mval.Int(), n), err
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(s, 10, 64)
+		switch v := mval.Uint(); {
+		case v < n:
+			return -1, err
+		case v > n:
+			return 1, err
+		default:
+			return 0, err
+		}
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		switch v := mval.Float(); {
+		case v < n:
+			return -1, err
+		case v > n:
+			return 1, err
+		default:
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("unsupported type %v", mval.Type())
+	}
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
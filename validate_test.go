@@ -0,0 +1,152 @@
+package toml
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type validatedServer struct {
+	Host    string        `toml:"host,required" toml_validate:"pattern=^[a-z.]+$"`
+	Port    int           `toml:"port,required" toml_validate:"min=1,max=65535"`
+	Mode    string        `toml:"mode" default:"dev" toml_validate:"oneof=dev prod"`
+	Tags    []string      `toml:"tags" toml_validate:"min=1,max=3"`
+	Key     string        `toml:"key" toml_validate:"len=4"`
+	Timeout time.Duration `toml:"timeout" toml_validate:"min=1s,max=1m"`
+	Weight  *float64      `toml:"weight" toml_validate:"min=0,max=1"`
+}
+
+type validatedConfig struct {
+	Name    string            `toml:"name,required" toml_validate:"max=8"`
+	Servers []validatedServer `toml:"servers"`
+	Limits  map[string]uint   `toml:"limits" toml_validate:"max=2"`
+}
+
+func TestDecoderValidation(t *testing.T) {
+	valid := `
+name = "app"
+limits = { cpu = 2 }
+
+[[servers]]
+host = "example.com"
+port = 8080
+tags = ["a"]
+key = "abcd"
+timeout = "30s"
+weight = 0.5
+`
+	var v validatedConfig
+	if err := Unmarshal([]byte(valid), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Servers[0].Mode != "dev" || *v.Servers[0].Weight != 0.5 {
+		t.Errorf("unexpected value: %+v", v)
+	}
+
+	invalid := `
+name = "application"
+limits = { cpu = 2, mem = 4, io = 1 }
+
+[[servers]]
+host = "Example.com"
+port = 0
+mode = "test"
+tags = []
+key = "abc"
+timeout = "2m"
+weight = 1.5
+
+[[servers]]
+`
+	err := Unmarshal([]byte(invalid), &v)
+	var verr ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+	expected := []string{
+		"(2, 1): name: length must be at most 8",
+		"(3, 1): limits: length must be at most 2",
+		`(6, 1): servers.0.host: must match pattern ^[a-z.]+$`,
+		"(7, 1): servers.0.port: must be at least 1",
+		"(8, 1): servers.0.mode: must be one of dev, prod",
+		"(9, 1): servers.0.tags: length must be at least 1",
+		"(10, 1): servers.0.key: length must be 4",
+		"(11, 1): servers.0.timeout: must be at most 1m",
+		"(12, 1): servers.0.weight: must be at most 1",
+		"(14, 1): servers.1.host: missing required key",
+		"(14, 1): servers.1.port: missing required key",
+	}
+	if err.Error() != strings.Join(expected, "\n") {
+		t.Errorf("expected error\n%s\ngot\n%s", strings.Join(expected, "\n"), err)
+	}
+	if verr[1].Path.String() != "limits" || verr[1].Position.Line != 3 {
+		t.Errorf("unexpected field error: %#v", verr[1])
+	}
+}
+
+func TestDecoderRequiredFromEnv(t *testing.T) {
+	var v struct {
+		Token string `toml:"token,required" env:"TOKEN" toml_validate:"len=3"`
+	}
+	lookup := func(s string) (string, bool) {
+		return "abc", s == "TOKEN"
+	}
+	if err := NewDecoder(strings.NewReader("")).LookupEnv(lookup).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Token != "abc" {
+		t.Errorf("unexpected token: %q", v.Token)
+	}
+
+	err := NewDecoder(strings.NewReader("")).Decode(&v)
+	if err == nil || err.Error() != "(1, 1): token: missing required key" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDecoderInvalidValidationTag(t *testing.T) {
+	var v struct {
+		Enabled bool `toml:"enabled" toml_validate:"min=1"`
+	}
+	err := Unmarshal([]byte("enabled = true"), &v)
+	if err == nil || err.Error() != "invalid min rule of field Enabled: unsupported type bool" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	var w struct {
+		Name string `toml:"name" toml_validate:"size=1"`
+	}
+	err = Unmarshal([]byte("name = 'a'"), &w)
+	if err == nil || err.Error() != `invalid toml_validate tag of field Name: unknown rule "size"` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidationRules(t *testing.T) {
+	rules, err := parseValidationRules("min=1,pattern=^[a-z]{1,3}(,[a-z]+)*$,max=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed []string
+	for _, rule := range rules {
+		parsed = append(parsed, rule.name+" "+rule.arg)
+	}
+	expected := []string{"min 1", "pattern ^[a-z]{1,3}(,[a-z]+)*$", "max 3"}
+	if strings.Join(parsed, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected %q, got %q", expected, parsed)
+	}
+}
+
+func TestDecoderIgnoresOtherLibrariesTags(t *testing.T) {
+	var v struct {
+		Token string `toml:"token" required:"true" envconfig:"TOKEN"`
+		Level int    `toml:"level" min:"x" len:"y"`
+	}
+	if err := Unmarshal([]byte("level = 3"), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Level != 3 {
+		t.Errorf("unexpected value: %+v", v)
+	}
+}
@@ -0,0 +1,19 @@
+// Package watch reloads TOML configurations when their files change.
+//
+// A Watcher polls the files of a configuration, including the files they
+// include with toml.LoadFS, and the directories searched by include patterns.
+// When one of them changes, the configuration is loaded again, decoded into a
+// fresh value, validated, and delivered through callbacks or a channel:
+//
+//	w := watch.New(os.DirFS("/etc/app"), func() interface{} { return new(Config) }, "app.toml").
+//		OnChange(func(v interface{}) { apply(v.(*Config)) }).
+//		OnError(func(err error) { log.Print(err) })
+//	go w.Run(ctx)
+//
+// Polling compares the modification time and size of the files, and the hash
+// of their content when these differ, so that it works on every platform
+// without additional dependencies. A configuration that fails to load or to
+// validate is reported as an error, and the last good value is kept.
+//
+// The package requires Go 1.16 or later.
+package watch
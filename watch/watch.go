@@ -0,0 +1,347 @@
+//go:build go1.16
+// +build go1.16
+
+package watch
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+// DefaultInterval is the time between two polls of a Watcher, unless changed
+// with Interval.
+const DefaultInterval = time.Second
+
+// Update is a new value of a configuration, or the error that prevented
+// loading it.
+type Update struct {
+	Value interface{}
+	Err   error
+}
+
+// Watcher reloads a configuration when its files change.
+type Watcher struct {
+	fsys        fs.FS
+	names       []string
+	newValue    func() interface{}
+	interval    time.Duration
+	validate    func(interface{}) error
+	loadOptions []toml.LoadOption
+	onChange    func(interface{})
+	onError     func(error)
+
+	mu      sync.Mutex
+	current interface{}
+	files   map[string]fileState
+}
+
+type fileState struct {
+	exists  bool
+	dir     bool
+	modTime time.Time
+	size    int64
+	sum     [sha256.Size]byte
+}
+
+// New returns a Watcher of the files names of fsys. They are loaded with
+// toml.LoadFS, and decoded in order into the value returned by newValue, which
+// must be a pointer, so that later files override the keys of earlier ones.
+func New(fsys fs.FS, newValue func() interface{}, names ...string) *Watcher {
+	return &Watcher{
+		fsys:     fsys,
+		names:    names,
+		newValue: newValue,
+		interval: DefaultInterval,
+	}
+}
+
+// Interval sets the time between two polls of the files. A duration that is
+// not positive restores DefaultInterval.
+func (w *Watcher) Interval(d time.Duration) *Watcher {
+	if d <= 0 {
+		d = DefaultInterval
+	}
+	w.interval = d
+	return w
+}
+
+// Validate sets a function called on every decoded value. An error rejects the
+// value, and is reported like a loading error.
+func (w *Watcher) Validate(validate func(interface{}) error) *Watcher {
+	w.validate = validate
+	return w
+}
+
+// LoadOptions sets the options given to toml.LoadFS.
+func (w *Watcher) LoadOptions(opts ...toml.LoadOption) *Watcher {
+	w.loadOptions = opts
+	return w
+}
+
+// OnChange sets a function called with every new value of the configuration.
+func (w *Watcher) OnChange(f func(interface{})) *Watcher {
+	w.onChange = f
+	return w
+}
+
+// OnError sets a function called with the errors of the configurations that
+// failed to load or to validate.
+func (w *Watcher) OnError(f func(error)) *Watcher {
+	w.onError = f
+	return w
+}
+
+// Current returns the last value of the configuration that loaded
+// successfully, or nil if there is none.
+func (w *Watcher) Current() interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current
+}
+
+// Run loads the configuration, then polls its files and reloads it when they
+// change, until ctx is done. Every load is reported to the OnChange or OnError
+// functions. Run returns the error of ctx.
+func (w *Watcher) Run(ctx context.Context) error {
+	return w.run(ctx, func(Update) {})
+}
+
+// Updates is the same as Run, but runs in a new goroutine and also sends every
+// load to the returned channel, which is closed once ctx is done.
+func (w *Watcher) Updates(ctx context.Context) <-chan Update {
+	c := make(chan Update)
+	go func() {
+		defer close(c)
+		w.run(ctx, func(u Update) {
+			select {
+			case c <- u:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return c
+}
+
+func (w *Watcher) run(ctx context.Context, send func(Update)) error {
+	deliver := func() {
+		value, err := w.reload()
+		if err != nil {
+			if w.onError != nil {
+				w.onError(err)
+			}
+		} else if w.onChange != nil {
+			w.onChange(value)
+		}
+		send(Update{Value: value, Err: err})
+	}
+
+	deliver()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if w.changed() {
+				deliver()
+			}
+		}
+	}
+}
+
+// Loads the configuration, and records the state of the files it read.
+func (w *Watcher) reload() (interface{}, error) {
+	rec := &recordingFS{fsys: w.fsys, files: make(map[string]*fileState)}
+	value, err := w.load(rec)
+
+	files := make(map[string]fileState, len(rec.files))
+	for name, state := range rec.files {
+		if state == nil {
+			// Opened without being read, for example to check that it exists
+			files[name] = w.stat(name, fileState{})
+		} else {
+			files[name] = *state
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files = files
+	if err != nil {
+		return nil, err
+	}
+	w.current = value
+	return value, nil
+}
+
+func (w *Watcher) load(fsys fs.FS) (interface{}, error) {
+	value := w.newValue()
+	for _, name := range w.names {
+		tree, err := toml.LoadFS(fsys, name, w.loadOptions...)
+		if err != nil {
+			return nil, err
+		}
+		if err := tree.Unmarshal(value); err != nil {
+			return nil, err
+		}
+	}
+	if w.validate != nil {
+		if err := w.validate(value); err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+// Reports whether a file read by the last load changed since.
+func (w *Watcher) changed() bool {
+	w.mu.Lock()
+	prevFiles := w.files
+	w.mu.Unlock()
+
+	changed := false
+	files := make(map[string]fileState, len(prevFiles))
+	for name, prev := range prevFiles {
+		state := w.stat(name, prev)
+		if state.exists != prev.exists || state.dir != prev.dir || state.sum != prev.sum {
+			changed = true
+		}
+		files[name] = state
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files = files
+	return changed
+}
+
+// Returns the current state of the file name. The content of a file is only
+// hashed again if its modification time or size differs from prev.
+func (w *Watcher) stat(name string, prev fileState) fileState {
+	info, err := fs.Stat(w.fsys, name)
+	if err != nil {
+		return fileState{}
+	}
+	state := fileState{
+		exists:  true,
+		dir:     info.IsDir(),
+		modTime: info.ModTime(),
+		size:    info.Size(),
+	}
+
+	if state.dir {
+		entries, err := fs.ReadDir(w.fsys, name)
+		if err != nil {
+			return fileState{}
+		}
+		state.sum = entriesSum(entries)
+		return state
+	}
+
+	if prev.exists && !prev.dir && prev.modTime.Equal(state.modTime) && prev.size == state.size {
+		state.sum = prev.sum
+		return state
+	}
+	b, err := fs.ReadFile(w.fsys, name)
+	if err != nil {
+		return fileState{}
+	}
+	state.sum = sha256.Sum256(b)
+	return state
+}
+
+// Returns the hash of the names of the entries of a directory.
+func entriesSum(entries []fs.DirEntry) [sha256.Size]byte {
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	sort.Strings(names)
+	return sha256.Sum256([]byte(strings.Join(names, "/")))
+}
+
+// recordingFS records the state of the files and directories opened in fsys,
+// as they were read. The state of the ones opened without being read is nil.
+type recordingFS struct {
+	fsys  fs.FS
+	files map[string]*fileState
+}
+
+func (r *recordingFS) Open(name string) (fs.File, error) {
+	if _, ok := r.files[name]; !ok {
+		r.files[name] = nil
+	}
+	f, err := r.fsys.Open(name)
+	if err != nil {
+		r.files[name] = &fileState{}
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return f, nil
+	}
+	return &recordingFile{
+		File:  f,
+		files: r.files,
+		name:  name,
+		state: fileState{
+			exists:  true,
+			dir:     info.IsDir(),
+			modTime: info.ModTime(),
+			size:    info.Size(),
+		},
+		hash: sha256.New(),
+	}, nil
+}
+
+// recordingFile hashes what is read from a file, and records its state in
+// files once it is closed.
+type recordingFile struct {
+	fs.File
+	files   map[string]*fileState
+	name    string
+	state   fileState
+	hash    hash.Hash
+	read    bool
+	entries []fs.DirEntry
+}
+
+func (f *recordingFile) Read(b []byte) (int, error) {
+	n, err := f.File.Read(b)
+	f.hash.Write(b[:n])
+	f.read = true
+	return n, err
+}
+
+func (f *recordingFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	dir, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.New("not implemented")}
+	}
+	entries, err := dir.ReadDir(n)
+	f.entries = append(f.entries, entries...)
+	f.read = true
+	return entries, err
+}
+
+func (f *recordingFile) Close() error {
+	if f.read {
+		if f.state.dir {
+			f.state.sum = entriesSum(f.entries)
+		} else {
+			copy(f.state.sum[:], f.hash.Sum(nil))
+		}
+		f.files[f.name] = &f.state
+	}
+	return f.File.Close()
+}
@@ -0,0 +1,224 @@
+//go:build go1.16
+// +build go1.16
+
+package watch
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+type testConfig struct {
+	Name  string `toml:"name"`
+	Port  int    `toml:"port"`
+	Debug bool   `toml:"debug"`
+}
+
+func newTestConfig() interface{} {
+	return new(testConfig)
+}
+
+func TestWatcherReload(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app.toml": {Data: []byte(`
+include = "conf.d/*.toml"
+name = "app"
+port = 80
+`)},
+		"conf.d/debug.toml": {Data: []byte(`debug = true`)},
+	}
+	w := New(fsys, newTestConfig, "app.toml").Validate(func(v interface{}) error {
+		if v.(*testConfig).Port == 0 {
+			return errors.New("port is required")
+		}
+		return nil
+	})
+
+	value, err := w.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := value.(*testConfig); *c != (testConfig{Name: "app", Port: 80, Debug: true}) {
+		t.Fatalf("unexpected config: %+v", c)
+	}
+	if w.changed() {
+		t.Fatal("no file changed")
+	}
+
+	steps := []struct {
+		name   string
+		change func()
+		err    string
+		config testConfig
+	}{
+		{
+			name:   "same content",
+			change: func() { fsys["app.toml"].ModTime = time.Unix(1, 0) },
+			config: testConfig{Name: "app", Port: 80, Debug: true},
+		},
+		{
+			name: "included file",
+			change: func() {
+				fsys["conf.d/debug.toml"] = &fstest.MapFile{Data: []byte(`debug = false`), ModTime: time.Unix(2, 0)}
+			},
+			config: testConfig{Name: "app", Port: 80},
+		},
+		{
+			name: "parse error",
+			change: func() {
+				fsys["app.toml"] = &fstest.MapFile{Data: []byte("port = "), ModTime: time.Unix(3, 0)}
+			},
+			err:    "app.toml:(1, 8): expecting a value",
+			config: testConfig{Name: "app", Port: 80},
+		},
+		{
+			name: "validation error",
+			change: func() {
+				fsys["app.toml"] = &fstest.MapFile{Data: []byte(`include = "conf.d/*.toml"`), ModTime: time.Unix(4, 0)}
+			},
+			err:    "port is required",
+			config: testConfig{Name: "app", Port: 80},
+		},
+		{
+			name: "new included file",
+			change: func() {
+				fsys["app.toml"] = &fstest.MapFile{Data: []byte(`include = "conf.d/*.toml"`), ModTime: time.Unix(5, 0)}
+				fsys["conf.d/port.toml"] = &fstest.MapFile{Data: []byte(`port = 8080`)}
+			},
+			config: testConfig{Port: 8080},
+		},
+	}
+
+	for _, step := range steps {
+		step.change()
+		if !w.changed() {
+			if step.name != "same content" {
+				t.Errorf("%s: change not detected", step.name)
+			}
+			continue
+		} else if step.name == "same content" {
+			t.Errorf("%s: unexpected change", step.name)
+		}
+
+		_, err := w.reload()
+		if step.err == "" && err != nil {
+			t.Errorf("%s: unexpected error %s", step.name, err)
+		}
+		if step.err != "" && (err == nil || err.Error() != step.err) {
+			t.Errorf("%s: expected error %q, got %v", step.name, step.err, err)
+		}
+		if c := w.Current().(*testConfig); *c != step.config {
+			t.Errorf("%s: expected %+v, got %+v", step.name, step.config, c)
+		}
+	}
+}
+
+// editingFS replaces the file name of a MapFS by edit once it has been read,
+// as if it was edited right after a load.
+type editingFS struct {
+	fstest.MapFS
+	name string
+	edit *fstest.MapFile
+}
+
+func (e *editingFS) Open(name string) (fs.File, error) {
+	f, err := e.MapFS.Open(name)
+	if err != nil || name != e.name || e.edit == nil {
+		return f, err
+	}
+	return &editedFile{File: f, fsys: e}, nil
+}
+
+type editedFile struct {
+	fs.File
+	fsys *editingFS
+}
+
+func (f *editedFile) Close() error {
+	f.fsys.MapFS[f.fsys.name], f.fsys.edit = f.fsys.edit, nil
+	return f.File.Close()
+}
+
+func TestWatcherEditAfterLoad(t *testing.T) {
+	fsys := &editingFS{
+		MapFS: fstest.MapFS{"app.toml": {Data: []byte(`port = 80`)}},
+		name:  "app.toml",
+		edit:  &fstest.MapFile{Data: []byte(`port = 8080`), ModTime: time.Unix(1, 0)},
+	}
+	w := New(fsys, newTestConfig, "app.toml")
+	if value, err := w.reload(); err != nil || value.(*testConfig).Port != 80 {
+		t.Fatalf("unexpected load: %v, %v", value, err)
+	}
+	if !w.changed() {
+		t.Fatal("edit made after the file was read not detected")
+	}
+	if value, err := w.reload(); err != nil || value.(*testConfig).Port != 8080 {
+		t.Fatalf("unexpected reload: %v, %v", value, err)
+	}
+	if w.changed() {
+		t.Error("no file changed")
+	}
+}
+
+func TestWatcherUpdates(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.toml")
+	if err := os.WriteFile(path, []byte(`port = 80`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var changes []interface{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := New(os.DirFS(dir), newTestConfig, "app.toml").
+		Interval(10 * time.Millisecond).
+		OnChange(func(v interface{}) { changes = append(changes, v) }).
+		Updates(ctx)
+
+	u := <-updates
+	if u.Err != nil || u.Value.(*testConfig).Port != 80 {
+		t.Fatalf("unexpected update: %+v", u)
+	}
+
+	if err := os.WriteFile(path, []byte(`port = 8080`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case u = <-updates:
+	case <-time.After(5 * time.Second):
+		t.Fatal("change not detected")
+	}
+	if u.Err != nil || u.Value.(*testConfig).Port != 8080 {
+		t.Fatalf("unexpected update: %+v", u)
+	}
+
+	cancel()
+	for range updates {
+	}
+	if len(changes) != 2 {
+		t.Errorf("expected 2 changes, got %d", len(changes))
+	}
+}
+
+func TestWatcherInterval(t *testing.T) {
+	fsys := fstest.MapFS{"app.toml": {Data: []byte(`port = 80`)}}
+	for _, d := range []time.Duration{0, -time.Second} {
+		w := New(fsys, newTestConfig, "app.toml").Interval(d)
+		if w.interval != DefaultInterval {
+			t.Errorf("Interval(%s): expected %s, got %s", d, DefaultInterval, w.interval)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err := w.Run(ctx)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Errorf("Interval(%s): unexpected error %v", d, err)
+		}
+	}
+}